@@ -0,0 +1,655 @@
+// Copyright 2017 Qubit Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dubber
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	klog "k8s.io/klog/v2"
+)
+
+// AuthoritativeConfig describes a zone served directly by dubber.
+type AuthoritativeConfig struct {
+	BaseProvisionerConfig `json:",omitempty,inline" yaml:",omitempty,inline"`
+	// Listen is the address to serve DNS on, over UDP and TCP, defaults
+	// to :53. Zones with the same listen address share a server.
+	Listen string `yaml:"listen" json:"listen"`
+	// Nameservers are the NS records for the zone, the first is used as
+	// the primary nameserver in the SOA record.
+	Nameservers []string `yaml:"nameservers" json:"nameservers"`
+	// Hostmaster is the mailbox of the SOA record, defaults to
+	// hostmaster.ZONE
+	Hostmaster string `yaml:"hostmaster" json:"hostmaster"`
+	// TTL is the TTL of the SOA and NS records, defaults to 3600.
+	TTL uint32 `yaml:"ttl" json:"ttl"`
+	// NegativeTTL is the SOA minimum, used for caching negative answers,
+	// defaults to 60.
+	NegativeTTL uint32 `yaml:"negativeTTL" json:"negativeTTL"`
+	// Secondaries are the IP:port addresses of secondary servers, which
+	// are allowed to transfer the zone, and are sent a NOTIFY when it
+	// changes.
+	Secondaries []string `yaml:"secondaries" json:"secondaries"`
+	// AllowTransfer lists additional networks, in CIDR notation, that are
+	// allowed to transfer the zone.
+	AllowTransfer []string `yaml:"allowTransfer" json:"allowTransfer"`
+	// History is the number of changes kept for IXFR, defaults to 10.
+	History int `yaml:"history" json:"history"`
+}
+
+// Authoritative is a provisioner that serves its zone from memory. The
+// zone starts out with just SOA and NS records, with a serial taken from
+// the current time. Queries are answered for the zone's records, following
+// CNAMEs within the zone, synthesising answers from wildcards, and
+// referring queries to delegated subdomains. AXFR and IXFR are supported
+// over TCP, and secondaries are sent a NOTIFY after each change.
+type Authoritative struct {
+	*AuthoritativeConfig
+	origin      string
+	secondaries []string
+	allowed     []*net.IPNet
+
+	sync.RWMutex
+	zone Zone
+	soa  *dns.SOA
+	// names holds the records for each owner name, nonTerminals holds the
+	// names that only exist as ancestors of other names.
+	names        map[string]Zone
+	nonTerminals map[string]bool
+	history      []authChange
+}
+
+// authChange is a single change to the zone, as sent in an IXFR.
+type authChange struct {
+	from, to       *dns.SOA
+	removed, added []dns.RR
+}
+
+// listenAddr returns the address to serve the zone on.
+func (cfg *AuthoritativeConfig) listenAddr() string {
+	if cfg.Listen == "" {
+		return ":53"
+	}
+	return cfg.Listen
+}
+
+// NewAuthoritative creates a provisioner that serves the zone itself.
+func NewAuthoritative(cfg *AuthoritativeConfig) (*Authoritative, error) {
+	if len(cfg.Nameservers) == 0 {
+		return nil, fmt.Errorf("authoritative zone %s must have nameservers", cfg.Zone)
+	}
+
+	a := &Authoritative{
+		AuthoritativeConfig: cfg,
+		origin:              strings.ToLower(dns.Fqdn(cfg.Zone)),
+	}
+
+	for _, s := range cfg.Secondaries {
+		host, port, err := net.SplitHostPort(s)
+		if err != nil {
+			host, port = s, "53"
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return nil, fmt.Errorf("secondary %q must be an IP address", s)
+		}
+		a.secondaries = append(a.secondaries, net.JoinHostPort(host, port))
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		a.allowed = append(a.allowed, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	for _, s := range cfg.AllowTransfer {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowTransfer network, %w", err)
+		}
+		a.allowed = append(a.allowed, ipnet)
+	}
+
+	ttl := cfg.TTL
+	if ttl == 0 {
+		ttl = 3600
+	}
+	negttl := cfg.NegativeTTL
+	if negttl == 0 {
+		negttl = 60
+	}
+	hostmaster := cfg.Hostmaster
+	if hostmaster == "" {
+		hostmaster = "hostmaster." + a.origin
+	}
+
+	z := Zone{&Record{RR: &dns.SOA{
+		Hdr:     dns.RR_Header{Name: a.origin, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:      dns.Fqdn(cfg.Nameservers[0]),
+		Mbox:    dns.Fqdn(hostmaster),
+		Serial:  uint32(time.Now().Unix()),
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  604800,
+		Minttl:  negttl,
+	}}}
+	for _, ns := range cfg.Nameservers {
+		z = append(z, &Record{RR: &dns.NS{
+			Hdr: dns.RR_Header{Name: a.origin, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: ttl},
+			Ns:  dns.Fqdn(ns),
+		}})
+	}
+	a.setZone(z)
+
+	return a, nil
+}
+
+// GroupFlags is empty for the authoritative server
+func (a *Authoritative) GroupFlags() []string {
+	return nil
+}
+
+// setZone replaces the served zone, and indexes its records. The caller
+// must hold the write lock.
+func (a *Authoritative) setZone(z Zone) {
+	sort.Sort(ByRR(z))
+	a.zone = z
+	a.names = map[string]Zone{}
+	a.nonTerminals = map[string]bool{}
+	for _, r := range z {
+		name := strings.ToLower(r.Header().Name)
+		a.names[name] = append(a.names[name], r)
+		if soa, ok := r.RR.(*dns.SOA); ok {
+			a.soa = soa
+		}
+		for n := name; n != a.origin && dns.IsSubDomain(a.origin, n); {
+			n = parentName(n)
+			a.nonTerminals[n] = true
+		}
+	}
+}
+
+func parentName(n string) string {
+	i := strings.Index(n, ".")
+	if i == -1 || i == len(n)-1 {
+		return "."
+	}
+	return n[i+1:]
+}
+
+// RemoteZone returns the zone currently being served.
+func (a *Authoritative) RemoteZone() (Zone, error) {
+	a.RLock()
+	defer a.RUnlock()
+	return append(Zone(nil), a.zone...), nil
+}
+
+// UpdateZone updates the zone being served, and sends a NOTIFY to the
+// secondaries.
+func (a *Authoritative) UpdateZone(wanted, unwanted, desired, remote Zone) error {
+	var from, to *dns.SOA
+	for _, uw := range unwanted {
+		if s, ok := uw.RR.(*dns.SOA); ok {
+			from = s
+		}
+	}
+	for _, w := range wanted {
+		if s, ok := w.RR.(*dns.SOA); ok {
+			to = s
+		}
+	}
+	if from == nil || to == nil {
+		return fmt.Errorf("no SOA record to update for zone %s", a.Zone)
+	}
+
+	a.Lock()
+	if from.Serial != a.soa.Serial {
+		a.Unlock()
+		return fmt.Errorf("zone %s serial has changed from %d to %d", a.Zone, from.Serial, a.soa.Serial)
+	}
+
+	change := authChange{from: a.soa}
+	var z Zone
+nextRecord:
+	for _, r := range a.zone {
+		for _, u := range unwanted {
+			if r.Compare(u) == 0 {
+				if r.Header().Rrtype != dns.TypeSOA {
+					change.removed = append(change.removed, r.RR)
+				}
+				continue nextRecord
+			}
+		}
+		z = append(z, r)
+	}
+	z = append(z, wanted...)
+	sort.Sort(ByRR(z))
+	z = Zone(ByRR(z).Dedupe())
+	a.setZone(z)
+
+	for _, w := range wanted {
+		if w.Header().Rrtype != dns.TypeSOA {
+			change.added = append(change.added, w.RR)
+		}
+	}
+	change.to = a.soa
+
+	history := a.History
+	if history == 0 {
+		history = 10
+	}
+	a.history = append(a.history, change)
+	if len(a.history) > history {
+		a.history = a.history[len(a.history)-history:]
+	}
+	a.Unlock()
+
+	klog.V(1).Infof("authoritative zone %s updated to serial %d", a.Zone, change.to.Serial)
+
+	for _, s := range a.secondaries {
+		go a.notify(s)
+	}
+
+	return nil
+}
+
+// notify sends a NOTIFY for the zone to a secondary, retrying a few times
+// if it does not respond.
+func (a *Authoritative) notify(addr string) {
+	m := new(dns.Msg)
+	m.SetNotify(a.origin)
+	c := &dns.Client{Timeout: 5 * time.Second}
+
+	var err error
+	for i := 0; i < 3; i++ {
+		var resp *dns.Msg
+		resp, _, err = c.Exchange(m, addr)
+		if err == nil && resp.Rcode != dns.RcodeSuccess {
+			err = fmt.Errorf("%s", dns.RcodeToString[resp.Rcode])
+		}
+		if err == nil {
+			return
+		}
+		time.Sleep(time.Second)
+	}
+	klog.Errorf("notify of zone %s to %s failed, %v", a.Zone, addr, err)
+}
+
+// ServeDNS answers queries for the zone.
+func (a *Authoritative) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Compress = true
+
+	if r.Opcode != dns.OpcodeQuery {
+		m.SetRcode(r, dns.RcodeNotImplemented)
+		w.WriteMsg(m)
+		return
+	}
+	if len(r.Question) != 1 {
+		m.SetRcode(r, dns.RcodeFormatError)
+		w.WriteMsg(m)
+		return
+	}
+
+	q := r.Question[0]
+	if q.Qtype == dns.TypeAXFR || q.Qtype == dns.TypeIXFR {
+		a.transfer(w, r)
+		return
+	}
+
+	a.RLock()
+	a.answer(m, q)
+	a.RUnlock()
+
+	size := dns.MinMsgSize
+	if opt := r.IsEdns0(); opt != nil {
+		m.SetEdns0(opt.UDPSize(), false)
+		size = int(opt.UDPSize())
+	}
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+		size = dns.MaxMsgSize
+	}
+	m.Truncate(size)
+
+	w.WriteMsg(m)
+}
+
+// answer fills in the response to a question, following the algorithm of
+// RFC 1034 section 4.3.2. The caller must hold the read lock.
+func (a *Authoritative) answer(m *dns.Msg, q dns.Question) {
+	name := strings.ToLower(q.Name)
+	if !dns.IsSubDomain(a.origin, name) {
+		m.Rcode = dns.RcodeRefused
+		return
+	}
+	m.Authoritative = true
+
+	seen := map[string]bool{}
+	for !seen[name] {
+		seen[name] = true
+
+		if ns := a.delegation(name); ns != nil {
+			m.Authoritative = false
+			m.Ns = append(m.Ns, ns...)
+			m.Extra = append(m.Extra, a.glue(ns)...)
+			return
+		}
+
+		rrs, ok := a.lookup(name, q.Name)
+		if !ok {
+			m.Rcode = dns.RcodeNameError
+			m.Ns = append(m.Ns, a.negativeSOA())
+			return
+		}
+
+		var matched []dns.RR
+		var cname *dns.CNAME
+		for _, rr := range rrs {
+			switch {
+			case rr.Header().Rrtype == q.Qtype, q.Qtype == dns.TypeANY:
+				matched = append(matched, rr)
+			case rr.Header().Rrtype == dns.TypeCNAME:
+				cname = rr.(*dns.CNAME)
+			}
+		}
+
+		switch {
+		case len(matched) != 0:
+			m.Answer = append(m.Answer, matched...)
+			m.Extra = append(m.Extra, a.glue(matched)...)
+			return
+		case cname != nil:
+			m.Answer = append(m.Answer, cname)
+			name = strings.ToLower(cname.Target)
+			if !dns.IsSubDomain(a.origin, name) {
+				return
+			}
+			q.Name = cname.Target
+		default:
+			m.Ns = append(m.Ns, a.negativeSOA())
+			return
+		}
+	}
+}
+
+// lookup returns copies of the records for a name, synthesising them
+// from a wildcard if needed. It returns false if the name does not
+// exist.
+func (a *Authoritative) lookup(name, qname string) ([]dns.RR, bool) {
+	if rrs, ok := a.names[name]; ok {
+		return copyRRs(rrs, ""), true
+	}
+	if a.nonTerminals[name] {
+		return nil, true
+	}
+
+	// Find the closest encloser, and check for a wildcard below it.
+	n := name
+	for n != a.origin {
+		n = parentName(n)
+		if _, ok := a.names[n]; ok || a.nonTerminals[n] {
+			break
+		}
+	}
+	if rrs, ok := a.names["*."+n]; ok {
+		return copyRRs(rrs, qname), true
+	}
+	return nil, false
+}
+
+// delegation returns the NS records of a delegated subdomain containing
+// name, if there is one.
+func (a *Authoritative) delegation(name string) []dns.RR {
+	var ns []dns.RR
+	for n := name; n != a.origin && dns.IsSubDomain(a.origin, n); n = parentName(n) {
+		for _, r := range a.names[n] {
+			if r.Header().Rrtype == dns.TypeNS {
+				ns = append(ns, dns.Copy(r.RR))
+			}
+		}
+		if ns != nil {
+			return ns
+		}
+	}
+	return nil
+}
+
+// glue returns the in-zone addresses of the targets of NS, MX and SRV
+// records.
+func (a *Authoritative) glue(rrs []dns.RR) []dns.RR {
+	var extra []dns.RR
+	for _, rr := range rrs {
+		var target string
+		switch rr := rr.(type) {
+		case *dns.NS:
+			target = rr.Ns
+		case *dns.MX:
+			target = rr.Mx
+		case *dns.SRV:
+			target = rr.Target
+		default:
+			continue
+		}
+		for _, r := range a.names[strings.ToLower(target)] {
+			if t := r.Header().Rrtype; t == dns.TypeA || t == dns.TypeAAAA {
+				extra = append(extra, dns.Copy(r.RR))
+			}
+		}
+	}
+	return extra
+}
+
+// negativeSOA is the SOA record included in negative answers, with a TTL
+// of the SOA minimum, as per RFC 2308.
+func (a *Authoritative) negativeSOA() dns.RR {
+	soa := dns.Copy(a.soa)
+	if a.soa.Minttl < soa.Header().Ttl {
+		soa.Header().Ttl = a.soa.Minttl
+	}
+	return soa
+}
+
+func copyRRs(z Zone, owner string) []dns.RR {
+	rrs := make([]dns.RR, 0, len(z))
+	for _, r := range z {
+		rr := dns.Copy(r.RR)
+		if owner != "" {
+			rr.Header().Name = owner
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+func (a *Authoritative) transferAllowed(addr net.Addr) bool {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	}
+	for _, n := range a.allowed {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// transfer answers AXFR and IXFR queries. Over UDP, and for an IXFR from
+// the current serial, just the current SOA is returned. An IXFR from a
+// serial older than the kept history is answered with the full zone.
+func (a *Authoritative) transfer(w dns.ResponseWriter, r *dns.Msg) {
+	q := r.Question[0]
+	if !a.transferAllowed(w.RemoteAddr()) || strings.ToLower(q.Name) != a.origin {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeRefused)
+		w.WriteMsg(m)
+		return
+	}
+
+	a.RLock()
+	soa := dns.Copy(a.soa)
+	var rrs []dns.RR
+	switch {
+	case q.Qtype == dns.TypeIXFR && len(r.Ns) == 1:
+		serial := uint32(0)
+		if s, ok := r.Ns[0].(*dns.SOA); ok {
+			serial = s.Serial
+		}
+		rrs = a.ixfr(serial)
+	case q.Qtype == dns.TypeAXFR:
+		if _, ok := w.RemoteAddr().(*net.TCPAddr); !ok {
+			a.RUnlock()
+			m := new(dns.Msg)
+			m.SetRcode(r, dns.RcodeRefused)
+			w.WriteMsg(m)
+			return
+		}
+	}
+	if rrs == nil {
+		rrs = a.axfr()
+	}
+	a.RUnlock()
+
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); !ok {
+		rrs = []dns.RR{soa}
+	}
+
+	ch := make(chan *dns.Envelope)
+	go func() {
+		defer close(ch)
+		for len(rrs) > 0 {
+			n := 100
+			if n > len(rrs) {
+				n = len(rrs)
+			}
+			ch <- &dns.Envelope{RR: rrs[:n]}
+			rrs = rrs[n:]
+		}
+	}()
+	if err := new(dns.Transfer).Out(w, r, ch); err != nil {
+		klog.Errorf("transfer of zone %s to %s failed, %v", a.Zone, w.RemoteAddr(), err)
+		for range ch {
+		}
+	}
+}
+
+// axfr returns the records of a full zone transfer. The caller must hold
+// the read lock.
+func (a *Authoritative) axfr() []dns.RR {
+	rrs := []dns.RR{a.soa}
+	for _, r := range a.zone {
+		if r.Header().Rrtype != dns.TypeSOA {
+			rrs = append(rrs, r.RR)
+		}
+	}
+	return append(rrs, a.soa)
+}
+
+// ixfr returns the records of an incremental transfer from the given
+// serial, or nil if the serial is not in the kept history. The caller must
+// hold the read lock.
+func (a *Authoritative) ixfr(serial uint32) []dns.RR {
+	if serial == a.soa.Serial {
+		return []dns.RR{a.soa}
+	}
+	for i, c := range a.history {
+		if c.from.Serial != serial {
+			continue
+		}
+		rrs := []dns.RR{a.soa}
+		for _, c := range a.history[i:] {
+			rrs = append(rrs, c.from)
+			rrs = append(rrs, c.removed...)
+			rrs = append(rrs, c.to)
+			rrs = append(rrs, c.added...)
+		}
+		return append(rrs, a.soa)
+	}
+	return nil
+}
+
+// serveAuthoritative starts DNS servers for the zones of any Authoritative
+// provisioners, until the context is cancelled.
+func serveAuthoritative(ctx context.Context, provs map[string][]NamedProvisioner) error {
+	muxes := map[string]*dns.ServeMux{}
+	for _, ps := range provs {
+		for _, np := range ps {
+			a, ok := unwrapProvisioner(np).(*Authoritative)
+			if !ok {
+				continue
+			}
+			listen := a.listenAddr()
+			if _, ok := muxes[listen]; !ok {
+				muxes[listen] = dns.NewServeMux()
+			}
+			muxes[listen].Handle(a.origin, a)
+		}
+	}
+
+	for listen, mux := range muxes {
+		addr, err := listenDNS(ctx, listen, mux)
+		if err != nil {
+			return fmt.Errorf("could not serve dns on %s, %w", listen, err)
+		}
+		klog.Infof("serving dns on %s", addr)
+	}
+	return nil
+}
+
+// listenDNS serves DNS over UDP and TCP on the same address, until the
+// context is cancelled. It returns the address being listened on.
+func listenDNS(ctx context.Context, listen string, h dns.Handler) (net.Addr, error) {
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenPacket("udp", l.Addr().String())
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	servers := []*dns.Server{
+		{Listener: l, Handler: h, NotifyStartedFunc: wg.Done},
+		{PacketConn: pc, Handler: h, NotifyStartedFunc: wg.Done},
+	}
+	for _, s := range servers {
+		go func(s *dns.Server) {
+			if err := s.ActivateAndServe(); err != nil {
+				klog.Errorf("dns server on %s failed, %v", l.Addr(), err)
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	go func() {
+		<-ctx.Done()
+		for _, s := range servers {
+			s.Shutdown()
+		}
+	}()
+
+	return l.Addr(), nil
+}
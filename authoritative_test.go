@@ -0,0 +1,355 @@
+package dubber
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestAuthoritative(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A secondary, which just records NOTIFYs
+	notifies := make(chan string, 10)
+	secondary, err := listenDNS(ctx, "127.0.0.1:0", dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Opcode == dns.OpcodeNotify {
+			notifies <- r.Question[0].Name
+		}
+		m := new(dns.Msg)
+		m.SetReply(r)
+		w.WriteMsg(m)
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	cfg := &AuthoritativeConfig{
+		Nameservers: []string{"ns1.example.com", "ns2.example.net"},
+		Secondaries: []string{secondary.String()},
+	}
+	cfg.Zone = "example.com."
+	a, err := NewAuthoritative(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	addr, err := listenDNS(ctx, "127.0.0.1:0", a)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	remz, err := a.RemoteZone()
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	var soa *Record
+	for _, r := range remz {
+		if _, ok := r.RR.(*dns.SOA); ok {
+			soa = r
+		}
+	}
+	serial := soa.RR.(*dns.SOA).Serial
+
+	desired, err := ParseZoneData(bytes.NewBufferString(`
+ns1.example.com. 300 IN A 10.0.0.1
+www.example.com. 300 IN A 10.0.0.2
+alias.example.com. 300 IN CNAME www.example.com.
+ext.example.com. 300 IN CNAME www.example.net.
+dangling.example.com. 300 IN CNAME missing.example.com.
+loop1.example.com. 300 IN CNAME loop2.example.com.
+loop2.example.com. 300 IN CNAME loop1.example.com.
+*.apps.example.com. 60 IN A 10.0.1.1
+x.y.deep.example.com. 300 IN TXT "deep"
+example.com. 300 IN MX 10 www.example.com.
+sub.example.com. 300 IN NS ns.sub.example.com.
+ns.sub.example.com. 300 IN A 10.0.2.1
+`))
+	if err != nil {
+		t.Fatalf("error parsing desired zone, %v", err)
+	}
+
+	var srv *Server
+	if err := srv.ReconcileZone(a, desired); err != nil {
+		t.Fatalf("error reconciling zone, %v", err)
+	}
+
+	select {
+	case z := <-notifies:
+		if z != "example.com." {
+			t.Fatalf("unexpected notify for %s", z)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no notify received")
+	}
+
+	tests := []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		aa     bool
+		answer []string
+		ns     []string
+		extra  []string
+	}{
+		{
+			name:   "www.example.com.",
+			qtype:  dns.TypeA,
+			aa:     true,
+			answer: []string{"www.example.com.	300	IN	A	10.0.0.2"},
+		},
+		{
+			name:   "WWW.Example.com.",
+			qtype:  dns.TypeA,
+			aa:     true,
+			answer: []string{"www.example.com.	300	IN	A	10.0.0.2"},
+		},
+		{
+			name:   "example.com.",
+			qtype:  dns.TypeNS,
+			aa:     true,
+			answer: []string{"example.com.	3600	IN	NS	ns1.example.com.", "example.com.	3600	IN	NS	ns2.example.net."},
+			extra:  []string{"ns1.example.com.	300	IN	A	10.0.0.1"},
+		},
+		{
+			name:   "example.com.",
+			qtype:  dns.TypeMX,
+			aa:     true,
+			answer: []string{"example.com.	300	IN	MX	10 www.example.com."},
+			extra:  []string{"www.example.com.	300	IN	A	10.0.0.2"},
+		},
+		{
+			// NODATA
+			name:  "www.example.com.",
+			qtype: dns.TypeAAAA,
+			aa:    true,
+			ns:    []string{"SOA"},
+		},
+		{
+			// Empty non-terminal
+			name:  "y.deep.example.com.",
+			qtype: dns.TypeA,
+			aa:    true,
+			ns:    []string{"SOA"},
+		},
+		{
+			name:  "nothing.example.com.",
+			qtype: dns.TypeA,
+			rcode: dns.RcodeNameError,
+			aa:    true,
+			ns:    []string{"SOA"},
+		},
+		{
+			name:  "example.org.",
+			qtype: dns.TypeA,
+			rcode: dns.RcodeRefused,
+		},
+		{
+			name:   "alias.example.com.",
+			qtype:  dns.TypeA,
+			aa:     true,
+			answer: []string{"alias.example.com.	300	IN	CNAME	www.example.com.", "www.example.com.	300	IN	A	10.0.0.2"},
+		},
+		{
+			name:   "alias.example.com.",
+			qtype:  dns.TypeCNAME,
+			aa:     true,
+			answer: []string{"alias.example.com.	300	IN	CNAME	www.example.com."},
+		},
+		{
+			name:   "ext.example.com.",
+			qtype:  dns.TypeA,
+			aa:     true,
+			answer: []string{"ext.example.com.	300	IN	CNAME	www.example.net."},
+		},
+		{
+			name:   "dangling.example.com.",
+			qtype:  dns.TypeA,
+			rcode:  dns.RcodeNameError,
+			aa:     true,
+			answer: []string{"dangling.example.com.	300	IN	CNAME	missing.example.com."},
+			ns:     []string{"SOA"},
+		},
+		{
+			name:   "loop1.example.com.",
+			qtype:  dns.TypeA,
+			aa:     true,
+			answer: []string{"loop1.example.com.	300	IN	CNAME	loop2.example.com.", "loop2.example.com.	300	IN	CNAME	loop1.example.com."},
+		},
+		{
+			name:   "web.apps.example.com.",
+			qtype:  dns.TypeA,
+			aa:     true,
+			answer: []string{"web.apps.example.com.	60	IN	A	10.0.1.1"},
+		},
+		{
+			name:   "a.b.apps.example.com.",
+			qtype:  dns.TypeA,
+			aa:     true,
+			answer: []string{"a.b.apps.example.com.	60	IN	A	10.0.1.1"},
+		},
+		{
+			// The wildcard does not apply to the closest encloser itself
+			name:  "apps.example.com.",
+			qtype: dns.TypeA,
+			aa:    true,
+			ns:    []string{"SOA"},
+		},
+		{
+			// Referral
+			name:  "host.sub.example.com.",
+			qtype: dns.TypeA,
+			ns:    []string{"sub.example.com.	300	IN	NS	ns.sub.example.com."},
+			extra: []string{"ns.sub.example.com.	300	IN	A	10.0.2.1"},
+		},
+	}
+
+	c := &dns.Client{Timeout: 5 * time.Second}
+	rrStrs := func(rrs []dns.RR) []string {
+		var strs []string
+		for _, rr := range rrs {
+			if soa, ok := rr.(*dns.SOA); ok {
+				if soa.Hdr.Ttl != 60 {
+					t.Errorf("expected negative answer SOA ttl of 60, got %d", soa.Hdr.Ttl)
+				}
+				strs = append(strs, "SOA")
+				continue
+			}
+			strs = append(strs, rr.String())
+		}
+		return strs
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+" "+dns.TypeToString[tt.qtype], func(t *testing.T) {
+			m := new(dns.Msg)
+			m.SetQuestion(tt.name, tt.qtype)
+			resp, _, err := c.Exchange(m, addr.String())
+			if err != nil {
+				t.Fatalf("unexpected error, %v", err)
+			}
+			if resp.Rcode != tt.rcode {
+				t.Errorf("expected rcode %s, got %s", dns.RcodeToString[tt.rcode], dns.RcodeToString[resp.Rcode])
+			}
+			if resp.Authoritative != tt.aa {
+				t.Errorf("expected aa %v, got %v", tt.aa, resp.Authoritative)
+			}
+			for _, sec := range []struct {
+				name     string
+				exp, got []string
+			}{
+				{"answer", tt.answer, rrStrs(resp.Answer)},
+				{"authority", tt.ns, rrStrs(resp.Ns)},
+				{"additional", tt.extra, rrStrs(resp.Extra)},
+			} {
+				if strings.Join(sec.exp, "\n") != strings.Join(sec.got, "\n") {
+					t.Errorf("%s section\n  expected:\n%s\n  got:\n%s", sec.name, strings.Join(sec.exp, "\n"), strings.Join(sec.got, "\n"))
+				}
+			}
+		})
+	}
+
+	// AXFR
+	m := new(dns.Msg)
+	m.SetAxfr("example.com.")
+	got := transferIn(t, m, addr.String())
+	remz, _ = a.RemoteZone()
+	if len(got) != len(remz)+1 {
+		t.Fatalf("expected %d records in AXFR, got %d:\n%v", len(remz)+1, len(got), got)
+	}
+
+	// IXFR from the serial of the first update
+	desired = append(desired[1:], &Record{RR: &dns.A{
+		Hdr: dns.RR_Header{Name: "new.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.ParseIP("10.0.0.3"),
+	}})
+	if err := srv.ReconcileZone(a, desired); err != nil {
+		t.Fatalf("error reconciling zone, %v", err)
+	}
+	m = new(dns.Msg)
+	m.SetIxfr("example.com.", serial+1, "ns1.example.com.", "hostmaster.example.com.")
+	got = transferIn(t, m, addr.String())
+	var strs []string
+	for _, rr := range got {
+		strs = append(strs, rr.String())
+	}
+	exp := []string{
+		"example.com.	3600	IN	SOA	ns1.example.com. hostmaster.example.com. " + strconv.Itoa(int(serial+2)) + " 3600 600 604800 60",
+		"example.com.	3600	IN	SOA	ns1.example.com. hostmaster.example.com. " + strconv.Itoa(int(serial+1)) + " 3600 600 604800 60",
+		"example.com.	3600	IN	SOA	ns1.example.com. hostmaster.example.com. " + strconv.Itoa(int(serial+2)) + " 3600 600 604800 60",
+		"new.example.com.	300	IN	A	10.0.0.3",
+		"example.com.	3600	IN	SOA	ns1.example.com. hostmaster.example.com. " + strconv.Itoa(int(serial+2)) + " 3600 600 604800 60",
+	}
+	if strings.Join(strs, "\n") != strings.Join(exp, "\n") {
+		t.Fatalf("IXFR\n  expected:\n%s\n  got:\n%s", strings.Join(exp, "\n"), strings.Join(strs, "\n"))
+	}
+
+	// Stale updates are refused
+	if err := a.UpdateZone(Zone{soa}, Zone{soa}, nil, nil); err == nil {
+		t.Fatalf("expected update with stale SOA to fail")
+	}
+
+	if a.transferAllowed(&net.TCPAddr{IP: net.ParseIP("10.1.1.1")}) {
+		t.Fatalf("expected transfers from other addresses to be refused")
+	}
+}
+
+func transferIn(t *testing.T, m *dns.Msg, addr string) []dns.RR {
+	t.Helper()
+	ch, err := new(dns.Transfer).In(m, addr)
+	if err != nil {
+		t.Fatalf("transfer failed, %v", err)
+	}
+	var rrs []dns.RR
+	for env := range ch {
+		if env.Error != nil {
+			t.Fatalf("transfer failed, %v", env.Error)
+		}
+		rrs = append(rrs, env.RR...)
+	}
+	return rrs
+}
+
+func TestAuthoritative_DuplicateZone(t *testing.T) {
+	build := func(yaml string) error {
+		cfg, err := FromYAML(strings.NewReader(yaml))
+		if err != nil {
+			t.Fatalf("unexpected error, %v", err)
+		}
+		_, err = cfg.BuildProvisioners()
+		return err
+	}
+
+	err := build(`
+provisioners:
+  authoritative:
+    - zone: example.com.
+      nameservers: [ns1.example.com]
+    - zone: Example.com
+      listen: ":53"
+      nameservers: [ns2.example.com]
+`)
+	if err == nil || !strings.Contains(err.Error(), "both serve zone example.com. on :53") {
+		t.Fatalf("expected an error for a zone served twice, got %v", err)
+	}
+
+	// The same zone may be served on different addresses
+	err = build(`
+provisioners:
+  authoritative:
+    - zone: example.com.
+      listen: 127.0.0.1:5301
+      nameservers: [ns1.example.com]
+    - zone: example.com.
+      listen: 127.0.0.1:5302
+      nameservers: [ns1.example.com]
+`)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+}
@@ -0,0 +1,581 @@
+// Copyright 2017 Qubit Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dubber
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/miekg/dns"
+	klog "k8s.io/klog/v2"
+)
+
+// AzureDNSConfig describes the settings required for managing an Azure DNS
+// zone, or an Azure Private DNS zone.
+type AzureDNSConfig struct {
+	BaseProvisionerConfig `json:",omitempty,inline" yaml:",omitempty,inline"`
+	SubscriptionID        string `yaml:"subscriptionID" json:"subscriptionID"`
+	ResourceGroup         string `yaml:"resourceGroup" json:"resourceGroup"`
+	// Private selects an Azure Private DNS zone, rather than a public
+	// Azure DNS zone.
+	Private bool `yaml:"private" json:"private"`
+	// URL is the base URL of the Azure Resource Manager API, defaults to
+	// https://management.azure.com
+	URL     string        `yaml:"url" json:"url"`
+	Timeout time.Duration `yaml:"timeout" json:"timeout"`
+}
+
+// AzureDNS is an Azure DNS and Azure Private DNS record provisioner.
+// Credentials are found using the Azure SDK's default credential chain
+// (environment, workload identity, managed identity, or the Azure CLI).
+// This provision uses the following flags:
+//   - azure.Metadata.KEY: Set the KEY metadata of the record set, values
+//     may not contain spaces
+//
+// Record sets read by RemoteZone are only updated, or deleted, if their
+// ETag is unchanged, and new record sets are only created if they do not
+// already exist. The SOA record set is updated first, so that a concurrent
+// update of the zone fails before any other changes are made.
+type AzureDNS struct {
+	*AzureDNSConfig
+	cred   azcore.TokenCredential
+	client *http.Client
+
+	sync.Mutex
+	// etags holds the ETag of each record set read by RemoteZone.
+	etags map[RecordSetKey]string
+}
+
+type azureRecordSet struct {
+	Name       string                   `json:"name,omitempty"`
+	Type       string                   `json:"type,omitempty"`
+	Etag       string                   `json:"etag,omitempty"`
+	Properties azureRecordSetProperties `json:"properties"`
+}
+
+// azureRecordSetProperties uses the property names of the public DNS API,
+// JSON decoding is case insensitive, so these are also used to read Private
+// DNS record sets.
+type azureRecordSetProperties struct {
+	Fqdn        string            `json:"fqdn,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	TTL         uint32            `json:"TTL"`
+	ARecords    []azureA          `json:"ARecords,omitempty"`
+	AAAARecords []azureAAAA       `json:"AAAARecords,omitempty"`
+	CNAMERecord *azureCNAME       `json:"CNAMERecord,omitempty"`
+	MXRecords   []azureMX         `json:"MXRecords,omitempty"`
+	NSRecords   []azureNS         `json:"NSRecords,omitempty"`
+	PTRRecords  []azurePTR        `json:"PTRRecords,omitempty"`
+	SRVRecords  []azureSRV        `json:"SRVRecords,omitempty"`
+	TXTRecords  []azureTXT        `json:"TXTRecords,omitempty"`
+	CAARecords  []azureCAA        `json:"caaRecords,omitempty"`
+	SOARecord   *azureSOA         `json:"SOARecord,omitempty"`
+}
+
+// azurePrivateKeys maps the property names used by the public DNS API to
+// those used by the Private DNS API.
+var azurePrivateKeys = map[string]string{
+	"TTL":         "ttl",
+	"ARecords":    "aRecords",
+	"AAAARecords": "aaaaRecords",
+	"CNAMERecord": "cnameRecord",
+	"MXRecords":   "mxRecords",
+	"PTRRecords":  "ptrRecords",
+	"SRVRecords":  "srvRecords",
+	"TXTRecords":  "txtRecords",
+	"SOARecord":   "soaRecord",
+}
+
+type azureA struct {
+	IPv4Address string `json:"ipv4Address"`
+}
+
+type azureAAAA struct {
+	IPv6Address string `json:"ipv6Address"`
+}
+
+type azureCNAME struct {
+	CNAME string `json:"cname"`
+}
+
+type azureMX struct {
+	Preference uint16 `json:"preference"`
+	Exchange   string `json:"exchange"`
+}
+
+type azureNS struct {
+	NSDName string `json:"nsdname"`
+}
+
+type azurePTR struct {
+	PTRDName string `json:"ptrdname"`
+}
+
+type azureSRV struct {
+	Priority uint16 `json:"priority"`
+	Weight   uint16 `json:"weight"`
+	Port     uint16 `json:"port"`
+	Target   string `json:"target"`
+}
+
+type azureTXT struct {
+	Value []string `json:"value"`
+}
+
+type azureCAA struct {
+	Flags uint8  `json:"flags"`
+	Tag   string `json:"tag"`
+	Value string `json:"value"`
+}
+
+type azureSOA struct {
+	Host         string `json:"host"`
+	Email        string `json:"email"`
+	SerialNumber uint32 `json:"serialNumber"`
+	RefreshTime  uint32 `json:"refreshTime"`
+	RetryTime    uint32 `json:"retryTime"`
+	ExpireTime   uint32 `json:"expireTime"`
+	MinimumTTL   uint32 `json:"minimumTTL"`
+}
+
+// NewAzureDNS creates an Azure DNS provisioner.
+func NewAzureDNS(cfg *AzureDNSConfig) (*AzureDNS, error) {
+	cred, err := azidentity.NewDefaultAzureCredential(nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not find azure credentials, %w", err)
+	}
+	return newAzureDNS(cfg, cred)
+}
+
+func newAzureDNS(cfg *AzureDNSConfig, cred azcore.TokenCredential) (*AzureDNS, error) {
+	if cfg.SubscriptionID == "" || cfg.ResourceGroup == "" {
+		return nil, fmt.Errorf("azure subscriptionID and resourceGroup must be set")
+	}
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	return &AzureDNS{
+		AzureDNSConfig: cfg,
+		cred:           cred,
+		client:         &http.Client{Timeout: timeout},
+	}, nil
+}
+
+// GroupFlags is empty for Azure DNS
+func (a *AzureDNS) GroupFlags() []string {
+	return nil
+}
+
+func (a *AzureDNS) baseURL() string {
+	if a.URL == "" {
+		return "https://management.azure.com"
+	}
+	return strings.TrimSuffix(a.URL, "/")
+}
+
+func (a *AzureDNS) apiVersion() string {
+	if a.Private {
+		return "2020-06-01"
+	}
+	return "2018-05-01"
+}
+
+func (a *AzureDNS) zoneURL(path string) string {
+	provider := "dnsZones"
+	if a.Private {
+		provider = "privateDnsZones"
+	}
+	return fmt.Sprintf("%s/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Network/%s/%s%s?api-version=%s",
+		a.baseURL(),
+		url.PathEscape(a.SubscriptionID),
+		url.PathEscape(a.ResourceGroup),
+		provider,
+		url.PathEscape(strings.TrimSuffix(a.Zone, ".")),
+		path,
+		a.apiVersion())
+}
+
+func (a *AzureDNS) do(method, u string, hdrs map[string]string, body interface{}, out interface{}) error {
+	ctx := context.Background()
+	tok, err := a.cred.GetToken(ctx, policy.TokenRequestOptions{
+		Scopes: []string{a.baseURL() + "/.default"},
+	})
+	if err != nil {
+		return fmt.Errorf("could not get azure token, %w", err)
+	}
+
+	var rdr io.Reader
+	if body != nil {
+		bs, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rdr = bytes.NewReader(bs)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, rdr)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+tok.Token)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range hdrs {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var aerr struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&aerr)
+		if resp.StatusCode == http.StatusPreconditionFailed {
+			return fmt.Errorf("%s %s, record set has changed since it was read, %s", method, u, aerr.Error.Message)
+		}
+		return fmt.Errorf("%s %s, %s %s %s", method, u, resp.Status, aerr.Error.Code, aerr.Error.Message)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// RemoteZone creates a Zone from the record sets of an Azure DNS zone.
+func (a *AzureDNS) RemoteZone() (Zone, error) {
+	list := "/recordsets"
+	if a.Private {
+		list = "/ALL"
+	}
+
+	var rss []azureRecordSet
+	for u := a.zoneURL(list); u != ""; {
+		var page struct {
+			Value    []azureRecordSet `json:"value"`
+			NextLink string           `json:"nextLink"`
+		}
+		if err := a.do(http.MethodGet, u, nil, nil, &page); err != nil {
+			return nil, fmt.Errorf("could not list record sets for zone %s, %w", a.Zone, err)
+		}
+		rss = append(rss, page.Value...)
+		u = page.NextLink
+	}
+
+	etags := map[RecordSetKey]string{}
+	var z Zone
+	for _, rs := range rss {
+		rrs, err := azureRecordSetToRecords(dns.Fqdn(a.Zone), rs)
+		if err != nil {
+			klog.Infof("ignoring azure record set %s %s, %v", rs.Type, rs.Name, err)
+			continue
+		}
+		for k := range rrs.Group(a.GroupFlags()) {
+			etags[k] = rs.Etag
+		}
+		z = append(z, rrs...)
+	}
+	sort.Sort(ByRR(z))
+
+	a.Lock()
+	a.etags = etags
+	a.Unlock()
+
+	return z, nil
+}
+
+func azureRecordSetToRecords(zone string, rs azureRecordSet) (Zone, error) {
+	rrtype := rs.Type[strings.LastIndex(rs.Type, "/")+1:]
+
+	name := rs.Name + "." + zone
+	switch {
+	case rs.Properties.Fqdn != "":
+		name = dns.Fqdn(rs.Properties.Fqdn)
+	case rs.Name == "@":
+		name = zone
+	}
+
+	p := rs.Properties
+	var rdata []string
+	switch rrtype {
+	case "A":
+		for _, r := range p.ARecords {
+			rdata = append(rdata, r.IPv4Address)
+		}
+	case "AAAA":
+		for _, r := range p.AAAARecords {
+			rdata = append(rdata, r.IPv6Address)
+		}
+	case "CNAME":
+		if p.CNAMERecord != nil {
+			rdata = append(rdata, dns.Fqdn(p.CNAMERecord.CNAME))
+		}
+	case "MX":
+		for _, r := range p.MXRecords {
+			rdata = append(rdata, fmt.Sprintf("%d %s", r.Preference, dns.Fqdn(r.Exchange)))
+		}
+	case "NS":
+		for _, r := range p.NSRecords {
+			rdata = append(rdata, dns.Fqdn(r.NSDName))
+		}
+	case "PTR":
+		for _, r := range p.PTRRecords {
+			rdata = append(rdata, dns.Fqdn(r.PTRDName))
+		}
+	case "SRV":
+		for _, r := range p.SRVRecords {
+			rdata = append(rdata, fmt.Sprintf("%d %d %d %s", r.Priority, r.Weight, r.Port, dns.Fqdn(r.Target)))
+		}
+	case "TXT":
+		for _, r := range p.TXTRecords {
+			var strs []string
+			for _, v := range r.Value {
+				strs = append(strs, strconv.Quote(v))
+			}
+			rdata = append(rdata, strings.Join(strs, " "))
+		}
+	case "CAA":
+		for _, r := range p.CAARecords {
+			rdata = append(rdata, fmt.Sprintf("%d %s %s", r.Flags, r.Tag, strconv.Quote(r.Value)))
+		}
+	case "SOA":
+		if s := p.SOARecord; s != nil {
+			rdata = append(rdata, fmt.Sprintf("%s %s %d %d %d %d %d",
+				dns.Fqdn(s.Host), dns.Fqdn(s.Email), s.SerialNumber, s.RefreshTime, s.RetryTime, s.ExpireTime, s.MinimumTTL))
+		}
+	default:
+		return nil, fmt.Errorf("unsupported record type %q", rrtype)
+	}
+
+	var flags RecordFlags
+	for k, v := range p.Metadata {
+		if flags == nil {
+			flags = RecordFlags{}
+		}
+		flags["azure.Metadata."+k] = v
+	}
+
+	var z Zone
+	for _, d := range rdata {
+		str := fmt.Sprintf("%s %d IN %s %s", name, p.TTL, rrtype, d)
+		rr, err := dns.NewRR(str)
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing record %q, %w", str, err)
+		}
+		z = append(z, &Record{RR: rr, Flags: flags})
+	}
+	return z, nil
+}
+
+func recordsToAzureProperties(z Zone) (azureRecordSetProperties, error) {
+	p := azureRecordSetProperties{
+		TTL: z[0].Header().Ttl,
+	}
+	for k, v := range z[0].Flags {
+		if !strings.HasPrefix(k, "azure.Metadata.") {
+			continue
+		}
+		if p.Metadata == nil {
+			p.Metadata = map[string]string{}
+		}
+		p.Metadata[strings.TrimPrefix(k, "azure.Metadata.")] = v
+	}
+
+	for _, r := range z {
+		switch rr := r.RR.(type) {
+		case *dns.A:
+			p.ARecords = append(p.ARecords, azureA{IPv4Address: rr.A.String()})
+		case *dns.AAAA:
+			p.AAAARecords = append(p.AAAARecords, azureAAAA{IPv6Address: rr.AAAA.String()})
+		case *dns.CNAME:
+			p.CNAMERecord = &azureCNAME{CNAME: rr.Target}
+		case *dns.MX:
+			p.MXRecords = append(p.MXRecords, azureMX{Preference: rr.Preference, Exchange: rr.Mx})
+		case *dns.NS:
+			p.NSRecords = append(p.NSRecords, azureNS{NSDName: rr.Ns})
+		case *dns.PTR:
+			p.PTRRecords = append(p.PTRRecords, azurePTR{PTRDName: rr.Ptr})
+		case *dns.SRV:
+			p.SRVRecords = append(p.SRVRecords, azureSRV{Priority: rr.Priority, Weight: rr.Weight, Port: rr.Port, Target: rr.Target})
+		case *dns.TXT:
+			p.TXTRecords = append(p.TXTRecords, azureTXT{Value: rr.Txt})
+		case *dns.CAA:
+			p.CAARecords = append(p.CAARecords, azureCAA{Flags: rr.Flag, Tag: rr.Tag, Value: rr.Value})
+		case *dns.SOA:
+			p.SOARecord = &azureSOA{
+				Host:         rr.Ns,
+				Email:        rr.Mbox,
+				SerialNumber: rr.Serial,
+				RefreshTime:  rr.Refresh,
+				RetryTime:    rr.Retry,
+				ExpireTime:   rr.Expire,
+				MinimumTTL:   rr.Minttl,
+			}
+		default:
+			return p, fmt.Errorf("unsupported record type %s", dns.TypeToString[r.Header().Rrtype])
+		}
+	}
+	return p, nil
+}
+
+// body renders the request body for a record set, renaming the properties
+// for the Private DNS API.
+func (a *AzureDNS) body(p azureRecordSetProperties) (interface{}, error) {
+	if !a.Private {
+		return azureRecordSet{Properties: p}, nil
+	}
+	bs, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	props := map[string]json.RawMessage{}
+	if err := json.Unmarshal(bs, &props); err != nil {
+		return nil, err
+	}
+	for k, pk := range azurePrivateKeys {
+		if v, ok := props[k]; ok {
+			delete(props, k)
+			props[pk] = v
+		}
+	}
+	return map[string]interface{}{"properties": props}, nil
+}
+
+func (a *AzureDNS) recordSetURL(key RecordSetKey) (string, error) {
+	rrtype, ok := dns.TypeToString[key.Rrtype]
+	if !ok {
+		return "", fmt.Errorf("unknown dns.Rtype %d", key.Rrtype)
+	}
+	zone := dns.Fqdn(a.Zone)
+	name := "@"
+	if key.Name != zone {
+		name = strings.TrimSuffix(key.Name, "."+zone)
+	}
+	return a.zoneURL("/" + rrtype + "/" + url.PathEscape(name)), nil
+}
+
+// UpdateZone updates an Azure DNS zone. The record sets containing wanted
+// or unwanted records are replaced with their new contents, or deleted if
+// no records remain. Each write is conditional on the record set's ETag,
+// as read by RemoteZone.
+func (a *AzureDNS) UpdateZone(wanted, unwanted, desired, remote Zone) error {
+	a.Lock()
+	etags := a.etags
+	a.Unlock()
+
+	rgs := remote.Group(a.GroupFlags())
+	wgs := wanted.Group(a.GroupFlags())
+	ugs := unwanted.Group(a.GroupFlags())
+
+	keys := map[RecordSetKey]struct{}{}
+	for k := range wgs {
+		keys[k] = struct{}{}
+	}
+	for k := range ugs {
+		keys[k] = struct{}{}
+	}
+	var sortedKeys []RecordSetKey
+	for k := range keys {
+		sortedKeys = append(sortedKeys, k)
+	}
+	sort.Slice(sortedKeys, func(i, j int) bool {
+		isoa, jsoa := sortedKeys[i].Rrtype == dns.TypeSOA, sortedKeys[j].Rrtype == dns.TypeSOA
+		if isoa != jsoa {
+			return isoa
+		}
+		if sortedKeys[i].Name != sortedKeys[j].Name {
+			return sortedKeys[i].Name < sortedKeys[j].Name
+		}
+		return sortedKeys[i].Rrtype < sortedKeys[j].Rrtype
+	})
+
+	for _, key := range sortedKeys {
+		var recs Zone
+	nextRecord:
+		for _, r := range rgs[key] {
+			for _, u := range ugs[key] {
+				if r.Compare(u) == 0 {
+					continue nextRecord
+				}
+			}
+			recs = append(recs, r)
+		}
+		recs = append(recs, wgs[key]...)
+		sort.Sort(ByRR(recs))
+		recs = Zone(ByRR(recs).Dedupe())
+
+		u, err := a.recordSetURL(key)
+		if err != nil {
+			return err
+		}
+		etag, exists := etags[key]
+
+		if len(recs) == 0 {
+			if !exists {
+				continue
+			}
+			klog.V(1).Infof("azure delete: %s %s", key.Name, dns.TypeToString[key.Rrtype])
+			if err := a.do(http.MethodDelete, u, map[string]string{"If-Match": etag}, nil, nil); err != nil {
+				return fmt.Errorf("deleting record set %s, %w", key.Name, err)
+			}
+			continue
+		}
+
+		props, err := recordsToAzureProperties(recs)
+		if err != nil {
+			return fmt.Errorf("generating record set for %s, %w", key.Name, err)
+		}
+		body, err := a.body(props)
+		if err != nil {
+			return err
+		}
+		hdrs := map[string]string{"If-None-Match": "*"}
+		if exists {
+			hdrs = map[string]string{"If-Match": etag}
+		}
+		klog.V(1).Infof("azure put: %s %s", key.Name, dns.TypeToString[key.Rrtype])
+		if err := a.do(http.MethodPut, u, hdrs, body, nil); err != nil {
+			return fmt.Errorf("updating record set %s, %w", key.Name, err)
+		}
+	}
+
+	klog.V(1).Infof("Change succeeded")
+
+	return nil
+}
@@ -0,0 +1,250 @@
+package dubber
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+)
+
+type testAzureCredential struct{}
+
+func (testAzureCredential) GetToken(ctx context.Context, opts policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	return azcore.AccessToken{Token: "secret", ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
+
+type testAzureRecordSet struct {
+	etag  int
+	props json.RawMessage
+}
+
+// testAzureServer is a minimal stand-in for the ARM record set API of a
+// DNS zone, with a page size of 2.
+type testAzureServer struct {
+	t       *testing.T
+	private bool
+	sync.Mutex
+	// sets is keyed by TYPE/name
+	sets  map[string]*testAzureRecordSet
+	etag  int
+	calls map[string]int
+}
+
+func (s *testAzureServer) provider() string {
+	if s.private {
+		return "privateDnsZones"
+	}
+	return "dnsZones"
+}
+
+func (s *testAzureServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error": {"code": "AuthenticationFailed", "message": "no token"}}`))
+		return
+	}
+
+	base := "/subscriptions/sub1/resourceGroups/rg1/providers/Microsoft.Network/" + s.provider() + "/example.com/"
+	if !strings.HasPrefix(r.URL.Path, base) {
+		http.NotFound(w, r)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, base)
+	s.calls[r.Method]++
+
+	if r.Method == http.MethodGet {
+		list := "recordsets"
+		if s.private {
+			list = "ALL"
+		}
+		if path != list {
+			http.NotFound(w, r)
+			return
+		}
+		var keys []string
+		for k := range s.sets {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		skip, _ := strconv.Atoi(r.URL.Query().Get("$skipToken"))
+		var page struct {
+			Value    []map[string]interface{} `json:"value"`
+			NextLink string                   `json:"nextLink,omitempty"`
+		}
+		for i := skip; i < len(keys) && i < skip+2; i++ {
+			parts := strings.SplitN(keys[i], "/", 2)
+			page.Value = append(page.Value, map[string]interface{}{
+				"name":       parts[1],
+				"type":       "Microsoft.Network/" + s.provider() + "/" + parts[0],
+				"etag":       fmt.Sprintf("etag-%d", s.sets[keys[i]].etag),
+				"properties": s.sets[keys[i]].props,
+			})
+		}
+		if skip+2 < len(keys) {
+			page.NextLink = fmt.Sprintf("http://%s%s?api-version=%s&$skipToken=%d",
+				r.Host, r.URL.Path, r.URL.Query().Get("api-version"), skip+2)
+		}
+		json.NewEncoder(w).Encode(page)
+		return
+	}
+
+	cur, exists := s.sets[path]
+	if m := r.Header.Get("If-Match"); m != "" && (!exists || m != fmt.Sprintf("etag-%d", cur.etag)) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		w.Write([]byte(`{"error": {"code": "PreconditionFailed", "message": "etag mismatch"}}`))
+		return
+	}
+	if r.Header.Get("If-None-Match") == "*" && exists {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		w.Write([]byte(`{"error": {"code": "PreconditionFailed", "message": "record set exists"}}`))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		var body struct {
+			Properties map[string]json.RawMessage `json:"properties"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ttl := "TTL"
+		if s.private {
+			ttl = "ttl"
+		}
+		if _, ok := body.Properties[ttl]; !ok {
+			s.t.Errorf("expected %s property in %v", ttl, body.Properties)
+		}
+		props, _ := json.Marshal(body.Properties)
+		s.etag++
+		s.sets[path] = &testAzureRecordSet{etag: s.etag, props: props}
+		w.Write([]byte(`{}`))
+	case http.MethodDelete:
+		delete(s.sets, path)
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestAzureDNSReconcile(t *testing.T) {
+	for _, private := range []bool{false, true} {
+		t.Run(fmt.Sprintf("private=%v", private), func(t *testing.T) {
+			h := &testAzureServer{
+				t:       t,
+				private: private,
+				sets: map[string]*testAzureRecordSet{
+					"SOA/@":     {props: json.RawMessage(`{"TTL": 3600, "SOARecord": {"host": "ns1.example.com", "email": "root.example.com", "serialNumber": 1, "refreshTime": 3600, "retryTime": 300, "expireTime": 2419200, "minimumTTL": 300}}`)},
+					"A/thing":   {props: json.RawMessage(`{"ttl": 10, "aRecords": [{"ipv4Address": "6.6.6.6"}, {"ipv4Address": "8.8.8.8"}]}`)},
+					"A/old":     {props: json.RawMessage(`{"TTL": 10, "ARecords": [{"ipv4Address": "5.5.5.5"}]}`)},
+					"TXT/@":     {props: json.RawMessage(`{"TTL": 300, "metadata": {"owner": "ops"}, "TXTRecords": [{"value": ["v=spf1 -all"]}]}`)},
+					"CNAME/www": {props: json.RawMessage(`{"TTL": 300, "CNAMERecord": {"cname": "thing.example.com"}}`)},
+				},
+				calls: map[string]int{},
+			}
+			ts := httptest.NewServer(h)
+			defer ts.Close()
+
+			cfg := &AzureDNSConfig{SubscriptionID: "sub1", ResourceGroup: "rg1", Private: private, URL: ts.URL}
+			cfg.Zone = "example.com."
+			p, err := newAzureDNS(cfg, testAzureCredential{})
+			if err != nil {
+				t.Fatalf("unexpected error, %v", err)
+			}
+
+			desired, err := ParseZoneData(bytes.NewBufferString(`
+thing.example.com. 10 IN A 7.7.7.7 ; azure.Metadata.owner=dubber
+thing.example.com. 10 IN A 8.8.8.8 ; azure.Metadata.owner=dubber
+new.example.com. 60 IN A 1.1.1.1
+_http._tcp.example.com. 300 IN SRV 10 20 8080 thing.example.com.
+`))
+			if err != nil {
+				t.Fatalf("error parsing desired zone, %v", err)
+			}
+
+			var srv *Server
+			if err := srv.ReconcileZone(p, desired); err != nil {
+				t.Fatalf("error reconciling zone, %v", err)
+			}
+
+			got, err := p.RemoteZone()
+			if err != nil {
+				t.Fatalf("error reading remote zone, %v", err)
+			}
+
+			exp := `_http._tcp.example.com.	300	IN	SRV	10 20 8080 thing.example.com.
+example.com.	300	IN	TXT	"v=spf1 -all" ; azure.Metadata.owner=ops
+example.com.	3600	IN	SOA	ns1.example.com. root.example.com. 2 3600 300 2419200 300
+new.example.com.	60	IN	A	1.1.1.1
+old.example.com.	10	IN	A	5.5.5.5
+thing.example.com.	10	IN	A	7.7.7.7 ; azure.Metadata.owner=dubber
+thing.example.com.	10	IN	A	8.8.8.8 ; azure.Metadata.owner=dubber
+www.example.com.	300	IN	CNAME	thing.example.com.`
+			if got.String() != exp {
+				t.Fatalf("\n  expected:\n%s\n  got:\n%s", exp, got)
+			}
+
+			// The SOA, thing, new and SRV record sets.
+			if h.calls[http.MethodPut] != 4 || h.calls[http.MethodDelete] != 0 {
+				t.Fatalf("unexpected API calls, %v", h.calls)
+			}
+
+			// Nothing left to do
+			if err := srv.ReconcileZone(p, desired); err != nil {
+				t.Fatalf("error reconciling zone, %v", err)
+			}
+			if h.calls[http.MethodPut] != 4 {
+				t.Fatalf("unexpected API calls, %v", h.calls)
+			}
+
+			// Removing the last record of a record set deletes it
+			var unwanted Zone
+			for _, r := range got {
+				if r.Header().Name == "old.example.com." {
+					unwanted = append(unwanted, r)
+				}
+			}
+			if err := p.UpdateZone(nil, unwanted, desired, got); err != nil {
+				t.Fatalf("unexpected error, %v", err)
+			}
+			if _, ok := h.sets["A/old"]; ok {
+				t.Fatalf("expected old record set to be deleted")
+			}
+
+			// Record sets changed since they were read must not be written
+			if err := p.UpdateZone(nil, unwanted, desired, got); err == nil {
+				t.Fatalf("expected delete of a missing record set to fail")
+			}
+			wanted, _ := ParseZoneData(bytes.NewBufferString(`new.example.com. 60 IN A 1.1.1.2`))
+			h.Lock()
+			h.sets["A/new"].etag = 100
+			h.Unlock()
+			if err := p.UpdateZone(wanted, nil, desired, got); err == nil {
+				t.Fatalf("expected update of a changed record set to fail")
+			}
+			wanted, _ = ParseZoneData(bytes.NewBufferString(`other.example.com. 60 IN A 1.1.1.3`))
+			h.Lock()
+			h.sets["A/other"] = &testAzureRecordSet{props: json.RawMessage(`{"TTL": 60, "ARecords": [{"ipv4Address": "1.1.1.4"}]}`)}
+			h.Unlock()
+			if err := p.UpdateZone(wanted, nil, desired, got); err == nil {
+				t.Fatalf("expected creation of an existing record set to fail")
+			}
+		})
+	}
+}
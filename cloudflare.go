@@ -0,0 +1,472 @@
+// Copyright 2017 Qubit Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dubber
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	klog "k8s.io/klog/v2"
+)
+
+// CloudflareConfig describes the settings required for managing a
+// Cloudflare DNS zone.
+type CloudflareConfig struct {
+	BaseProvisionerConfig `json:",omitempty,inline" yaml:",omitempty,inline"`
+	ZoneID                string `yaml:"zoneID" json:"zoneID"`
+	// APIToken is a Cloudflare API token with DNS edit permission on
+	// the zone.
+	APIToken string `yaml:"apiToken" json:"apiToken"`
+	// URL is the base URL of the API, defaults to
+	// https://api.cloudflare.com/client/v4
+	URL     string        `yaml:"url" json:"url"`
+	Timeout time.Duration `yaml:"timeout" json:"timeout"`
+}
+
+// Cloudflare is a Cloudflare DNS record provisioner.
+// This provision uses the following flags:
+//   - cloudflare.Proxied: "true" will proxy traffic for the record
+//     through Cloudflare
+//   - cloudflare.Comment: A comment on the record, with whitespace and "%"
+//     percent encoded
+//   - cloudflare.Tags: A comma separated list of tags for the record, in
+//     alphabetical order
+//
+// Cloudflare does not expose the zone's SOA record, or support conditional
+// updates, so RemoteZone synthesises an SOA with a serial derived from the
+// zone's records, and UpdateZone checks it immediately before making
+// changes.
+type Cloudflare struct {
+	*CloudflareConfig
+	client *http.Client
+
+	sync.Mutex
+	// ids holds the Cloudflare ID of each record read by RemoteZone.
+	ids map[string]string
+}
+
+type cfRecord struct {
+	ID       string      `json:"id,omitempty"`
+	Type     string      `json:"type"`
+	Name     string      `json:"name"`
+	Content  string      `json:"content,omitempty"`
+	TTL      uint32      `json:"ttl"`
+	Proxied  *bool       `json:"proxied,omitempty"`
+	Priority *uint16     `json:"priority,omitempty"`
+	Comment  string      `json:"comment,omitempty"`
+	Tags     []string    `json:"tags,omitempty"`
+	Data     interface{} `json:"data,omitempty"`
+}
+
+type cfSRVData struct {
+	Priority uint16 `json:"priority"`
+	Weight   uint16 `json:"weight"`
+	Port     uint16 `json:"port"`
+	Target   string `json:"target"`
+}
+
+type cfResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result     json.RawMessage `json:"result"`
+	ResultInfo struct {
+		Page       int `json:"page"`
+		TotalPages int `json:"total_pages"`
+	} `json:"result_info"`
+}
+
+// NewCloudflare creates a Cloudflare provisioner.
+func NewCloudflare(cfg *CloudflareConfig) (*Cloudflare, error) {
+	if cfg.ZoneID == "" {
+		return nil, fmt.Errorf("cloudflare zoneID must be set")
+	}
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	return &Cloudflare{
+		CloudflareConfig: cfg,
+		client:           &http.Client{Timeout: timeout},
+	}, nil
+}
+
+// GroupFlags is empty for Cloudflare
+func (c *Cloudflare) GroupFlags() []string {
+	return nil
+}
+
+func (c *Cloudflare) do(method, path string, query url.Values, body interface{}) (*cfResponse, error) {
+	base := c.URL
+	if base == "" {
+		base = "https://api.cloudflare.com/client/v4"
+	}
+	u := strings.TrimSuffix(base, "/") + "/zones/" + url.PathEscape(c.ZoneID) + "/dns_records" + path
+	if len(query) != 0 {
+		u += "?" + query.Encode()
+	}
+
+	var rdr io.Reader
+	if body != nil {
+		bs, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		rdr = bytes.NewReader(bs)
+	}
+
+	req, err := http.NewRequestWithContext(context.Background(), method, u, rdr)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.APIToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	cfresp := &cfResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(cfresp); err != nil {
+		return nil, fmt.Errorf("%s %s, %s, %w", method, u, resp.Status, err)
+	}
+	if !cfresp.Success {
+		var msgs []string
+		for _, e := range cfresp.Errors {
+			msgs = append(msgs, fmt.Sprintf("%d: %s", e.Code, e.Message))
+		}
+		return nil, fmt.Errorf("%s %s, %s %s", method, u, resp.Status, strings.Join(msgs, ", "))
+	}
+	return cfresp, nil
+}
+
+// RemoteZone creates a Zone from the Cloudflare zone's DNS records.
+func (c *Cloudflare) RemoteZone() (Zone, error) {
+	var recs []cfRecord
+	for page := 1; ; page++ {
+		q := url.Values{}
+		q.Set("page", strconv.Itoa(page))
+		q.Set("per_page", "100")
+		resp, err := c.do(http.MethodGet, "", q, nil)
+		if err != nil {
+			return nil, fmt.Errorf("could not list records for zone %s, %w", c.Zone, err)
+		}
+		var prs []cfRecord
+		if err := json.Unmarshal(resp.Result, &prs); err != nil {
+			return nil, fmt.Errorf("could not decode records for zone %s, %w", c.Zone, err)
+		}
+		recs = append(recs, prs...)
+		if page >= resp.ResultInfo.TotalPages {
+			break
+		}
+	}
+
+	ids := map[string]string{}
+	var z Zone
+	for i := range recs {
+		r, err := cfRecordToRecord(recs[i])
+		if err != nil {
+			klog.Infof("ignoring cloudflare record %s %s, %v", recs[i].Type, recs[i].Name, err)
+			continue
+		}
+		ids[r.String()] = recs[i].ID
+		z = append(z, r)
+	}
+	sort.Sort(ByRR(z))
+
+	c.Lock()
+	c.ids = ids
+	c.Unlock()
+
+	z = append(z, &Record{RR: c.soa(z)})
+	sort.Sort(ByRR(z))
+
+	return z, nil
+}
+
+// soa synthesises an SOA record for the zone, the serial is a hash of the
+// zone's sorted records.
+func (c *Cloudflare) soa(z Zone) *dns.SOA {
+	h := fnv.New32a()
+	for _, r := range z {
+		h.Write([]byte(r.String() + "\n"))
+	}
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: dns.Fqdn(c.Zone), Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Ns:      "ns.cloudflare.com.",
+		Mbox:    "dns.cloudflare.com.",
+		Serial:  h.Sum32(),
+		Refresh: 10000,
+		Retry:   2400,
+		Expire:  604800,
+		Minttl:  3600,
+	}
+}
+
+func cfRecordToRecord(cr cfRecord) (*Record, error) {
+	name := dns.Fqdn(cr.Name)
+	var str string
+	switch cr.Type {
+	case "MX":
+		var prio uint16
+		if cr.Priority != nil {
+			prio = *cr.Priority
+		}
+		str = fmt.Sprintf("%s %d IN MX %d %s", name, cr.TTL, prio, dns.Fqdn(cr.Content))
+	case "SRV":
+		var prio uint16
+		if cr.Priority != nil {
+			prio = *cr.Priority
+		}
+		str = fmt.Sprintf("%s %d IN SRV %d %s", name, cr.TTL, prio, cr.Content)
+	case "TXT":
+		content := cr.Content
+		if !strings.HasPrefix(content, `"`) {
+			content = strconv.Quote(content)
+		}
+		str = fmt.Sprintf("%s %d IN TXT %s", name, cr.TTL, content)
+	case "CNAME", "NS", "PTR":
+		str = fmt.Sprintf("%s %d IN %s %s", name, cr.TTL, cr.Type, dns.Fqdn(cr.Content))
+	default:
+		str = fmt.Sprintf("%s %d IN %s %s", name, cr.TTL, cr.Type, cr.Content)
+	}
+
+	rr, err := dns.NewRR(str)
+	if err != nil {
+		return nil, err
+	}
+
+	var flags RecordFlags
+	setFlag := func(k, v string) {
+		if flags == nil {
+			flags = RecordFlags{}
+		}
+		flags[k] = v
+	}
+	setFlag("cloudflare.Proxied", strconv.FormatBool(cr.Proxied != nil && *cr.Proxied))
+	if cr.Comment != "" {
+		setFlag("cloudflare.Comment", escapeFlagValue(cr.Comment))
+	}
+	if len(cr.Tags) != 0 {
+		tags := append([]string{}, cr.Tags...)
+		sort.Strings(tags)
+		setFlag("cloudflare.Tags", strings.Join(tags, ","))
+	}
+
+	return &Record{RR: rr, Flags: flags}, nil
+}
+
+// normaliseRecord sets the cloudflare.Proxied flag of a desired record to
+// true or false, as it is always reported by RemoteZone, and sets the TTL of
+// proxied records to 1 (automatic), as Cloudflare does.
+func (c *Cloudflare) normaliseRecord(r *Record) *Record {
+	proxied := cfProxied(r)
+	nr := &Record{RR: dns.Copy(r.RR), Flags: RecordFlags{}}
+	for k, v := range r.Flags {
+		nr.Flags[k] = v
+	}
+	nr.Flags["cloudflare.Proxied"] = strconv.FormatBool(proxied)
+	if proxied {
+		nr.Header().Ttl = 1
+	}
+	return nr
+}
+
+// cfProxied returns true if the record should be proxied by Cloudflare.
+func cfProxied(r *Record) bool {
+	v, ok := r.Flags["cloudflare.Proxied"]
+	return ok && (v == "" || v == "true")
+}
+
+func recordToCFRecord(r *Record) (cfRecord, error) {
+	hdr := r.Header()
+	rrtype, ok := dns.TypeToString[hdr.Rrtype]
+	if !ok {
+		return cfRecord{}, fmt.Errorf("unknown dns.Rtype %d", hdr.Rrtype)
+	}
+	cr := cfRecord{
+		Type:    rrtype,
+		Name:    strings.TrimSuffix(hdr.Name, "."),
+		TTL:     hdr.Ttl,
+		Comment: unescapeFlagValue(r.Flags["cloudflare.Comment"]),
+	}
+
+	switch rr := r.RR.(type) {
+	case *dns.A:
+		cr.Content = rr.A.String()
+	case *dns.AAAA:
+		cr.Content = rr.AAAA.String()
+	case *dns.CNAME:
+		cr.Content = strings.TrimSuffix(rr.Target, ".")
+	case *dns.NS:
+		cr.Content = strings.TrimSuffix(rr.Ns, ".")
+	case *dns.PTR:
+		cr.Content = strings.TrimSuffix(rr.Ptr, ".")
+	case *dns.MX:
+		cr.Content = strings.TrimSuffix(rr.Mx, ".")
+		cr.Priority = &rr.Preference
+	case *dns.TXT:
+		cr.Content = strings.Join(rr.Txt, "")
+	case *dns.SRV:
+		cr.Data = cfSRVData{
+			Priority: rr.Priority,
+			Weight:   rr.Weight,
+			Port:     rr.Port,
+			Target:   strings.TrimSuffix(rr.Target, "."),
+		}
+	default:
+		cr.Content = r.RR.String()[len(hdr.String()):]
+	}
+
+	proxied := cfProxied(r)
+	cr.Proxied = &proxied
+	if proxied {
+		cr.TTL = 1
+	}
+	if v := r.Flags["cloudflare.Tags"]; v != "" {
+		cr.Tags = strings.Split(v, ",")
+	}
+
+	return cr, nil
+}
+
+// UpdateZone updates a Cloudflare zone. Within each set of records with the
+// same name and type, unwanted records are updated in place to become
+// wanted records, and any remaining unwanted records are deleted, or
+// wanted records created.
+func (c *Cloudflare) UpdateZone(wanted, unwanted, desired, remote Zone) error {
+	var soa *dns.SOA
+	var uws, ws Zone
+	for _, uw := range unwanted {
+		if s, ok := uw.RR.(*dns.SOA); ok {
+			soa = s
+			continue
+		}
+		uws = append(uws, uw)
+	}
+	for _, w := range wanted {
+		if w.Header().Rrtype == dns.TypeSOA {
+			continue
+		}
+		ws = append(ws, w)
+	}
+	if soa == nil {
+		return fmt.Errorf("no SOA record to update for zone %s", c.Zone)
+	}
+
+	cur, err := c.RemoteZone()
+	if err != nil {
+		return err
+	}
+	for _, r := range cur {
+		if s, ok := r.RR.(*dns.SOA); ok && s.Serial != soa.Serial {
+			return fmt.Errorf("zone %s has changed since it was read", c.Zone)
+		}
+	}
+
+	c.Lock()
+	ids := c.ids
+	c.Unlock()
+
+	wgs := ws.Group(c.GroupFlags())
+	ugs := uws.Group(c.GroupFlags())
+
+	keys := map[RecordSetKey]struct{}{}
+	for k := range wgs {
+		keys[k] = struct{}{}
+	}
+	for k := range ugs {
+		keys[k] = struct{}{}
+	}
+	var sortedKeys []RecordSetKey
+	for k := range keys {
+		sortedKeys = append(sortedKeys, k)
+	}
+	sort.Slice(sortedKeys, func(i, j int) bool {
+		if sortedKeys[i].Name != sortedKeys[j].Name {
+			return sortedKeys[i].Name < sortedKeys[j].Name
+		}
+		return sortedKeys[i].Rrtype < sortedKeys[j].Rrtype
+	})
+
+	id := func(r *Record) (string, error) {
+		id, ok := ids[r.String()]
+		if !ok {
+			return "", fmt.Errorf("no cloudflare record id found for %s", r)
+		}
+		return url.PathEscape(id), nil
+	}
+
+	for _, key := range sortedKeys {
+		wg, ug := wgs[key], ugs[key]
+		for i := 0; i < max(len(wg), len(ug)); i++ {
+			switch {
+			case i < len(wg) && i < len(ug):
+				rid, err := id(ug[i])
+				if err != nil {
+					return err
+				}
+				cr, err := recordToCFRecord(wg[i])
+				if err != nil {
+					return err
+				}
+				klog.V(1).Infof("cloudflare update: %s -> %s", ug[i], wg[i])
+				if _, err := c.do(http.MethodPut, "/"+rid, nil, cr); err != nil {
+					return fmt.Errorf("updating %s, %w", ug[i], err)
+				}
+			case i < len(ug):
+				rid, err := id(ug[i])
+				if err != nil {
+					return err
+				}
+				klog.V(1).Infof("cloudflare delete: %s", ug[i])
+				if _, err := c.do(http.MethodDelete, "/"+rid, nil, nil); err != nil {
+					return fmt.Errorf("deleting %s, %w", ug[i], err)
+				}
+			default:
+				cr, err := recordToCFRecord(wg[i])
+				if err != nil {
+					return err
+				}
+				klog.V(1).Infof("cloudflare create: %s", wg[i])
+				if _, err := c.do(http.MethodPost, "", nil, cr); err != nil {
+					return fmt.Errorf("creating %s, %w", wg[i], err)
+				}
+			}
+		}
+	}
+
+	klog.V(1).Infof("Change succeeded")
+
+	return nil
+}
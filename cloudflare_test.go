@@ -0,0 +1,288 @@
+package dubber
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// testCloudflareServer is a minimal stand-in for the Cloudflare DNS records
+// API, with a page size of 2.
+type testCloudflareServer struct {
+	t *testing.T
+	sync.Mutex
+	records []cfRecord
+	nextID  int
+	calls   map[string]int
+}
+
+func (s *testCloudflareServer) write(w http.ResponseWriter, result interface{}, page, pages int) {
+	bs, _ := json.Marshal(result)
+	resp := cfResponse{Success: true, Result: bs}
+	resp.ResultInfo.Page = page
+	resp.ResultInfo.TotalPages = pages
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *testCloudflareServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"success": false, "errors": [{"code": 10000, "message": "Authentication error"}]}`))
+		return
+	}
+
+	const base = "/zones/zone1/dns_records"
+	if !strings.HasPrefix(r.URL.Path, base) {
+		http.NotFound(w, r)
+		return
+	}
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, base), "/")
+	s.calls[r.Method]++
+
+	find := func() int {
+		for i := range s.records {
+			if s.records[i].ID == id {
+				return i
+			}
+		}
+		s.t.Errorf("unknown record id %q", id)
+		return -1
+	}
+	decode := func() cfRecord {
+		var cr cfRecord
+		if err := json.NewDecoder(r.Body).Decode(&cr); err != nil {
+			s.t.Errorf("invalid record, %v", err)
+		}
+		// The API returns SRV records with content and priority
+		if cr.Type == "SRV" {
+			d := cr.Data.(map[string]interface{})
+			prio := uint16(d["priority"].(float64))
+			cr.Priority = &prio
+			cr.Content = fmt.Sprintf("%v %v %v", d["weight"], d["port"], d["target"])
+			cr.Data = nil
+		}
+		// The API always reports proxied, with a TTL of 1 (automatic)
+		// for proxied records
+		if cr.Proxied == nil {
+			no := false
+			cr.Proxied = &no
+		}
+		if *cr.Proxied {
+			cr.TTL = 1
+		}
+		return cr
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		pages := (len(s.records) + 1) / 2
+		var res []cfRecord
+		for i := (page - 1) * 2; i < len(s.records) && i < page*2; i++ {
+			res = append(res, s.records[i])
+		}
+		s.write(w, res, page, pages)
+	case http.MethodPost:
+		cr := decode()
+		s.nextID++
+		cr.ID = fmt.Sprintf("r%d", s.nextID)
+		s.records = append(s.records, cr)
+		s.write(w, cr, 0, 0)
+	case http.MethodPut:
+		i := find()
+		cr := decode()
+		cr.ID = id
+		s.records[i] = cr
+		s.write(w, cr, 0, 0)
+	case http.MethodDelete:
+		i := find()
+		s.records = append(s.records[:i], s.records[i+1:]...)
+		s.write(w, map[string]string{"id": id}, 0, 0)
+	}
+}
+
+func TestCloudflareReconcile(t *testing.T) {
+	yes := true
+	prio := uint16(10)
+	h := &testCloudflareServer{
+		t: t,
+		records: []cfRecord{
+			{ID: "a", Type: "A", Name: "thing.example.com", Content: "6.6.6.6", TTL: 1, Proxied: &yes},
+			{ID: "b", Type: "A", Name: "thing.example.com", Content: "8.8.8.8", TTL: 1, Proxied: &yes},
+			{ID: "c", Type: "MX", Name: "example.com", Content: "mail.example.com", TTL: 300, Priority: &prio},
+			{ID: "d", Type: "TXT", Name: "example.com", Content: "v=spf1 -all", TTL: 300},
+			{ID: "e", Type: "CNAME", Name: "old.example.com", Content: "thing.example.com", TTL: 300, Comment: "dubber"},
+		},
+		calls: map[string]int{},
+	}
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	cfg := &CloudflareConfig{ZoneID: "zone1", APIToken: "secret", URL: ts.URL}
+	cfg.Zone = "example.com."
+	p, err := NewCloudflare(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	got, err := p.RemoteZone()
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if len(got) != 6 {
+		t.Fatalf("expected 5 records and an SOA across all pages, got\n%s", got)
+	}
+
+	desired, err := ParseZoneData(bytes.NewBufferString(`
+thing.example.com. 60 IN A 7.7.7.7 ; cloudflare.Proxied=true
+thing.example.com. 60 IN A 8.8.8.8 ; cloudflare.Proxied=true
+thing.example.com. 60 IN A 9.9.9.9 ; cloudflare.Proxied=true
+_http._tcp.example.com. 300 IN SRV 10 20 8080 thing.example.com. ; cloudflare.Tags=team:dns,web
+example.com. 300 IN TXT "v=spf1 include:example.net -all"
+example.com. 300 IN MX 10 mail.example.com. ; cloudflare.Proxied=false
+`))
+	if err != nil {
+		t.Fatalf("error parsing desired zone, %v", err)
+	}
+
+	var srv *Server
+	if err := srv.ReconcileZone(p, desired); err != nil {
+		t.Fatalf("error reconciling zone, %v", err)
+	}
+
+	got, err = p.RemoteZone()
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	var strs []string
+	for _, r := range got {
+		if r.Header().Name == "example.com." && r.Header().Rrtype != dns.TypeTXT {
+			// SOA and MX are not part of the desired zone
+			continue
+		}
+		strs = append(strs, r.String())
+	}
+	sort.Strings(strs)
+
+	exp := `_http._tcp.example.com.	300	IN	SRV	10 20 8080 thing.example.com. ; cloudflare.Proxied=false cloudflare.Tags=team:dns,web
+example.com.	300	IN	TXT	"v=spf1 include:example.net -all" ; cloudflare.Proxied=false
+old.example.com.	300	IN	CNAME	thing.example.com. ; cloudflare.Comment=dubber cloudflare.Proxied=false
+thing.example.com.	1	IN	A	7.7.7.7 ; cloudflare.Proxied=true
+thing.example.com.	1	IN	A	8.8.8.8 ; cloudflare.Proxied=true
+thing.example.com.	1	IN	A	9.9.9.9 ; cloudflare.Proxied=true`
+	if str := strings.Join(strs, "\n"); str != exp {
+		t.Fatalf("\n  expected:\n%s\n  got:\n%s", exp, str)
+	}
+
+	// 6.6.6.6 and the TXT record are updated in place, the new A and SRV
+	// records are created.
+	if h.calls[http.MethodPut] != 2 || h.calls[http.MethodPost] != 2 || h.calls[http.MethodDelete] != 0 {
+		t.Fatalf("unexpected API calls, %v", h.calls)
+	}
+
+	// Nothing left to do, despite the TTL of the proxied records, and the
+	// unset Proxied flags, in the desired zone
+	if err := srv.ReconcileZone(p, desired); err != nil {
+		t.Fatalf("error reconciling zone, %v", err)
+	}
+	if h.calls[http.MethodPut] != 2 || h.calls[http.MethodPost] != 2 {
+		t.Fatalf("unexpected API calls, %v", h.calls)
+	}
+
+	// Changes made after the zone was read must cause the update to fail
+	soa := got[0]
+	for _, r := range got {
+		if r.Header().Rrtype == dns.TypeSOA {
+			soa = r
+		}
+	}
+	h.Lock()
+	h.records = h.records[1:]
+	h.Unlock()
+	add, _ := ParseZoneData(bytes.NewBufferString(`new.example.com. 60 IN A 1.1.1.1`))
+	if err := p.UpdateZone(add, Zone{soa}, nil, nil); err == nil {
+		t.Fatalf("expected update of a changed zone to fail")
+	}
+}
+
+func TestCloudflarePlanApply_Comment(t *testing.T) {
+	h := &testCloudflareServer{
+		t: t,
+		records: []cfRecord{
+			{ID: "a", Type: "A", Name: "thing.example.com", Content: "6.6.6.6", TTL: 300, Comment: "managed by dubber"},
+		},
+		calls: map[string]int{},
+	}
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "records.zone"), []byte(`
+thing.example.com. 300 IN A 7.7.7.7 ; cloudflare.Comment=still%20managed%20by%20dubber
+`), 0644); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	cfg, err := FromYAML(strings.NewReader(`
+discoverers:
+  files:
+    - path: ` + dir + `
+provisioners:
+  cloudflare:
+    - zone: example.com.
+      zoneID: zone1
+      apiToken: secret
+      url: ` + ts.URL + `
+`))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	srv := New(&cfg)
+
+	plan, err := srv.Plan(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	bs, err := json.Marshal(plan)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if plan, err = ReadPlan(bytes.NewReader(bs)); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if len(plan.Zones) != 1 {
+		t.Fatalf("expected 1 zone in plan, got %d", len(plan.Zones))
+	}
+	if got, exp := strings.Join(plan.Zones[0].Unwanted, "\n"), "thing.example.com.\t300\tIN\tA\t6.6.6.6 ; cloudflare.Comment=managed%20by%20dubber cloudflare.Proxied=false"; !strings.Contains(got, exp) {
+		t.Fatalf("expected unwanted records to include\n%s\n  got:\n%s", exp, got)
+	}
+
+	if err := srv.Apply(plan); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	// The commented record is updated in place
+	h.Lock()
+	defer h.Unlock()
+	if h.calls[http.MethodPut] != 1 || h.calls[http.MethodPost] != 0 || h.calls[http.MethodDelete] != 0 {
+		t.Fatalf("unexpected API calls, %v", h.calls)
+	}
+	if got := h.records[0]; got.ID != "a" || got.Content != "7.7.7.7" || got.Comment != "still managed by dubber" {
+		t.Fatalf("unexpected record %+v", got)
+	}
+}
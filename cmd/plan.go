@@ -0,0 +1,100 @@
+// Copyright 2017 Qubit Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	goflag "flag"
+	"os"
+
+	"github.com/QubitProducts/dubber"
+	"github.com/spf13/cobra"
+	klog "k8s.io/klog/v2"
+)
+
+var planCmd = &cobra.Command{
+	Use:   "plan PLAN",
+	Short: "Write the changes each zone needs to a plan file, without applying them",
+	Long: `Discover and reconcile every zone once, writing the changes that would
+                be made to PLAN as JSON, or to stdout if PLAN is -.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		goflag.CommandLine.Set("alsologtostderr", "true")
+		goflag.CommandLine.Parse([]string{})
+
+		cfg := readConfig()
+		d := dubber.New(&cfg)
+
+		plan, err := d.Plan(context.Background())
+		if err != nil {
+			klog.Exitf("plan failed, %v", err)
+		}
+
+		w := os.Stdout
+		if args[0] != "-" {
+			if w, err = os.Create(args[0]); err != nil {
+				klog.Fatalf("Unable to create plan file %s, %v", args[0], err)
+			}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(plan); err != nil {
+			klog.Fatalf("Unable to write plan, %v", err)
+		}
+		if w != os.Stdout {
+			if err := w.Close(); err != nil {
+				klog.Fatalf("Unable to write plan, %v", err)
+			}
+		}
+		blocked := 0
+		for _, zp := range plan.Zones {
+			if zp.Blocked != "" {
+				blocked++
+			}
+		}
+		klog.Infof("planned changes to %d zones, %d blocked by safety limits", len(plan.Zones), blocked)
+	},
+}
+
+var applyCmd = &cobra.Command{
+	Use:   "apply PLAN",
+	Short: "Apply the changes in a plan file",
+	Long: `Apply exactly the changes recorded in PLAN by dubber plan. Nothing is
+                applied if any zone has changed since the plan was made.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		goflag.CommandLine.Set("alsologtostderr", "true")
+		goflag.CommandLine.Parse([]string{})
+
+		r, err := os.Open(args[0])
+		if err != nil {
+			klog.Fatalf("Unable to open plan file %s, %v", args[0], err)
+		}
+		plan, err := dubber.ReadPlan(r)
+		r.Close()
+		if err != nil {
+			klog.Fatalf("Unable to read plan, %v", err)
+		}
+
+		cfg := readConfig()
+		d := dubber.New(&cfg)
+
+		if err := d.Apply(plan); err != nil {
+			klog.Exitf("apply failed, %v", err)
+		}
+		klog.Infof("applied changes to %d zones", len(plan.Zones))
+	},
+}
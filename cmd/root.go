@@ -33,7 +33,10 @@ var cfgFile = "dubber.yaml"
 var statsAddr = ":8080"
 var dryrun bool
 var oneshot bool
+var safetyOverride bool
+var safetyHTTPOverride bool
 var pollInterval time.Duration
+var gracePeriod time.Duration
 
 // RootCmd is the main Cobra command for the dubber application
 var RootCmd *cobra.Command
@@ -51,9 +54,13 @@ func init() {
 	RootCmd.PersistentFlags().StringVar(&cfgFile, "config", cfgFile, "config file (default is dubber.yaml)")
 	RootCmd.PersistentFlags().StringVar(&statsAddr, "addr", statsAddr, "statistics endpoint")
 	RootCmd.PersistentFlags().BoolVar(&dryrun, "dry-run", false, "Just log the actions to be taken")
-	RootCmd.PersistentFlags().BoolVar(&oneshot, "oneshot", false, "Do one run only and exit")
-	RootCmd.PersistentFlags().DurationVar(&pollInterval, "poll.interval", time.Minute*1, "How often to poll and check for updates")
+	RootCmd.PersistentFlags().BoolVar(&oneshot, "oneshot", false, "Discover and reconcile every zone once, then exit. Exits non-zero on any failure")
+	RootCmd.PersistentFlags().BoolVar(&safetyOverride, "safety.override", false, "Apply updates even if they exceed the configured safety limits")
+	RootCmd.PersistentFlags().BoolVar(&safetyHTTPOverride, "safety.http-override", false, "Allow blocked updates to be overridden with a POST to /safety on the unauthenticated statistics endpoint")
+	RootCmd.PersistentFlags().DurationVar(&pollInterval, "poll.interval", time.Minute*1, "How often to poll and check for updates, or retry discoverers that watch for changes after they fail")
+	RootCmd.PersistentFlags().DurationVar(&gracePeriod, "discoverer.grace-period", time.Minute*10, "How long to keep the records of a failing discoverer before dropping them, 0 keeps them forever")
 	RootCmd.PersistentFlags().AddGoFlagSet(goflag.CommandLine)
+	RootCmd.AddCommand(planCmd, applyCmd)
 	RootCmd.Run = func(cmd *cobra.Command, args []string) {
 		goflag.CommandLine.Set("alsologtostderr", "true")
 
@@ -62,7 +69,7 @@ func init() {
 		klog.Info("Starting dubber")
 
 		ctx, cancel := context.WithCancel(context.Background())
-		sigs := make(chan os.Signal)
+		sigs := make(chan os.Signal, 1)
 		signal.Notify(sigs, os.Interrupt)
 		go func() {
 			sig := <-sigs
@@ -73,22 +80,19 @@ func init() {
 		var g *errgroup.Group
 		g, ctx = errgroup.WithContext(ctx)
 
-		r, err := os.Open(cfgFile)
-		if err != nil {
-			klog.Fatalf("Unable to open config file %s, %v", cfgFile, err)
-		}
+		cfg := readConfig()
+		d := dubber.New(&cfg)
 
-		cfg, err := dubber.FromYAML(r)
-		if err != nil {
-			klog.Fatalf("Unable to read config, %v", err)
+		if oneshot {
+			if err := d.Run(ctx); err != nil {
+				klog.Errorf("oneshot run failed, %v", err)
+				klog.Flush()
+				os.Exit(1)
+			}
+			klog.Info("oneshot run completed")
+			return
 		}
 
-		cfg.DryRun = dryrun
-		cfg.OneShot = oneshot
-		cfg.PollInterval = pollInterval
-
-		d := dubber.New(&cfg)
-
 		if statsAddr != "" {
 			g.Go(func() error {
 				if err := http.ListenAndServe(statsAddr, d); err != nil {
@@ -114,3 +118,26 @@ func init() {
 		}
 	}
 }
+
+// readConfig reads the config file, and applies the command line flags.
+func readConfig() dubber.Config {
+	r, err := os.Open(cfgFile)
+	if err != nil {
+		klog.Fatalf("Unable to open config file %s, %v", cfgFile, err)
+	}
+	defer r.Close()
+
+	cfg, err := dubber.FromYAML(r)
+	if err != nil {
+		klog.Fatalf("Unable to read config, %v", err)
+	}
+
+	cfg.DryRun = dryrun
+	cfg.OneShot = oneshot
+	cfg.SafetyOverride = safetyOverride
+	cfg.SafetyHTTPOverride = safetyHTTPOverride
+	cfg.PollInterval = pollInterval
+	cfg.DiscovererGracePeriod = gracePeriod
+
+	return cfg
+}
@@ -37,10 +37,38 @@ type BaseDiscovererConfig struct {
 type BaseProvisionerConfig struct {
 	Zone           string                  `yaml:"zone" json:"zone"`
 	OwnerFlagsStrs map[string]JSONTemplate `yaml:"ownerFlags"`
+	RegistryConfig RegistryConfig          `yaml:"registry" json:"registry"`
+	SafetyConfig   SafetyConfig            `yaml:"safety" json:"safety"`
 
 	ownerFlagsOnce sync.Once
 	ownerFlagsErr  error
 	ownerFlags     map[string]*regexp.Regexp
+
+	registryOnce sync.Once
+	registryErr  error
+	registry     *Registry
+
+	safetyOnce sync.Once
+	safetyErr  error
+	safety     *Safety
+}
+
+// Safety returns the safety limits for the zone, or nil if no limits are
+// configured.
+func (bp *BaseProvisionerConfig) Safety() (*Safety, error) {
+	bp.safetyOnce.Do(func() {
+		bp.safety, bp.safetyErr = bp.SafetyConfig.build()
+	})
+	return bp.safety, bp.safetyErr
+}
+
+// Registry returns the ownership registry for the zone, or nil if no
+// owner ID is configured.
+func (bp *BaseProvisionerConfig) Registry() (*Registry, error) {
+	bp.registryOnce.Do(func() {
+		bp.registry, bp.registryErr = bp.RegistryConfig.build()
+	})
+	return bp.registry, bp.registryErr
 }
 
 func (bp *BaseProvisionerConfig) OwnerFlags() (map[string]*regexp.Regexp, error) {
@@ -77,17 +105,33 @@ type Config struct {
 	Discoverers struct {
 		Marathon   []MarathonConfig   `yaml:"marathon" json:"marathon"`
 		Kubernetes []KubernetesConfig `yaml:"kubernetes" json:"kubernetes"`
+		Consul     []ConsulConfig     `yaml:"consul" json:"consul"`
+		Nomad      []NomadConfig      `yaml:"nomad" json:"nomad"`
+		Files      []FilesConfig      `yaml:"files" json:"files"`
+		HTTP       []HTTPConfig       `yaml:"http" json:"http"`
+		Exec       []ExecConfig       `yaml:"exec" json:"exec"`
+		Docker     []DockerConfig     `yaml:"docker" json:"docker"`
 	} `yaml:"discoverers" json:"discoverers"`
 	Provisioners struct {
-		Route53   []Route53Config   `yaml:"route53" json:"route53"`
-		GCloudDNS []GCloudDNSConfig `yaml:"gcloud" json:"gcloud"`
+		Route53       []Route53Config       `yaml:"route53" json:"route53"`
+		GCloudDNS     []GCloudDNSConfig     `yaml:"gcloud" json:"gcloud"`
+		RFC2136       []RFC2136Config       `yaml:"rfc2136" json:"rfc2136"`
+		Etcd          []EtcdConfig          `yaml:"etcd" json:"etcd"`
+		PowerDNS      []PowerDNSConfig      `yaml:"powerdns" json:"powerdns"`
+		Cloudflare    []CloudflareConfig    `yaml:"cloudflare" json:"cloudflare"`
+		Azure         []AzureDNSConfig      `yaml:"azure" json:"azure"`
+		ZoneFile      []ZoneFileConfig      `yaml:"zonefile" json:"zonefile"`
+		Authoritative []AuthoritativeConfig `yaml:"authoritative" json:"authoritative"`
 	} `yaml:"provisioners" json:"provisioners"`
 
 	XXX `json:",omitempty" yaml:",omitempty,inline"`
 
-	DryRun       bool          `json:"-"  yaml:"-"`
-	OneShot      bool          `json:"-"  yaml:"-"`
-	PollInterval time.Duration `json:"-"  yaml:"-"`
+	DryRun                bool          `json:"-"  yaml:"-"`
+	OneShot               bool          `json:"-"  yaml:"-"`
+	SafetyOverride        bool          `json:"-"  yaml:"-"`
+	SafetyHTTPOverride    bool          `json:"-"  yaml:"-"`
+	PollInterval          time.Duration `json:"-"  yaml:"-"`
+	DiscovererGracePeriod time.Duration `json:"-"  yaml:"-"`
 }
 
 // FromYAML creates a dubber config from a YAML config file
@@ -118,42 +162,111 @@ func FromYAML(r io.Reader) (Config, error) {
 // XXX catches unknown Rule settings
 type XXX map[string]interface{}
 
-// BuildProvisioners returns the set of provisioners for this config
-func (cfg Config) BuildProvisioners() (map[string]Provisioner, error) {
-	prvs := map[string]Provisioner{}
-	for _, pcfg := range cfg.Provisioners.Route53 {
-		dom := pcfg.Zone
-		prv := NewRoute53(pcfg)
-		if _, ok := prvs[dom]; ok {
-			// We should actually allow this.
-			return nil, fmt.Errorf("zone %q managed by multiple provisioners", dom)
-		}
+// BuildProvisioners returns the provisioners for this config, keyed by
+// the zone they manage. A zone may be managed by several provisioners,
+// each is reconciled independently.
+func (cfg Config) BuildProvisioners() (map[string][]NamedProvisioner, error) {
+	prvs := map[string][]NamedProvisioner{}
+	add := func(kind string, i int, dom string, prv Provisioner) {
 		if cfg.DryRun {
-			prvs[dom] = dryRunProvisioner{prv}
-			continue
+			prv = dryRunProvisioner{real: prv}
 		}
-		prvs[dom] = prv
+		prvs[dom] = append(prvs[dom], NamedProvisioner{
+			Name:        fmt.Sprintf("%s/%d", kind, i),
+			Provisioner: prv,
+		})
+	}
+
+	for i := range cfg.Provisioners.Route53 {
+		pcfg := &cfg.Provisioners.Route53[i]
+		add("route53", i, pcfg.Zone, NewRoute53(pcfg))
+	}
+
+	for i := range cfg.Provisioners.GCloudDNS {
+		pcfg := &cfg.Provisioners.GCloudDNS[i]
+		add("gcloud", i, pcfg.Zone, NewGCloudDNS(pcfg))
+	}
+
+	for i := range cfg.Provisioners.RFC2136 {
+		pcfg := &cfg.Provisioners.RFC2136[i]
+		add("rfc2136", i, pcfg.Zone, NewRFC2136(pcfg))
 	}
 
-	for _, pcfg := range cfg.Provisioners.GCloudDNS {
-		dom := pcfg.Zone
-		prv := NewGCloudDNS(pcfg)
-		if _, ok := prvs[dom]; ok {
-			// We should actually allow this.
-			return nil, fmt.Errorf("zone %q managed by multiple provisioners", dom)
+	for i := range cfg.Provisioners.Etcd {
+		pcfg := &cfg.Provisioners.Etcd[i]
+		prv, err := NewEtcd(pcfg)
+		if err != nil {
+			return nil, err
 		}
-		if cfg.DryRun {
-			prvs[dom] = dryRunProvisioner{prv}
-			continue
+		add("etcd", i, pcfg.Zone, prv)
+	}
+
+	for i := range cfg.Provisioners.PowerDNS {
+		pcfg := &cfg.Provisioners.PowerDNS[i]
+		prv, err := NewPowerDNS(pcfg)
+		if err != nil {
+			return nil, err
 		}
-		prvs[dom] = prv
+		add("powerdns", i, pcfg.Zone, prv)
 	}
 
-	for _, p := range prvs {
-		_, err := p.OwnerFlags()
+	for i := range cfg.Provisioners.Cloudflare {
+		pcfg := &cfg.Provisioners.Cloudflare[i]
+		prv, err := NewCloudflare(pcfg)
 		if err != nil {
 			return nil, err
 		}
+		add("cloudflare", i, pcfg.Zone, prv)
+	}
+
+	for i := range cfg.Provisioners.Azure {
+		pcfg := &cfg.Provisioners.Azure[i]
+		prv, err := NewAzureDNS(pcfg)
+		if err != nil {
+			return nil, err
+		}
+		add("azure", i, pcfg.Zone, prv)
+	}
+
+	for i := range cfg.Provisioners.ZoneFile {
+		pcfg := &cfg.Provisioners.ZoneFile[i]
+		prv, err := NewZoneFile(pcfg)
+		if err != nil {
+			return nil, err
+		}
+		add("zonefile", i, pcfg.Zone, prv)
+	}
+
+	// Zones sharing a listen address are served from one mux, where a
+	// second server for the same zone would replace the first.
+	served := map[string]int{}
+	for i := range cfg.Provisioners.Authoritative {
+		pcfg := &cfg.Provisioners.Authoritative[i]
+		prv, err := NewAuthoritative(pcfg)
+		if err != nil {
+			return nil, err
+		}
+		k := prv.origin + " " + pcfg.listenAddr()
+		if j, ok := served[k]; ok {
+			return nil, fmt.Errorf("authoritative/%d and authoritative/%d both serve zone %s on %s", j, i, prv.origin, pcfg.listenAddr())
+		}
+		served[k] = i
+		add("authoritative", i, pcfg.Zone, prv)
+	}
+
+	for _, ps := range prvs {
+		for _, p := range ps {
+			_, err := p.OwnerFlags()
+			if err != nil {
+				return nil, err
+			}
+			if _, err := p.Registry(); err != nil {
+				return nil, err
+			}
+			if _, err := p.Safety(); err != nil {
+				return nil, err
+			}
+		}
 	}
 	return prvs, nil
 }
@@ -173,6 +286,7 @@ func (cfg Config) BuildDiscoveres() ([]Discoverer, error) {
 		}
 
 		ds = append(ds, Discoverer{
+			Name:         fmt.Sprintf("marathon/%d", i),
 			StatePuller:  d,
 			JSONTemplate: dcfg.Template,
 		})
@@ -189,7 +303,123 @@ func (cfg Config) BuildDiscoveres() ([]Discoverer, error) {
 			return nil, fmt.Errorf("building kubernetes Discoverer failed, %w", err)
 		}
 
+		if dcfg.DNSEndpoints.Enabled {
+			dcfg.Template, err = withDNSEndpointTemplate(dcfg.Template)
+			if err != nil {
+				return nil, fmt.Errorf("building kubernetes Discoverer failed, %w", err)
+			}
+		}
+
+		ds = append(ds, Discoverer{
+			Name:         fmt.Sprintf("kubernetes/%d", i),
+			StatePuller:  d,
+			JSONTemplate: dcfg.Template,
+		})
+	}
+
+	for i := range cfg.Discoverers.Consul {
+		dcfg := cfg.Discoverers.Consul[i]
+		if dcfg.Disabled {
+			continue
+		}
+
+		d, err := NewConsul(dcfg)
+		if err != nil {
+			return nil, fmt.Errorf("building consul Discoverer failed, %w", err)
+		}
+
+		ds = append(ds, Discoverer{
+			Name:         fmt.Sprintf("consul/%d", i),
+			StatePuller:  d,
+			JSONTemplate: dcfg.Template,
+		})
+	}
+
+	for i := range cfg.Discoverers.Nomad {
+		dcfg := cfg.Discoverers.Nomad[i]
+		if dcfg.Disabled {
+			continue
+		}
+
+		d, err := NewNomad(dcfg)
+		if err != nil {
+			return nil, fmt.Errorf("building nomad Discoverer failed, %w", err)
+		}
+
+		ds = append(ds, Discoverer{
+			Name:         fmt.Sprintf("nomad/%d", i),
+			StatePuller:  d,
+			JSONTemplate: dcfg.Template,
+		})
+	}
+
+	for i := range cfg.Discoverers.Files {
+		dcfg := cfg.Discoverers.Files[i]
+		if dcfg.Disabled {
+			continue
+		}
+
+		d, err := NewFiles(dcfg)
+		if err != nil {
+			return nil, fmt.Errorf("building files Discoverer failed, %w", err)
+		}
+
+		ds = append(ds, Discoverer{
+			Name:         fmt.Sprintf("files/%d", i),
+			StatePuller:  d,
+			JSONTemplate: filesDefaultTemplate(dcfg.Template),
+		})
+	}
+
+	for i := range cfg.Discoverers.HTTP {
+		dcfg := cfg.Discoverers.HTTP[i]
+		if dcfg.Disabled {
+			continue
+		}
+
+		d, err := NewHTTP(dcfg)
+		if err != nil {
+			return nil, fmt.Errorf("building http Discoverer failed, %w", err)
+		}
+
+		ds = append(ds, Discoverer{
+			Name:         fmt.Sprintf("http/%d", i),
+			StatePuller:  d,
+			JSONTemplate: dcfg.Template,
+		})
+	}
+
+	for i := range cfg.Discoverers.Exec {
+		dcfg := cfg.Discoverers.Exec[i]
+		if dcfg.Disabled {
+			continue
+		}
+
+		d, err := NewExec(dcfg)
+		if err != nil {
+			return nil, fmt.Errorf("building exec Discoverer failed, %w", err)
+		}
+
+		ds = append(ds, Discoverer{
+			Name:         fmt.Sprintf("exec/%d", i),
+			StatePuller:  d,
+			JSONTemplate: dcfg.Template,
+		})
+	}
+
+	for i := range cfg.Discoverers.Docker {
+		dcfg := cfg.Discoverers.Docker[i]
+		if dcfg.Disabled {
+			continue
+		}
+
+		d, err := NewDocker(dcfg)
+		if err != nil {
+			return nil, fmt.Errorf("building docker Discoverer failed, %w", err)
+		}
+
 		ds = append(ds, Discoverer{
+			Name:         fmt.Sprintf("docker/%d", i),
 			StatePuller:  d,
 			JSONTemplate: dcfg.Template,
 		})
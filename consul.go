@@ -0,0 +1,204 @@
+// Copyright 2017 Qubit Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dubber
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	consul "github.com/hashicorp/consul/api"
+	"k8s.io/klog/v2"
+)
+
+// ConsulConfig describes configuration options for
+// the consul discoverer. Any settings not given are taken
+// from the standard CONSUL_ environment variables.
+type ConsulConfig struct {
+	BaseDiscovererConfig `json:",omitempty" yaml:",omitempty,inline"`
+	Address              string `json:"address" yaml:"address"`
+	Datacenter           string `json:"datacenter" yaml:"datacenter"`
+	Token                string `json:"token" yaml:"token"`
+	// Services limits the services passed to the template, all
+	// services are included if this is empty.
+	Services []string `json:"services" yaml:"services"`
+	XXX      `json:",omitempty" yaml:",omitempty,inline"`
+}
+
+// ConsulState holds the state information we will pass to the configuration
+// template.
+type ConsulState struct {
+	// Nodes are the catalog nodes, by node name.
+	Nodes map[string]*consul.Node
+	// Services are the instances of each service, with their node and
+	// health checks, by service name.
+	Services map[string][]*consul.ServiceEntry
+}
+
+// Consul implements discovery of services and nodes
+// from the catalog of https://www.consul.io
+type Consul struct {
+	client   *consul.Client
+	services []string
+
+	sync.Mutex
+	// listed is set when the last call succeeded, and indexes are
+	// those of the state it returned.
+	listed  bool
+	indexes consulIndexes
+}
+
+// consulIndexes are the raft indexes of the endpoints we block on.
+type consulIndexes struct {
+	services uint64
+	nodes    uint64
+	health   uint64
+}
+
+// NewConsul creates a new consul discoverer
+func NewConsul(cfg ConsulConfig) (*Consul, error) {
+	config := consul.DefaultConfig()
+	if cfg.Address != "" {
+		config.Address = cfg.Address
+	}
+	if cfg.Datacenter != "" {
+		config.Datacenter = cfg.Datacenter
+	}
+	if cfg.Token != "" {
+		config.Token = cfg.Token
+	}
+
+	client, err := consul.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Consul{client: client, services: cfg.Services}, nil
+}
+
+func (c *Consul) blocksUntilChange() {}
+
+// StatePull reads the services, nodes and health from the consul catalog.
+// The first call, and the first call after a failure, return the current
+// state, subsequent calls block until the catalog or health of services changes.
+func (c *Consul) StatePull(ctx context.Context) (State, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.listed {
+		c.listed = false
+		if err := c.wait(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	st, idxs, err := c.state(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.indexes = idxs
+	c.listed = true
+
+	return st, nil
+}
+
+// wait blocks until any of the indexes change.
+func (c *Consul) wait(ctx context.Context) error {
+	watch := func(idx uint64, query func(*consul.QueryOptions) (*consul.QueryMeta, error)) func(context.Context) error {
+		return func(ctx context.Context) error {
+			for {
+				q := (&consul.QueryOptions{WaitIndex: idx}).WithContext(ctx)
+				meta, err := query(q)
+				if err != nil {
+					return fmt.Errorf("failed watching consul, %w", err)
+				}
+				// Blocking queries return the same index when they time
+				// out with no changes
+				if meta.LastIndex != idx {
+					return nil
+				}
+			}
+		}
+	}
+
+	return waitForChange(ctx,
+		watch(c.indexes.services, func(q *consul.QueryOptions) (*consul.QueryMeta, error) {
+			_, meta, err := c.client.Catalog().Services(q)
+			return meta, err
+		}),
+		watch(c.indexes.nodes, func(q *consul.QueryOptions) (*consul.QueryMeta, error) {
+			_, meta, err := c.client.Catalog().Nodes(q)
+			return meta, err
+		}),
+		watch(c.indexes.health, func(q *consul.QueryOptions) (*consul.QueryMeta, error) {
+			_, meta, err := c.client.Health().State(consul.HealthAny, q)
+			return meta, err
+		}),
+	)
+}
+
+func (c *Consul) state(ctx context.Context) (*ConsulState, consulIndexes, error) {
+	klog.Info("Pulling state from consul")
+
+	var idxs consulIndexes
+	q := (&consul.QueryOptions{}).WithContext(ctx)
+
+	svcs, meta, err := c.client.Catalog().Services(q)
+	if err != nil {
+		return nil, idxs, fmt.Errorf("failed listing consul services, %w", err)
+	}
+	idxs.services = meta.LastIndex
+
+	nodes, meta, err := c.client.Catalog().Nodes(q)
+	if err != nil {
+		return nil, idxs, fmt.Errorf("failed listing consul nodes, %w", err)
+	}
+	idxs.nodes = meta.LastIndex
+
+	_, meta, err = c.client.Health().State(consul.HealthAny, q)
+	if err != nil {
+		return nil, idxs, fmt.Errorf("failed reading consul health, %w", err)
+	}
+	idxs.health = meta.LastIndex
+
+	st := &ConsulState{
+		Nodes:    map[string]*consul.Node{},
+		Services: map[string][]*consul.ServiceEntry{},
+	}
+
+	for _, n := range nodes {
+		st.Nodes[n.Node] = n
+	}
+
+	names := c.services
+	if len(names) == 0 {
+		for name := range svcs {
+			names = append(names, name)
+		}
+	}
+
+	for _, name := range names {
+		if _, ok := svcs[name]; !ok {
+			continue
+		}
+		entries, _, err := c.client.Health().Service(name, "", false, q)
+		if err != nil {
+			return nil, idxs, fmt.Errorf("failed reading consul service %s, %w", name, err)
+		}
+		st.Services[name] = entries
+	}
+
+	return st, idxs, nil
+}
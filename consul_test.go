@@ -0,0 +1,192 @@
+package dubber
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// testConsulServer is a stand-in for the parts of the consul HTTP API used
+// by the discoverer, with support for blocking queries.
+type testConsulServer struct {
+	sync.Mutex
+	index    uint64
+	changed  chan struct{}
+	failing  bool
+	nodes    []*consul.Node
+	services map[string][]*consul.ServiceEntry
+}
+
+func (s *testConsulServer) register(e *consul.ServiceEntry) {
+	s.Lock()
+	defer s.Unlock()
+	s.services[e.Service.Service] = append(s.services[e.Service.Service], e)
+	s.index++
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *testConsulServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	idx, changed := s.index, s.changed
+	s.Unlock()
+
+	if wi := r.URL.Query().Get("index"); wi != "" {
+		if n, _ := strconv.ParseUint(wi, 10, 64); n == idx {
+			select {
+			case <-changed:
+			case <-r.Context().Done():
+				return
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.failing {
+		http.Error(w, "unavailable", http.StatusInternalServerError)
+		return
+	}
+
+	var resp interface{}
+	switch {
+	case r.URL.Path == "/v1/catalog/services":
+		svcs := map[string][]string{}
+		for name, es := range s.services {
+			for _, e := range es {
+				svcs[name] = append(svcs[name], e.Service.Tags...)
+			}
+		}
+		resp = svcs
+	case r.URL.Path == "/v1/catalog/nodes":
+		resp = s.nodes
+	case r.URL.Path == "/v1/health/state/any":
+		resp = consul.HealthChecks{}
+	case strings.HasPrefix(r.URL.Path, "/v1/health/service/"):
+		resp = s.services[strings.TrimPrefix(r.URL.Path, "/v1/health/service/")]
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(s.index, 10))
+	json.NewEncoder(w).Encode(resp)
+}
+
+func TestConsulStatePull(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	node := &consul.Node{Node: "node1", Address: "10.0.0.1"}
+	cs := &testConsulServer{
+		index:   1,
+		changed: make(chan struct{}),
+		nodes:   []*consul.Node{node},
+		services: map[string][]*consul.ServiceEntry{
+			"web": {{Node: node, Service: &consul.AgentService{Service: "web", Port: 80}}},
+		},
+	}
+	ts := httptest.NewServer(cs)
+	defer ts.Close()
+
+	c, err := NewConsul(ConsulConfig{Address: ts.URL})
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	st, err := c.StatePull(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	cst := st.(*ConsulState)
+	if _, ok := cst.Nodes["node1"]; !ok {
+		t.Fatalf("expected node1 in state, got %v", cst.Nodes)
+	}
+	if len(cst.Services["web"]) != 1 {
+		t.Fatalf("expected 1 web instance, got %v", cst.Services)
+	}
+
+	type result struct {
+		st  State
+		err error
+	}
+	res := make(chan result)
+	go func() {
+		st, err := c.StatePull(ctx)
+		res <- result{st, err}
+	}()
+
+	select {
+	case r := <-res:
+		t.Fatalf("expected StatePull to block until a change, got %v, %v", r.st, r.err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	cs.register(&consul.ServiceEntry{Node: node, Service: &consul.AgentService{Service: "api", Port: 8080}})
+
+	r := <-res
+	if r.err != nil {
+		t.Fatalf("unexpected error, %v", r.err)
+	}
+	cst = r.st.(*ConsulState)
+	if len(cst.Services["api"]) != 1 {
+		t.Fatalf("expected 1 api instance, got %v", cst.Services)
+	}
+}
+
+func TestConsulStatePull_Recover(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	node := &consul.Node{Node: "node1", Address: "10.0.0.1"}
+	cs := &testConsulServer{
+		index:   1,
+		changed: make(chan struct{}),
+		nodes:   []*consul.Node{node},
+		services: map[string][]*consul.ServiceEntry{
+			"web": {{Node: node, Service: &consul.AgentService{Service: "web", Port: 80}}},
+		},
+	}
+	ts := httptest.NewServer(cs)
+	defer ts.Close()
+
+	c, err := NewConsul(ConsulConfig{Address: ts.URL})
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	if _, err := c.StatePull(ctx); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	cs.Lock()
+	cs.failing = true
+	cs.Unlock()
+	if _, err := c.StatePull(ctx); err == nil {
+		t.Fatalf("expected an error while consul is failing")
+	}
+
+	// The catalog is unchanged, but the recovery is still reported
+	cs.Lock()
+	cs.failing = false
+	cs.Unlock()
+	rctx, rcancel := context.WithTimeout(ctx, time.Second)
+	defer rcancel()
+	st, err := c.StatePull(rctx)
+	if err != nil {
+		t.Fatalf("expected the state after recovering, got %v", err)
+	}
+	if len(st.(*ConsulState).Services["web"]) != 1 {
+		t.Fatalf("expected 1 web instance, got %v", st.(*ConsulState).Services)
+	}
+}
@@ -36,8 +36,40 @@ type StatePuller interface {
 	StatePull(context.Context) (State, error)
 }
 
+// watcher is implemented by StatePullers that only block until their
+// state changes, as described for StatePuller, rather than returning the
+// current state immediately. They are called again as soon as they return,
+// instead of once every poll interval.
+type watcher interface {
+	blocksUntilChange()
+}
+
+// waitForChange runs each of the watches concurrently, and returns
+// when the first of them returns. Watches should block until they see
+// a change, or their context is cancelled.
+func waitForChange(ctx context.Context, watches ...func(context.Context) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	changed := make(chan error, len(watches))
+	for _, w := range watches {
+		go func(w func(context.Context) error) {
+			changed <- w(ctx)
+		}(w)
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-changed:
+		return err
+	}
+}
+
 // Discoverer combined zone data and state into a Zone
 type Discoverer struct {
+	// Name identifies the discoverer in logs and metrics.
+	Name string
 	StatePuller
 	State interface{}
 	JSONTemplate
@@ -0,0 +1,345 @@
+// Copyright 2017 Qubit Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dubber
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// DockerConfig describes configuration options for
+// the docker discoverer.
+type DockerConfig struct {
+	BaseDiscovererConfig `json:",omitempty" yaml:",omitempty,inline"`
+	// Host is the docker daemon to connect to, as unix:///path/to/socket
+	// or tcp://host:port. Defaults to unix:///var/run/docker.sock.
+	Host string          `json:"host" yaml:"host"`
+	TLS  TLSClientConfig `json:"tls" yaml:"tls"`
+	// Labels limits the containers to those with the given labels, in
+	// the form "key" or "key=value".
+	Labels []string `json:"labels" yaml:"labels"`
+	// Debounce is how long to wait for further events after an event
+	// is seen, before a new state is returned. Defaults to 1s.
+	Debounce time.Duration `json:"debounce" yaml:"debounce"`
+	XXX      `json:",omitempty" yaml:",omitempty,inline"`
+}
+
+// DockerState holds the state information we will pass to the configuration
+// template.
+type DockerState struct {
+	// Containers are the running containers, keyed by name.
+	Containers map[string]DockerContainer
+}
+
+// DockerContainer describes a running container.
+type DockerContainer struct {
+	ID     string            `json:"Id"`
+	Names  []string          `json:"Names"`
+	Image  string            `json:"Image"`
+	Labels map[string]string `json:"Labels"`
+	State  string            `json:"State"`
+	Status string            `json:"Status"`
+	Ports  []DockerPort      `json:"Ports"`
+
+	NetworkSettings struct {
+		Networks map[string]DockerNetwork `json:"Networks"`
+	} `json:"NetworkSettings"`
+
+	// Name is the container's primary name, without the leading /.
+	Name string `json:"-"`
+	// Networks is a shortcut for NetworkSettings.Networks, keyed by
+	// network name.
+	Networks map[string]DockerNetwork `json:"-"`
+}
+
+// DockerPort is a port exposed by a container.
+type DockerPort struct {
+	IP          string `json:"IP"`
+	PrivatePort int    `json:"PrivatePort"`
+	PublicPort  int    `json:"PublicPort"`
+	Type        string `json:"Type"`
+}
+
+// DockerNetwork describes a container's attachment to a network.
+type DockerNetwork struct {
+	NetworkID         string   `json:"NetworkID"`
+	Aliases           []string `json:"Aliases"`
+	IPAddress         string   `json:"IPAddress"`
+	GlobalIPv6Address string   `json:"GlobalIPv6Address"`
+	MacAddress        string   `json:"MacAddress"`
+}
+
+// dockerEvent is the subset of an event from the docker event stream that
+// we use.
+type dockerEvent struct {
+	Type   string `json:"Type"`
+	Action string `json:"Action"`
+	Actor  struct {
+		ID         string            `json:"ID"`
+		Attributes map[string]string `json:"Attributes"`
+	} `json:"Actor"`
+}
+
+// Docker implements discovery of containers from a docker daemon.
+type Docker struct {
+	client   *http.Client
+	base     string
+	labels   []string
+	debounce time.Duration
+
+	sync.Mutex
+	started bool
+	changes chan struct{}
+}
+
+// NewDocker creates a new docker discoverer
+func NewDocker(cfg DockerConfig) (*Docker, error) {
+	host := cfg.Host
+	if host == "" {
+		host = "unix:///var/run/docker.sock"
+	}
+
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid docker host %s, %w", host, err)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	d := &Docker{
+		client:   &http.Client{Transport: transport},
+		labels:   cfg.Labels,
+		debounce: cfg.Debounce,
+		changes:  make(chan struct{}, 1),
+	}
+	if d.debounce == 0 {
+		d.debounce = time.Second
+	}
+
+	switch u.Scheme {
+	case "unix":
+		path := u.Path
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", path)
+		}
+		// The host is ignored, but must be valid
+		d.base = "http://docker"
+	case "tcp", "http", "https":
+		scheme := "http"
+		if cfg.TLS.enabled() || u.Scheme == "https" {
+			scheme = "https"
+			transport.TLSClientConfig, err = cfg.TLS.build()
+			if err != nil {
+				return nil, fmt.Errorf("invalid docker tls config, %w", err)
+			}
+		}
+		d.base = scheme + "://" + u.Host
+	default:
+		return nil, fmt.Errorf("unsupported docker host scheme %q", u.Scheme)
+	}
+
+	return d, nil
+}
+
+func (d *Docker) blocksUntilChange() {}
+
+// StatePull lists the running containers. The first call starts watching the
+// docker event stream and returns the current state, subsequent calls block
+// until an event is seen, and no further events have been seen for the
+// debounce period. If listing the containers fails, the next call retries
+// without waiting for another event.
+func (d *Docker) StatePull(ctx context.Context) (State, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if !d.started {
+		d.started = true
+		go d.watch(ctx)
+		return d.retryState(ctx)
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-d.changes:
+	}
+
+	timer := time.NewTimer(d.debounce)
+	defer timer.Stop()
+	for quiet := false; !quiet; {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-d.changes:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(d.debounce)
+		case <-timer.C:
+			quiet = true
+		}
+	}
+
+	return d.retryState(ctx)
+}
+
+// retryState lists the containers, re-arming the change notification if
+// that fails, so that the changes we were woken for are not lost.
+func (d *Docker) retryState(ctx context.Context) (State, error) {
+	st, err := d.state(ctx)
+	if err != nil {
+		d.changed()
+	}
+	return st, err
+}
+
+// changed notifies StatePull that containers may have changed
+func (d *Docker) changed() {
+	select {
+	case d.changes <- struct{}{}:
+	default:
+	}
+}
+
+// filters builds the docker API filters argument.
+func (d *Docker) filters(fs map[string][]string) string {
+	if len(d.labels) != 0 {
+		fs["label"] = d.labels
+	}
+	bs, _ := json.Marshal(fs)
+	return string(bs)
+}
+
+// relevant reports whether an event may change the state. The label filter
+// is applied to container events here, rather than by the daemon, as it
+// would otherwise also drop the network connect and disconnect events,
+// which carry no container labels.
+func (d *Docker) relevant(ev dockerEvent) bool {
+	if ev.Type != "container" {
+		return true
+	}
+	for _, l := range d.labels {
+		k, v, hasValue := strings.Cut(l, "=")
+		av, ok := ev.Actor.Attributes[k]
+		if !ok || (hasValue && av != v) {
+			return false
+		}
+	}
+	return true
+}
+
+// watch follows the docker event stream until the context is cancelled,
+// reconnecting if the stream fails.
+func (d *Docker) watch(ctx context.Context) {
+	for {
+		err := d.events(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		klog.Errorf("docker event stream failed, %v", err)
+
+		// We may have missed events while disconnected
+		d.changed()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func (d *Docker) events(ctx context.Context) error {
+	fs, _ := json.Marshal(map[string][]string{
+		"type": {"container", "network"},
+	})
+	q := url.Values{}
+	q.Set("filters", string(fs))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.base+"/events?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response, %s", resp.Status)
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var ev dockerEvent
+		if err := dec.Decode(&ev); err != nil {
+			return err
+		}
+		if !d.relevant(ev) {
+			continue
+		}
+		klog.V(2).Infof("docker event %s %s %s", ev.Type, ev.Action, ev.Actor.ID)
+		d.changed()
+	}
+}
+
+func (d *Docker) state(ctx context.Context) (State, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	q := url.Values{}
+	q.Set("filters", d.filters(map[string][]string{
+		"status": {"running"},
+	}))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.base+"/containers/json?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers, %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to list containers, %s", resp.Status)
+	}
+
+	var cs []DockerContainer
+	if err := json.NewDecoder(resp.Body).Decode(&cs); err != nil {
+		return nil, fmt.Errorf("failed to decode containers, %w", err)
+	}
+
+	st := &DockerState{Containers: map[string]DockerContainer{}}
+	for _, c := range cs {
+		c.Name = c.ID
+		if len(c.Names) != 0 {
+			c.Name = strings.TrimPrefix(c.Names[0], "/")
+		}
+		c.Networks = c.NetworkSettings.Networks
+		st.Containers[c.Name] = c
+	}
+
+	return st, nil
+}
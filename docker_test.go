@@ -0,0 +1,177 @@
+package dubber
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+)
+
+func TestDockerDiscover(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// unix socket paths are limited in length, so avoid t.TempDir
+	dir, err := os.MkdirTemp("", "dubber")
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "docker.sock")
+
+	var mu sync.Mutex
+	containers := []string{`{
+  "Id": "abc123",
+  "Names": ["/web"],
+  "Image": "nginx",
+  "Labels": {"dns.name": "www.example.com"},
+  "State": "running",
+  "Ports": [{"IP": "0.0.0.0", "PrivatePort": 80, "PublicPort": 8080, "Type": "tcp"}],
+  "NetworkSettings": {"Networks": {"bridge": {"IPAddress": "172.17.0.2"}}}
+}`}
+	failing := false
+	events := make(chan string)
+	done := make(chan struct{})
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var fs map[string][]string
+		if err := json.Unmarshal([]byte(r.URL.Query().Get("filters")), &fs); err != nil {
+			http.Error(w, "bad filters", http.StatusBadRequest)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/containers/json":
+			if len(fs["label"]) != 1 || fs["label"][0] != "dns.name" {
+				http.Error(w, "bad filters", http.StatusBadRequest)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if failing {
+				http.Error(w, "broken", http.StatusInternalServerError)
+				return
+			}
+			w.Write([]byte("["))
+			for i, c := range containers {
+				if i != 0 {
+					w.Write([]byte(","))
+				}
+				w.Write([]byte(c))
+			}
+			w.Write([]byte("]"))
+		case "/events":
+			// The daemon would drop network events without labels
+			if len(fs["label"]) != 0 {
+				http.Error(w, "unexpected label filter", http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			for {
+				select {
+				case <-r.Context().Done():
+					return
+				case <-done:
+					return
+				case ev := <-events:
+					w.Write([]byte(ev + "\n"))
+					w.(http.Flusher).Flush()
+				}
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	ts.Listener = l
+	ts.Start()
+	defer ts.Close()
+	defer close(done)
+
+	dd, err := NewDocker(DockerConfig{
+		Host:     "unix://" + sock,
+		Labels:   []string{"dns.name"},
+		Debounce: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	tmpl := template.Must(template.New("base").Parse(`
+{{- range .Containers }}
+{{ index .Labels "dns.name" }}. 300 IN A {{ .Networks.bridge.IPAddress }}
+{{- end }}`))
+	d := Discoverer{StatePuller: dd, JSONTemplate: JSONTemplate{tmpl}}
+
+	check := func(exp string) {
+		z, err := d.Discover(ctx)
+		if err != nil {
+			t.Fatalf("unexpected error, %v", err)
+		}
+		sort.Sort(ByRR(z))
+		if z.String() != exp {
+			t.Fatalf("\n  expected:\n%s\n  got:\n%s", exp, z)
+		}
+	}
+
+	check(`www.example.com.	300	IN	A	172.17.0.2`)
+
+	mu.Lock()
+	containers = append(containers, `{
+  "Id": "def456",
+  "Names": ["/api"],
+  "Labels": {"dns.name": "api.example.com"},
+  "NetworkSettings": {"Networks": {"bridge": {"IPAddress": "172.17.0.3"}}}
+}`)
+	mu.Unlock()
+
+	send := func(ev string) {
+		go func() {
+			select {
+			case events <- ev:
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	send(`{"Type": "container", "Action": "start", "Actor": {"ID": "def456", "Attributes": {"dns.name": "api.example.com"}}}`)
+
+	check(`api.example.com.	300	IN	A	172.17.0.3
+www.example.com.	300	IN	A	172.17.0.2`)
+
+	// Network changes carry no container labels, but are still seen
+	mu.Lock()
+	containers = containers[:1]
+	containers[0] = `{
+  "Id": "abc123",
+  "Names": ["/web"],
+  "Labels": {"dns.name": "www.example.com"},
+  "NetworkSettings": {"Networks": {"bridge": {"IPAddress": "172.17.0.4"}}}
+}`
+	failing = true
+	mu.Unlock()
+
+	send(`{"Type": "network", "Action": "connect", "Actor": {"ID": "net1", "Attributes": {"container": "abc123", "name": "bridge"}}}`)
+
+	// A failed listing is retried without waiting for another event
+	if _, err := d.Discover(ctx); err == nil {
+		t.Fatalf("expected an error listing containers")
+	}
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+
+	check(`www.example.com.	300	IN	A	172.17.0.4`)
+}
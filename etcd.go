@@ -0,0 +1,384 @@
+// Copyright 2017 Qubit Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dubber
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	klog "k8s.io/klog/v2"
+)
+
+// EtcdConfig describes the settings required for managing a zone stored in
+// etcd, using the SkyDNS layout served by the CoreDNS etcd plugin.
+type EtcdConfig struct {
+	BaseProvisionerConfig `json:",omitempty,inline" yaml:",omitempty,inline"`
+	Endpoints             []string `yaml:"endpoints" json:"endpoints"`
+	// Prefix is the root of the SkyDNS keys, defaults to /skydns.
+	Prefix   string          `yaml:"prefix" json:"prefix"`
+	Username string          `yaml:"username" json:"username"`
+	Password string          `yaml:"password" json:"password"`
+	TLS      TLSClientConfig `yaml:"tls" json:"tls"`
+	Timeout  time.Duration   `yaml:"timeout" json:"timeout"`
+}
+
+// Etcd is a provisioner for zones served by CoreDNS from etcd.
+// Each record is stored as a SkyDNS service under a key derived from the
+// record's name, with the labels reversed, e.g. www.example.com. is stored
+// under /skydns/com/example/www/. Leaf keys of 8 hex characters, as written
+// by dubber and external-dns, identify individual records for the name
+// above them.
+//
+// The CoreDNS etcd plugin synthesises the SOA record, so the SOA returned
+// by RemoteZone is also synthesised, with a serial derived from the zone's
+// keys and their revisions. UpdateZone reads the zone again and checks the
+// serial, then applies the changes in a single transaction that fails if
+// any of the zone's keys have been created or modified since that read.
+type Etcd struct {
+	*EtcdConfig
+	client *clientv3.Client
+}
+
+// etcdZone is the state of a zone's keys as read from etcd.
+type etcdZone struct {
+	zone Zone
+	// keys holds the etcd key of each record.
+	keys map[string]string
+	// rev is the etcd revision the zone was read at.
+	rev int64
+}
+
+// etcdService is a SkyDNS service entry.
+type etcdService struct {
+	Host     string `json:"host,omitempty"`
+	Port     int    `json:"port,omitempty"`
+	Priority int    `json:"priority,omitempty"`
+	Weight   int    `json:"weight,omitempty"`
+	Text     string `json:"text,omitempty"`
+	Mail     bool   `json:"mail,omitempty"`
+	TTL      uint32 `json:"ttl,omitempty"`
+}
+
+// etcdRecordID matches the final component of keys that identify a single
+// record under a name.
+var etcdRecordID = regexp.MustCompile(`^[0-9a-f]{8}$`)
+
+// NewEtcd creates an etcd SkyDNS provisioner.
+func NewEtcd(cfg *EtcdConfig) (*Etcd, error) {
+	ccfg := clientv3.Config{
+		Endpoints:   cfg.Endpoints,
+		Username:    cfg.Username,
+		Password:    cfg.Password,
+		DialTimeout: 10 * time.Second,
+	}
+	if cfg.TLS.enabled() {
+		tlsCfg, err := cfg.TLS.build()
+		if err != nil {
+			return nil, fmt.Errorf("invalid etcd tls config, %w", err)
+		}
+		ccfg.TLS = tlsCfg
+	}
+
+	c, err := clientv3.New(ccfg)
+	if err != nil {
+		return nil, fmt.Errorf("could not create etcd client, %w", err)
+	}
+	return newEtcd(cfg, c), nil
+}
+
+func newEtcd(cfg *EtcdConfig, c *clientv3.Client) *Etcd {
+	return &Etcd{EtcdConfig: cfg, client: c}
+}
+
+// GroupFlags is empty for etcd
+func (e *Etcd) GroupFlags() []string {
+	return nil
+}
+
+func (e *Etcd) timeout() time.Duration {
+	if e.Timeout == 0 {
+		return 10 * time.Second
+	}
+	return e.Timeout
+}
+
+// path converts a domain name to its SkyDNS key.
+func (e *Etcd) path(name string) string {
+	prefix := e.Prefix
+	if prefix == "" {
+		prefix = "/skydns"
+	}
+	labels := dns.SplitDomainName(strings.ToLower(name))
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return strings.TrimSuffix(prefix, "/") + "/" + strings.Join(labels, "/")
+}
+
+// name converts a SkyDNS key, below the zone's key, to a domain name.
+func (e *Etcd) name(key string) string {
+	zpath := e.path(e.Zone)
+	rel := strings.Trim(strings.TrimPrefix(key, zpath), "/")
+	name := dns.Fqdn(e.Zone)
+	if rel == "" {
+		return name
+	}
+
+	labels := strings.Split(rel, "/")
+	if etcdRecordID.MatchString(labels[len(labels)-1]) {
+		labels = labels[:len(labels)-1]
+	}
+	for _, l := range labels {
+		name = l + "." + name
+	}
+	return name
+}
+
+func (e *Etcd) reverseZone() bool {
+	z := strings.ToLower(dns.Fqdn(e.Zone))
+	return strings.HasSuffix(z, "in-addr.arpa.") || strings.HasSuffix(z, "ip6.arpa.")
+}
+
+// recordKey is the key we store a record under.
+func (e *Etcd) recordKey(rr dns.RR) string {
+	h := fnv.New32a()
+	h.Write([]byte(rr.String()))
+	return fmt.Sprintf("%s/%08x", e.path(rr.Header().Name), h.Sum32())
+}
+
+// toRR converts a SkyDNS service to a resource record. The record type
+// is inferred the same way CoreDNS does when answering queries.
+func (e *Etcd) toRR(name string, svc etcdService) (dns.RR, error) {
+	ttl := svc.TTL
+	if ttl == 0 {
+		ttl = 300
+	}
+	hdr := dns.RR_Header{Name: name, Class: dns.ClassINET, Ttl: ttl}
+
+	ip := net.ParseIP(svc.Host)
+	switch {
+	case svc.Text != "":
+		hdr.Rrtype = dns.TypeTXT
+		return &dns.TXT{Hdr: hdr, Txt: []string{svc.Text}}, nil
+	case svc.Mail:
+		hdr.Rrtype = dns.TypeMX
+		return &dns.MX{Hdr: hdr, Preference: uint16(svc.Priority), Mx: dns.Fqdn(svc.Host)}, nil
+	case ip != nil && ip.To4() != nil:
+		hdr.Rrtype = dns.TypeA
+		return &dns.A{Hdr: hdr, A: ip}, nil
+	case ip != nil:
+		hdr.Rrtype = dns.TypeAAAA
+		return &dns.AAAA{Hdr: hdr, AAAA: ip}, nil
+	case svc.Host == "":
+		return nil, fmt.Errorf("service for %s has no host or text", name)
+	case svc.Port != 0:
+		hdr.Rrtype = dns.TypeSRV
+		return &dns.SRV{
+			Hdr:      hdr,
+			Priority: uint16(svc.Priority),
+			Weight:   uint16(svc.Weight),
+			Port:     uint16(svc.Port),
+			Target:   dns.Fqdn(svc.Host),
+		}, nil
+	case e.reverseZone():
+		hdr.Rrtype = dns.TypePTR
+		return &dns.PTR{Hdr: hdr, Ptr: dns.Fqdn(svc.Host)}, nil
+	default:
+		hdr.Rrtype = dns.TypeCNAME
+		return &dns.CNAME{Hdr: hdr, Target: dns.Fqdn(svc.Host)}, nil
+	}
+}
+
+// toService converts a resource record to a SkyDNS service.
+func toService(rr dns.RR) (etcdService, error) {
+	svc := etcdService{TTL: rr.Header().Ttl}
+	switch rr := rr.(type) {
+	case *dns.A:
+		svc.Host = rr.A.String()
+	case *dns.AAAA:
+		svc.Host = rr.AAAA.String()
+	case *dns.CNAME:
+		svc.Host = rr.Target
+	case *dns.PTR:
+		svc.Host = rr.Ptr
+	case *dns.SRV:
+		svc.Host = rr.Target
+		svc.Port = int(rr.Port)
+		svc.Priority = int(rr.Priority)
+		svc.Weight = int(rr.Weight)
+	case *dns.MX:
+		svc.Host = rr.Mx
+		svc.Priority = int(rr.Preference)
+		svc.Mail = true
+	case *dns.TXT:
+		svc.Text = strings.Join(rr.Txt, "")
+	default:
+		return svc, fmt.Errorf("record type %s is not supported by etcd", dns.TypeToString[rr.Header().Rrtype])
+	}
+	return svc, nil
+}
+
+// RemoteZone creates a Zone from the SkyDNS keys below the zone.
+func (e *Etcd) RemoteZone() (Zone, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout())
+	defer cancel()
+
+	ez, err := e.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return ez.zone, nil
+}
+
+// read reads the zone's keys. The serial of the synthesised SOA is a hash
+// of the zone's keys and their modification revisions, so that it changes
+// when any of them are created, modified or deleted, but not when
+// unrelated keys are written.
+func (e *Etcd) read(ctx context.Context) (etcdZone, error) {
+	zpath := e.path(e.Zone)
+	resp, err := e.client.Get(ctx, zpath, clientv3.WithPrefix())
+	if err != nil {
+		return etcdZone{}, fmt.Errorf("could not read zone %s, %w", e.Zone, err)
+	}
+
+	ez := etcdZone{keys: map[string]string{}, rev: resp.Header.Revision}
+	h := fnv.New32a()
+	for _, kv := range resp.Kvs {
+		key := string(kv.Key)
+		// Skip sibling keys sharing our prefix, e.g. /skydns/com/examples
+		if key != zpath && !strings.HasPrefix(key, zpath+"/") {
+			continue
+		}
+		fmt.Fprintf(h, "%s %d\n", key, kv.ModRevision)
+
+		var svc etcdService
+		if err := json.Unmarshal(kv.Value, &svc); err != nil {
+			klog.Errorf("ignoring invalid service at %s, %v", key, err)
+			continue
+		}
+		rr, err := e.toRR(e.name(key), svc)
+		if err != nil {
+			klog.Errorf("ignoring service at %s, %v", key, err)
+			continue
+		}
+		ez.keys[rr.String()] = key
+		ez.zone = append(ez.zone, &Record{RR: rr})
+	}
+
+	ez.zone = append(ez.zone, &Record{RR: &dns.SOA{
+		Hdr:     dns.RR_Header{Name: dns.Fqdn(e.Zone), Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300},
+		Ns:      "ns.dns." + dns.Fqdn(e.Zone),
+		Mbox:    "hostmaster." + dns.Fqdn(e.Zone),
+		Serial:  h.Sum32(),
+		Refresh: 7200,
+		Retry:   1800,
+		Expire:  86400,
+		Minttl:  30,
+	}})
+	sort.Sort(ByRR(ez.zone))
+
+	return ez, nil
+}
+
+// UpdateZone removes the unwanted records and adds the wanted records
+// in a single transaction. The zone is read again first, and the update
+// refused if its serial no longer matches the unwanted SOA. The transaction
+// is conditional on none of the zone's keys having been created or
+// modified since that read. etcd cannot make a transaction conditional on
+// a key in a range being deleted, so deletions are only detected up to
+// the read.
+func (e *Etcd) UpdateZone(wanted, unwanted, desired, remote Zone) error {
+	var soa *dns.SOA
+	var uws Zone
+	for _, uw := range unwanted {
+		if s, ok := uw.RR.(*dns.SOA); ok {
+			soa = s
+			continue
+		}
+		uws = append(uws, uw)
+	}
+	if soa == nil {
+		return fmt.Errorf("no SOA record to update for zone %s", e.Zone)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout())
+	defer cancel()
+
+	ez, err := e.read(ctx)
+	if err != nil {
+		return err
+	}
+	for _, r := range ez.zone {
+		if s, ok := r.RR.(*dns.SOA); ok && s.Serial != soa.Serial {
+			return fmt.Errorf("zone %s has changed since it was read", e.Zone)
+		}
+	}
+
+	var ops []clientv3.Op
+	for _, uw := range uws {
+		key, ok := ez.keys[uw.RR.String()]
+		if !ok {
+			key = e.recordKey(uw.RR)
+		}
+		ops = append(ops, clientv3.OpDelete(key))
+	}
+
+	for _, w := range wanted {
+		if w.RR.Header().Rrtype == dns.TypeSOA {
+			// The SOA is synthesised by CoreDNS
+			continue
+		}
+		svc, err := toService(w.RR)
+		if err != nil {
+			return err
+		}
+		bs, err := json.Marshal(svc)
+		if err != nil {
+			return err
+		}
+		ops = append(ops, clientv3.OpPut(e.recordKey(w.RR), string(bs)))
+	}
+
+	klog.V(1).Infof("etcd update of zone %s at revision %d: %v", e.Zone, ez.rev, ops)
+
+	zpath := e.path(e.Zone)
+	rev := ez.rev + 1
+	resp, err := e.client.Txn(ctx).
+		If(
+			clientv3.Compare(clientv3.ModRevision(zpath), "<", rev),
+			clientv3.Compare(clientv3.ModRevision(zpath+"/").WithPrefix(), "<", rev),
+		).
+		Then(ops...).
+		Commit()
+	if err != nil {
+		return fmt.Errorf("updating zone %s, %w", e.Zone, err)
+	}
+	if !resp.Succeeded {
+		return fmt.Errorf("zone %s has been modified since revision %d", e.Zone, ez.rev)
+	}
+
+	klog.V(1).Infof("Change succeeded at revision %d", resp.Header.Revision)
+
+	return nil
+}
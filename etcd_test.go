@@ -0,0 +1,279 @@
+package dubber
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+func freeURL(t *testing.T) url.URL {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen, %v", err)
+	}
+	defer l.Close()
+	return url.URL{Scheme: "http", Host: l.Addr().String()}
+}
+
+func startTestEtcd(t *testing.T) *clientv3.Client {
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+	curl, purl := freeURL(t), freeURL(t)
+	cfg.ListenClientUrls, cfg.AdvertiseClientUrls = []url.URL{curl}, []url.URL{curl}
+	cfg.ListenPeerUrls, cfg.AdvertisePeerUrls = []url.URL{purl}, []url.URL{purl}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatalf("could not start etcd, %v", err)
+	}
+	t.Cleanup(e.Close)
+
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		t.Fatalf("etcd did not start")
+	}
+
+	c, err := clientv3.New(clientv3.Config{Endpoints: []string{curl.String()}})
+	if err != nil {
+		t.Fatalf("could not create etcd client, %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestEtcdReconcile(t *testing.T) {
+	c := startTestEtcd(t)
+	ctx := context.Background()
+
+	// Records written by other tools
+	for k, v := range map[string]string{
+		"/skydns/com/example/other":          `{"host": "5.5.5.5", "ttl": 10}`,
+		"/skydns/com/example/thing/1a2b3c4d": `{"host": "6.6.6.6", "ttl": 10}`,
+		"/skydns/com/examples/www":           `{"host": "9.9.9.9"}`,
+	} {
+		if _, err := c.Put(ctx, k, v); err != nil {
+			t.Fatalf("unexpected error, %v", err)
+		}
+	}
+
+	cfg := &EtcdConfig{}
+	cfg.Zone = "example.com."
+	p := newEtcd(cfg, c)
+
+	desired, err := ParseZoneData(bytes.NewBufferString(`
+thing.example.com. 10 IN A 7.7.7.7
+new.example.com. 10 IN CNAME thing.example.com.
+_http._tcp.example.com. 10 IN SRV 10 20 8080 thing.example.com.
+example.com. 10 IN MX 10 mail.example.com.
+example.com. 10 IN TXT "v=spf1 -all"
+`))
+	if err != nil {
+		t.Fatalf("error parsing desired zone, %v", err)
+	}
+
+	var srv *Server
+	if err := srv.ReconcileZone(p, desired); err != nil {
+		t.Fatalf("error reconciling zone, %v", err)
+	}
+
+	got, err := p.RemoteZone()
+	if err != nil {
+		t.Fatalf("error reading remote zone, %v", err)
+	}
+
+	var soa *dns.SOA
+	var rest Zone
+	for _, r := range got {
+		if s, ok := r.RR.(*dns.SOA); ok {
+			soa = s
+			continue
+		}
+		rest = append(rest, r)
+	}
+
+	exp := `_http._tcp.example.com.	10	IN	SRV	10 20 8080 thing.example.com.
+example.com.	10	IN	MX	10 mail.example.com.
+example.com.	10	IN	TXT	"v=spf1 -all"
+new.example.com.	10	IN	CNAME	thing.example.com.
+other.example.com.	10	IN	A	5.5.5.5
+thing.example.com.	10	IN	A	7.7.7.7`
+	if rest.String() != exp {
+		t.Fatalf("\n  expected:\n%s\n  got:\n%s", exp, rest)
+	}
+
+	// Records are removed from the key they were read from
+	resp, err := c.Get(ctx, "/skydns/com/example/thing/1a2b3c4d")
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if len(resp.Kvs) != 0 {
+		t.Fatalf("expected old thing record to be removed, got %v", resp.Kvs)
+	}
+
+	// Nothing left to do
+	if err := srv.ReconcileZone(p, desired); err != nil {
+		t.Fatalf("error reconciling zone, %v", err)
+	}
+
+	// A change made after the zone was read must cause the update to fail
+	if _, err := c.Put(ctx, "/skydns/com/example/late", `{"host": "1.1.1.1"}`); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	newSOA := *soa
+	newSOA.Serial++
+	add, _ := dns.NewRR(`added.example.com. 10 IN A 2.2.2.2`)
+	err = p.UpdateZone(Zone{{RR: add}, {RR: &newSOA}}, Zone{{RR: soa}}, nil, nil)
+	if err == nil {
+		t.Fatalf("expected update with stale revision to fail")
+	}
+
+	resp, err = c.Get(ctx, "/skydns/com/example/added", clientv3.WithPrefix())
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if len(resp.Kvs) != 0 {
+		t.Fatalf("expected stale update not to be applied, got %v", resp.Kvs)
+	}
+
+	// As must a key being deleted, which does not change the revision of
+	// the remaining keys
+	got, err = p.RemoteZone()
+	if err != nil {
+		t.Fatalf("error reading remote zone, %v", err)
+	}
+	before := soa.Serial
+	for _, r := range got {
+		if s, ok := r.RR.(*dns.SOA); ok {
+			soa = s
+		}
+	}
+	if soa.Serial == before {
+		t.Fatalf("expected serial to change from %d", before)
+	}
+	if _, err := c.Delete(ctx, "/skydns/com/example/late"); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	newSOA = *soa
+	newSOA.Serial++
+	err = p.UpdateZone(Zone{{RR: add}, {RR: &newSOA}}, Zone{{RR: soa}}, nil, nil)
+	if err == nil {
+		t.Fatalf("expected update after a deletion to fail")
+	}
+
+	got, err = p.RemoteZone()
+	if err != nil {
+		t.Fatalf("error reading remote zone, %v", err)
+	}
+	before = soa.Serial
+	for _, r := range got {
+		if s, ok := r.RR.(*dns.SOA); ok {
+			soa = s
+		}
+	}
+	if soa.Serial == before {
+		t.Fatalf("expected serial to change after a deletion from %d", before)
+	}
+
+	// Writes outside of the zone leave the serial alone, and do not
+	// prevent the update
+	if _, err := c.Put(ctx, "/skydns/com/examples/www", `{"host": "9.9.9.10"}`); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	got, err = p.RemoteZone()
+	if err != nil {
+		t.Fatalf("error reading remote zone, %v", err)
+	}
+	for _, r := range got {
+		if s, ok := r.RR.(*dns.SOA); ok && s.Serial != soa.Serial {
+			t.Fatalf("expected serial %d to be unchanged, got %d", soa.Serial, s.Serial)
+		}
+	}
+	newSOA = *soa
+	newSOA.Serial++
+	if err := p.UpdateZone(Zone{{RR: add}, {RR: &newSOA}}, Zone{{RR: soa}}, nil, nil); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+}
+
+func TestEtcdLargeZone(t *testing.T) {
+	c := startTestEtcd(t)
+	ctx := context.Background()
+
+	// More keys than etcd's default --max-txn-ops of 128
+	for i := 0; i < 200; i++ {
+		k := fmt.Sprintf("/skydns/com/example/host%d", i)
+		if _, err := c.Put(ctx, k, `{"host": "10.0.0.1"}`); err != nil {
+			t.Fatalf("unexpected error, %v", err)
+		}
+	}
+
+	cfg := &EtcdConfig{}
+	cfg.Zone = "example.com."
+	p := newEtcd(cfg, c)
+
+	remz, err := p.RemoteZone()
+	if err != nil {
+		t.Fatalf("error reading remote zone, %v", err)
+	}
+	desired, err := ParseZoneData(bytes.NewBufferString(`www.example.com. 10 IN A 7.7.7.7`))
+	if err != nil {
+		t.Fatalf("error parsing desired zone, %v", err)
+	}
+	var nonSOA Zone
+	for _, r := range remz {
+		if r.Header().Rrtype != dns.TypeSOA {
+			nonSOA = append(nonSOA, r)
+		}
+	}
+	desired = append(desired, nonSOA...)
+
+	var srv *Server
+	if err := srv.ReconcileZone(p, desired); err != nil {
+		t.Fatalf("error reconciling zone, %v", err)
+	}
+
+	resp, err := c.Get(ctx, "/skydns/com/example/www/", clientv3.WithPrefix())
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if len(resp.Kvs) != 1 {
+		t.Fatalf("expected www to be added, got %v", resp.Kvs)
+	}
+}
+
+func TestEtcdEmptyZone(t *testing.T) {
+	c := startTestEtcd(t)
+
+	cfg := &EtcdConfig{Prefix: "/dns/"}
+	cfg.Zone = "example.org."
+	p := newEtcd(cfg, c)
+
+	desired, err := ParseZoneData(bytes.NewBufferString(`www.example.org. 10 IN AAAA 2001:db8::1`))
+	if err != nil {
+		t.Fatalf("error parsing desired zone, %v", err)
+	}
+
+	var srv *Server
+	if err := srv.ReconcileZone(p, desired); err != nil {
+		t.Fatalf("error reconciling zone, %v", err)
+	}
+
+	resp, err := c.Get(context.Background(), "/dns/org/example/www/", clientv3.WithPrefix())
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if len(resp.Kvs) != 1 || string(resp.Kvs[0].Value) != `{"host":"2001:db8::1","ttl":10}` {
+		t.Fatalf("expected a single AAAA service, got %v", resp.Kvs)
+	}
+}
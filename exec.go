@@ -0,0 +1,239 @@
+// Copyright 2017 Qubit Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dubber
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"reflect"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// ExecConfig describes configuration options for
+// the exec discoverer.
+type ExecConfig struct {
+	BaseDiscovererConfig `json:",omitempty" yaml:",omitempty,inline"`
+	// Command is the program, and arguments, to run.
+	Command []string `json:"command" yaml:"command"`
+	// Env is added to dubber's own environment for the command.
+	Env map[string]string `json:"env" yaml:"env"`
+	// Dir is the working directory for the command.
+	Dir string `json:"dir" yaml:"dir"`
+	// Timeout is the maximum time the command may run for, defaults to
+	// 30s. It is ignored in stream mode.
+	Timeout time.Duration `json:"timeout" yaml:"timeout"`
+	// Interval is how often to re-run the command, defaults to 1m. It is
+	// ignored in stream mode.
+	Interval time.Duration `json:"interval" yaml:"interval"`
+	// Stream runs the command once, and reads a new state from each
+	// line of JSON it writes to stdout.
+	Stream bool `json:"stream" yaml:"stream"`
+	XXX    `json:",omitempty" yaml:",omitempty,inline"`
+}
+
+// ExecState holds the state information we will pass to the configuration
+// template.
+type ExecState struct {
+	// Data is the decoded JSON output of the command.
+	Data interface{}
+}
+
+// Exec implements discovery by running an external command that
+// writes JSON to stdout.
+type Exec struct {
+	cfg ExecConfig
+
+	sync.Mutex
+	started bool
+	failed  bool
+	data    interface{}
+	states  chan interface{}
+	exited  chan error
+}
+
+// NewExec creates a new exec discoverer
+func NewExec(cfg ExecConfig) (*Exec, error) {
+	if len(cfg.Command) == 0 {
+		return nil, fmt.Errorf("command must be set")
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 30 * time.Second
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = time.Minute
+	}
+	return &Exec{cfg: cfg}, nil
+}
+
+func (e *Exec) blocksUntilChange() {}
+
+// StatePull runs the command. The first call, and the first call after a
+// failure, return the current state, subsequent calls re-run the command
+// every interval until its output changes. In stream mode each call returns the next state written by the
+// command, which is restarted if it exits.
+func (e *Exec) StatePull(ctx context.Context) (State, error) {
+	e.Lock()
+	defer e.Unlock()
+
+	if e.cfg.Stream {
+		return e.streamPull(ctx)
+	}
+
+	ticker := time.NewTicker(e.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		data, err := e.run(ctx)
+		if err != nil {
+			e.failed = true
+			return nil, err
+		}
+
+		if !e.started || e.failed || !reflect.DeepEqual(e.data, data) {
+			e.started = true
+			e.failed = false
+			e.data = data
+			return &ExecState{Data: data}, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *Exec) command(ctx context.Context) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, e.cfg.Command[0], e.cfg.Command[1:]...)
+	cmd.Dir = e.cfg.Dir
+	cmd.Env = os.Environ()
+	for k, v := range e.cfg.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	return cmd
+}
+
+func (e *Exec) run(ctx context.Context) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, e.cfg.Timeout)
+	defer cancel()
+
+	cmd := e.command(ctx)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+
+	klog.V(1).Infof("running %v", e.cfg.Command)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("command %v failed, %w, %s", e.cfg.Command, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	var data interface{}
+	if err := json.Unmarshal(out, &data); err != nil {
+		return nil, fmt.Errorf("failed to decode output of %v, %w", e.cfg.Command, err)
+	}
+	return data, nil
+}
+
+func (e *Exec) streamPull(ctx context.Context) (State, error) {
+	if e.states == nil {
+		if err := e.stream(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case data := <-e.states:
+		return &ExecState{Data: data}, nil
+	case err := <-e.exited:
+		// Don't lose a final state written just before exiting
+		select {
+		case data := <-e.states:
+			e.exited <- err
+			return &ExecState{Data: data}, nil
+		default:
+		}
+		// Start the command again on the next pull
+		e.states, e.exited = nil, nil
+		return nil, err
+	}
+}
+
+// stream starts the command, and reads states from its output. Only the
+// most recent state is kept, a slow consumer will skip intermediate states.
+func (e *Exec) stream(ctx context.Context) error {
+	cmd := e.command(ctx)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	klog.Infof("starting %v", e.cfg.Command)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %v, %w", e.cfg.Command, err)
+	}
+
+	states := make(chan interface{}, 1)
+	exited := make(chan error, 1)
+	e.states, e.exited = states, exited
+
+	go func() {
+		sc := bufio.NewScanner(stdout)
+		sc.Buffer(nil, 16*1024*1024)
+		for sc.Scan() {
+			line := bytes.TrimSpace(sc.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			var data interface{}
+			if err := json.Unmarshal(line, &data); err != nil {
+				klog.Errorf("failed to decode output of %v, %v", e.cfg.Command, err)
+				continue
+			}
+			// Replace any state that has not been read yet
+			select {
+			case <-states:
+			default:
+			}
+			states <- data
+		}
+
+		err := sc.Err()
+		if err != nil {
+			// Nothing reads stdout any more, so the command could
+			// block writing to it forever.
+			cmd.Process.Kill()
+		}
+		if werr := cmd.Wait(); err == nil {
+			err = werr
+		}
+		if err == nil {
+			err = fmt.Errorf("exited")
+		}
+		exited <- fmt.Errorf("command %v stopped, %w", e.cfg.Command, err)
+	}()
+
+	return nil
+}
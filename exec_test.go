@@ -0,0 +1,135 @@
+package dubber
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecStatePull(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "hosts.json"), []byte(`{"hosts": ["www"]}`), 0644); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	e, err := NewExec(ExecConfig{
+		Command:  []string{"sh", "-c", `test "$TEAM" = dns && cat hosts.json`},
+		Env:      map[string]string{"TEAM": "dns"},
+		Dir:      dir,
+		Interval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	st, err := e.StatePull(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	hosts := st.(*ExecState).Data.(map[string]interface{})["hosts"].([]interface{})
+	if len(hosts) != 1 {
+		t.Fatalf("expected 1 host, got %v", hosts)
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		os.WriteFile(filepath.Join(dir, "hosts.json"), []byte(`{"hosts": ["www", "api"]}`), 0644)
+	}()
+
+	st, err = e.StatePull(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	hosts = st.(*ExecState).Data.(map[string]interface{})["hosts"].([]interface{})
+	if len(hosts) != 2 {
+		t.Fatalf("expected 2 hosts, got %v", hosts)
+	}
+	// Recovering with unchanged output is still reported as a success
+	os.Rename(filepath.Join(dir, "hosts.json"), filepath.Join(dir, "hosts.json.bak"))
+	if _, err := e.StatePull(ctx); err == nil {
+		t.Fatalf("expected an error with hosts.json missing")
+	}
+	os.Rename(filepath.Join(dir, "hosts.json.bak"), filepath.Join(dir, "hosts.json"))
+	rctx, rcancel := context.WithTimeout(ctx, time.Second)
+	defer rcancel()
+	if _, err := e.StatePull(rctx); err != nil {
+		t.Fatalf("expected the state after recovering, got %v", err)
+	}
+}
+
+func TestExecStatePullTimeout(t *testing.T) {
+	e, err := NewExec(ExecConfig{
+		Command: []string{"sleep", "10"},
+		Timeout: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	if _, err := e.StatePull(context.Background()); err == nil {
+		t.Fatalf("expected timeout error")
+	}
+}
+
+func TestExecStatePullStream(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	e, err := NewExec(ExecConfig{
+		Command: []string{"sh", "-c", `echo '{"n": 1}'; sleep 0.2; echo '{"n": 2}'`},
+		Stream:  true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	for _, exp := range []float64{1, 2} {
+		st, err := e.StatePull(ctx)
+		if err != nil {
+			t.Fatalf("unexpected error, %v", err)
+		}
+		if n := st.(*ExecState).Data.(map[string]interface{})["n"]; n != exp {
+			t.Fatalf("expected %v, got %v", exp, n)
+		}
+	}
+
+	_, err = e.StatePull(ctx)
+	if err == nil || !strings.Contains(err.Error(), "stopped") {
+		t.Fatalf("expected command stopped error, got %v", err)
+	}
+
+	// The command is restarted on the next pull
+	st, err := e.StatePull(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if n := st.(*ExecState).Data.(map[string]interface{})["n"]; n != float64(1) {
+		t.Fatalf("expected 1, got %v", n)
+	}
+}
+
+func TestExecStatePullStream_LongLine(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The line is too long to scan, the command must be stopped rather
+	// than left blocked writing the rest of its output.
+	e, err := NewExec(ExecConfig{
+		Command: []string{"sh", "-c", `head -c 20000000 /dev/zero | tr '\0' a; echo; echo '{"n": 1}'; sleep 60`},
+		Stream:  true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	_, err = e.StatePull(ctx)
+	if err == nil || !strings.Contains(err.Error(), "too long") {
+		t.Fatalf("expected token too long error, got %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2017 Qubit Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dubber
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/Masterminds/sprig/v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// dnsEndpointResource is the external-dns DNSEndpoint custom resource.
+var dnsEndpointResource = schema.GroupVersionResource{
+	Group:    "externaldns.k8s.io",
+	Version:  "v1alpha1",
+	Resource: "dnsendpoints",
+}
+
+// DNSEndpoint mirrors the external-dns DNSEndpoint custom resource,
+// see https://github.com/kubernetes-sigs/external-dns
+type DNSEndpoint struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   DNSEndpointSpec   `json:"spec,omitempty"`
+	Status DNSEndpointStatus `json:"status,omitempty"`
+}
+
+// DNSEndpointSpec is the set of records requested by a DNSEndpoint.
+type DNSEndpointSpec struct {
+	Endpoints []ExternalDNSEndpoint `json:"endpoints,omitempty"`
+}
+
+// DNSEndpointStatus is the status of a DNSEndpoint.
+type DNSEndpointStatus struct {
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+}
+
+// ExternalDNSEndpoint is a single record set in a DNSEndpoint.
+type ExternalDNSEndpoint struct {
+	DNSName          string                                `json:"dnsName,omitempty"`
+	Targets          []string                              `json:"targets,omitempty"`
+	RecordType       string                                `json:"recordType,omitempty"`
+	SetIdentifier    string                                `json:"setIdentifier,omitempty"`
+	RecordTTL        int64                                 `json:"recordTTL,omitempty"`
+	Labels           map[string]string                     `json:"labels,omitempty"`
+	ProviderSpecific []ExternalDNSProviderSpecificProperty `json:"providerSpecific,omitempty"`
+}
+
+// ExternalDNSProviderSpecificProperty is a provider specific option on an
+// ExternalDNSEndpoint.
+type ExternalDNSProviderSpecificProperty struct {
+	Name  string `json:"name,omitempty"`
+	Value string `json:"value,omitempty"`
+}
+
+// externalDNSProviderFlags maps external-dns provider specific property
+// names to dubber record flags.
+var externalDNSProviderFlags = map[string]string{
+	"aws/weight":                 "route53.Weight",
+	"aws/region":                 "route53.Region",
+	"aws/evaluate-target-health": "route53.EvalTargetHealth",
+	"external-dns.alpha.kubernetes.io/cloudflare-proxied": "cloudflare.Proxied",
+}
+
+// Flags translates the set identifier and provider specific properties of
+// the endpoint into record flags. Properties with no equivalent flag are
+// ignored.
+func (ep ExternalDNSEndpoint) Flags() RecordFlags {
+	flags := RecordFlags{}
+	if ep.SetIdentifier != "" {
+		flags["route53.SetID"] = ep.SetIdentifier
+	}
+	for _, p := range ep.ProviderSpecific {
+		f, ok := externalDNSProviderFlags[p.Name]
+		if !ok {
+			continue
+		}
+		// Flags are whitespace separated, so cannot contain whitespace
+		if strings.ContainsAny(p.Value, " \t\n") {
+			continue
+		}
+		flags[f] = p.Value
+	}
+	return flags
+}
+
+func dnsEndpointFromUnstructured(u *unstructured.Unstructured) (DNSEndpoint, error) {
+	dep := DNSEndpoint{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, &dep); err != nil {
+		return dep, fmt.Errorf("could not convert DNSEndpoint %s/%s, %w", u.GetNamespace(), u.GetName(), err)
+	}
+	return dep, nil
+}
+
+// DNSEndpointTemplate renders the DNSEndpoints in a KubernetesState as zone
+// data. It is used when a kubernetes discoverer has DNSEndpoints enabled, but
+// no template, and is available to other templates as "dnsendpoints".
+const DNSEndpointTemplate = `
+{{- range $dep := .DNSEndpoints }}
+{{-   range $ep := $dep.Spec.Endpoints }}
+{{-     range $t := $ep.Targets }}
+{{ $ep.DNSName }} {{ or $ep.RecordTTL 300 }} IN {{ $ep.RecordType }} {{ if eq $ep.RecordType "TXT" }}{{ quote $t }}{{ else }}{{ $t }}{{ end }} ; {{ $ep.Flags }}
+{{-     end }}
+{{-   end }}
+{{- end }}
+`
+
+// withDNSEndpointTemplate adds the "dnsendpoints" template to t, if t is
+// empty it is set to render the DNSEndpoints.
+func withDNSEndpointTemplate(t JSONTemplate) (JSONTemplate, error) {
+	if t.Template == nil {
+		tmpl, err := template.New("base").Funcs(sprig.TxtFuncMap()).Parse(`{{ template "dnsendpoints" . }}`)
+		if err != nil {
+			return t, err
+		}
+		t = JSONTemplate{tmpl}
+	}
+
+	if _, err := t.New("dnsendpoints").Funcs(sprig.TxtFuncMap()).Parse(DNSEndpointTemplate); err != nil {
+		return t, fmt.Errorf("could not parse DNSEndpoint template, %w", err)
+	}
+	return t, nil
+}
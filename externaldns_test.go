@@ -0,0 +1,94 @@
+package dubber
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestDNSEndpointDiscover(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dep := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "externaldns.k8s.io/v1alpha1",
+		"kind":       "DNSEndpoint",
+		"metadata": map[string]interface{}{
+			"namespace": "default",
+			"name":      "examples",
+		},
+		"spec": map[string]interface{}{
+			"endpoints": []interface{}{
+				map[string]interface{}{
+					"dnsName":       "www.example.com",
+					"recordType":    "A",
+					"recordTTL":     int64(60),
+					"targets":       []interface{}{"1.2.3.4", "5.6.7.8"},
+					"setIdentifier": "cluster1",
+					"providerSpecific": []interface{}{
+						map[string]interface{}{"name": "aws/weight", "value": "10"},
+						map[string]interface{}{"name": "unknown", "value": "ignored"},
+					},
+				},
+				map[string]interface{}{
+					"dnsName":    "txt.example.com",
+					"recordType": "TXT",
+					"targets":    []interface{}{"v=spf1 -all"},
+				},
+				map[string]interface{}{
+					"dnsName":    "alias.example.com",
+					"recordType": "CNAME",
+					"targets":    []interface{}{"www.example.com"},
+					"providerSpecific": []interface{}{
+						map[string]interface{}{"name": "external-dns.alpha.kubernetes.io/cloudflare-proxied", "value": "true"},
+					},
+				},
+			},
+		},
+	}}
+
+	dynClient := dynfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{dnsEndpointResource: "DNSEndpointList"},
+		dep,
+	)
+
+	cfg := KubernetesConfig{}
+	cfg.DNSEndpoints.Enabled = true
+	client := fake.NewSimpleClientset()
+	client.Resources = []*metav1.APIResourceList{{
+		GroupVersion: dnsEndpointResource.GroupVersion().String(),
+		APIResources: []metav1.APIResource{{Name: dnsEndpointResource.Resource}},
+	}}
+	k, err := newKubernetes(cfg, client, dynClient)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	tmpl, err := withDNSEndpointTemplate(JSONTemplate{})
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	d := Discoverer{StatePuller: k, JSONTemplate: tmpl}
+	z, err := d.Discover(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	sort.Sort(ByRR(z))
+
+	exp := `alias.example.com.	300	IN	CNAME	www.example.com. ; cloudflare.Proxied=true
+txt.example.com.	300	IN	TXT	"v=spf1 -all"
+www.example.com.	60	IN	A	1.2.3.4 ; route53.SetID=cluster1 route53.Weight=10
+www.example.com.	60	IN	A	5.6.7.8 ; route53.SetID=cluster1 route53.Weight=10`
+	if z.String() != exp {
+		t.Fatalf("\n  expected:\n%s\n  got:\n%s", exp, z)
+	}
+}
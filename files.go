@@ -0,0 +1,233 @@
+// Copyright 2017 Qubit Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dubber
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/Masterminds/sprig/v3"
+	"github.com/fsnotify/fsnotify"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+// FilesConfig describes configuration options for
+// the files discoverer.
+type FilesConfig struct {
+	BaseDiscovererConfig `json:",omitempty" yaml:",omitempty,inline"`
+	// Path is a file, or a directory of files, to read. Files in
+	// sub-directories, and hidden files, are ignored.
+	Path string `json:"path" yaml:"path"`
+	XXX  `json:",omitempty" yaml:",omitempty,inline"`
+}
+
+// FilesState holds the state information we will pass to the configuration
+// template.
+type FilesState struct {
+	// Data is the parsed content of .yaml, .yml and .json files, by
+	// file name.
+	Data map[string]interface{}
+	// Zones is the raw content of .zone files, by file name.
+	Zones map[string]string
+}
+
+// FilesTemplate renders the zone files in a FilesState. It is used when
+// a files discoverer has no template.
+const FilesTemplate = `
+{{- range .Zones }}
+{{ . }}
+{{- end }}
+`
+
+// Files implements discovery of records from local data files, or
+// zone file fragments.
+type Files struct {
+	path string
+
+	sync.Mutex
+	watcher *fsnotify.Watcher
+	changes chan struct{}
+}
+
+// NewFiles creates a new files discoverer
+func NewFiles(cfg FilesConfig) (*Files, error) {
+	if cfg.Path == "" {
+		return nil, fmt.Errorf("path must be set")
+	}
+	return &Files{path: cfg.Path}, nil
+}
+
+// filesDefaultTemplate returns t, or FilesTemplate if t is empty.
+func filesDefaultTemplate(t JSONTemplate) JSONTemplate {
+	if t.Template != nil {
+		return t
+	}
+	return JSONTemplate{template.Must(template.New("base").Funcs(sprig.TxtFuncMap()).Parse(FilesTemplate))}
+}
+
+func (f *Files) blocksUntilChange() {}
+
+// StatePull reads the configured files. The first call returns the
+// current state, subsequent calls block until the files change.
+func (f *Files) StatePull(ctx context.Context) (State, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.watcher == nil {
+		if err := f.watch(ctx); err != nil {
+			return nil, err
+		}
+		return f.state()
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-f.changes:
+	}
+
+	// Editors, and kubernetes ConfigMap updates, often result
+	// in several events for a single change.
+	timer := time.NewTimer(100 * time.Millisecond)
+	defer timer.Stop()
+	for quiet := false; !quiet; {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-f.changes:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(100 * time.Millisecond)
+		case <-timer.C:
+			quiet = true
+		}
+	}
+
+	return f.state()
+}
+
+// watch starts watching the directory holding our files. For a single file
+// we watch the parent directory, so that the file being replaced, rather
+// than written to, is seen.
+func (f *Files) watch(ctx context.Context) error {
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	dir := f.path
+	if !fi.IsDir() {
+		dir = filepath.Dir(f.path)
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create file watcher, %w", err)
+	}
+	if err := w.Add(dir); err != nil {
+		w.Close()
+		return fmt.Errorf("failed to watch %s, %w", dir, err)
+	}
+
+	f.watcher = w
+	f.changes = make(chan struct{}, 1)
+
+	go func() {
+		defer w.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				klog.V(2).Infof("file change %s", ev)
+				select {
+				case f.changes <- struct{}{}:
+				default:
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				klog.Errorf("error watching %s, %v", dir, err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (f *Files) state() (State, error) {
+	klog.Infof("Reading state from %s", f.path)
+
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []string{f.path}
+	if fi.IsDir() {
+		ents, err := os.ReadDir(f.path)
+		if err != nil {
+			return nil, err
+		}
+		paths = nil
+		for _, ent := range ents {
+			if ent.IsDir() || strings.HasPrefix(ent.Name(), ".") {
+				continue
+			}
+			paths = append(paths, filepath.Join(f.path, ent.Name()))
+		}
+	}
+
+	st := &FilesState{
+		Data:  map[string]interface{}{},
+		Zones: map[string]string{},
+	}
+	for _, p := range paths {
+		name := filepath.Base(p)
+		switch filepath.Ext(name) {
+		case ".yaml", ".yml", ".json":
+			bs, err := os.ReadFile(p)
+			if err != nil {
+				return nil, err
+			}
+			var data interface{}
+			if err := yaml.Unmarshal(bs, &data); err != nil {
+				return nil, fmt.Errorf("failed to parse %s, %w", p, err)
+			}
+			st.Data[name] = data
+		case ".zone":
+			bs, err := os.ReadFile(p)
+			if err != nil {
+				return nil, err
+			}
+			st.Zones[name] = string(bs)
+		default:
+			klog.V(1).Infof("ignoring file %s", p)
+		}
+	}
+
+	return st, nil
+}
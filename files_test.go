@@ -0,0 +1,62 @@
+package dubber
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"text/template"
+	"time"
+)
+
+func TestFilesDiscover(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dir := t.TempDir()
+	write := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("failed writing %s, %v", name, err)
+		}
+	}
+	write("cnames.yaml", `
+vanity:
+  - name: go.example.com
+    target: www.example.com
+`)
+	write("static.zone", `example.com. 300 IN MX 10 mail.example.com.`)
+	write(".hidden.zone", `hidden.example.com. 300 IN A 1.1.1.1`)
+
+	fs, err := NewFiles(FilesConfig{Path: dir})
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	tmpl := template.Must(template.New("base").Parse(`
+{{- template "zones" . }}
+{{- range (index .Data "cnames.yaml").vanity }}
+{{ .name }}. 300 IN CNAME {{ .target }}.
+{{- end }}`))
+	template.Must(tmpl.New("zones").Parse(FilesTemplate))
+	d := Discoverer{StatePuller: fs, JSONTemplate: JSONTemplate{tmpl}}
+
+	check := func(exp string) {
+		z, err := d.Discover(ctx)
+		if err != nil {
+			t.Fatalf("unexpected error, %v", err)
+		}
+		sort.Sort(ByRR(z))
+		if z.String() != exp {
+			t.Fatalf("\n  expected:\n%s\n  got:\n%s", exp, z)
+		}
+	}
+
+	check(`example.com.	300	IN	MX	10 mail.example.com.
+go.example.com.	300	IN	CNAME	www.example.com.`)
+
+	write("static.zone", `example.com. 300 IN MX 20 mail2.example.com.`)
+
+	check(`example.com.	300	IN	MX	20 mail2.example.com.
+go.example.com.	300	IN	CNAME	www.example.com.`)
+}
@@ -34,13 +34,13 @@ type GCloudDNSConfig struct {
 
 // GCloudDNS is an Google Cloud DNS provider.
 type GCloudDNS struct {
-	GCloudDNSConfig
+	*GCloudDNSConfig
 
 	svc *gdns.Service
 }
 
 // NewGCloudDNS creates a gcloud dns provisioner.
-func NewGCloudDNS(cfg GCloudDNSConfig) *GCloudDNS {
+func NewGCloudDNS(cfg *GCloudDNSConfig) *GCloudDNS {
 	ctx := context.Background()
 
 	svc, err := gdns.NewService(ctx)
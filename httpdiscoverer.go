@@ -0,0 +1,277 @@
+// Copyright 2017 Qubit Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dubber
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+// HTTPConfig describes configuration options for
+// the HTTP discoverer.
+type HTTPConfig struct {
+	BaseDiscovererConfig `json:",omitempty" yaml:",omitempty,inline"`
+	Endpoints            []HTTPEndpointConfig `json:"endpoints" yaml:"endpoints"`
+	// Interval is how often to poll the endpoints for changes.
+	// Defaults to 30s.
+	Interval time.Duration `json:"interval" yaml:"interval"`
+	XXX      `json:",omitempty" yaml:",omitempty,inline"`
+}
+
+// HTTPEndpointConfig describes a single URL to read data from.
+type HTTPEndpointConfig struct {
+	// Name is the key for the data in the template state, defaults
+	// to the URL.
+	Name        string            `json:"name" yaml:"name"`
+	URL         string            `json:"url" yaml:"url"`
+	Headers     map[string]string `json:"headers" yaml:"headers"`
+	BearerToken string            `json:"bearerToken" yaml:"bearerToken"`
+	BasicAuth   struct {
+		Username string `json:"username" yaml:"username"`
+		Password string `json:"password" yaml:"password"`
+	} `json:"basic_auth" yaml:"basic_auth"`
+	TLS TLSClientConfig `json:"tls" yaml:"tls"`
+}
+
+// TLSClientConfig describes the TLS settings used to connect to
+// a server.
+type TLSClientConfig struct {
+	CAFile             string `json:"caFile" yaml:"caFile"`
+	CertFile           string `json:"certFile" yaml:"certFile"`
+	KeyFile            string `json:"keyFile" yaml:"keyFile"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify" yaml:"insecureSkipVerify"`
+}
+
+// enabled returns true if any TLS settings have been given.
+func (c TLSClientConfig) enabled() bool {
+	return c != TLSClientConfig{}
+}
+
+func (c TLSClientConfig) build() (*tls.Config, error) {
+	tlsCfg := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+	if c.CAFile != "" {
+		bs, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA file, %w", err)
+		}
+		tlsCfg.RootCAs = x509.NewCertPool()
+		if !tlsCfg.RootCAs.AppendCertsFromPEM(bs) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", c.CAFile)
+		}
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate, %w", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	return tlsCfg, nil
+}
+
+// HTTPState holds the state information we will pass to the configuration
+// template.
+type HTTPState struct {
+	// Data is the decoded JSON, or YAML, body from each endpoint, by
+	// endpoint name.
+	Data map[string]interface{}
+}
+
+// HTTP implements discovery by polling HTTP endpoints for JSON or
+// YAML data.
+type HTTP struct {
+	interval  time.Duration
+	endpoints []*httpEndpoint
+
+	sync.Mutex
+	started bool
+	// failed is set if the last call failed, the next successful fetch
+	// is then returned even if nothing has changed.
+	failed bool
+}
+
+type httpEndpoint struct {
+	HTTPEndpointConfig
+	client *http.Client
+
+	etag         string
+	lastModified string
+	data         interface{}
+}
+
+// NewHTTP creates a new HTTP discoverer
+func NewHTTP(cfg HTTPConfig) (*HTTP, error) {
+	h := &HTTP{interval: cfg.Interval}
+	if h.interval == 0 {
+		h.interval = 30 * time.Second
+	}
+
+	for _, ecfg := range cfg.Endpoints {
+		if ecfg.URL == "" {
+			return nil, fmt.Errorf("endpoint url must be set")
+		}
+		if ecfg.Name == "" {
+			ecfg.Name = ecfg.URL
+		}
+
+		tlsCfg, err := ecfg.TLS.build()
+		if err != nil {
+			return nil, fmt.Errorf("invalid tls config for %s, %w", ecfg.Name, err)
+		}
+
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsCfg
+
+		h.endpoints = append(h.endpoints, &httpEndpoint{
+			HTTPEndpointConfig: ecfg,
+			client:             &http.Client{Transport: transport, Timeout: time.Minute},
+		})
+	}
+
+	return h, nil
+}
+
+func (h *HTTP) blocksUntilChange() {}
+
+// StatePull fetches the data from each endpoint. The first call, and the
+// first call after a failure, return the current state, subsequent calls
+// poll the endpoints until one of them changes.
+func (h *HTTP) StatePull(ctx context.Context) (State, error) {
+	h.Lock()
+	defer h.Unlock()
+
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		// Results are only saved once every endpoint has been fetched, so
+		// that a failure does not leave an endpoint's ETag updated for
+		// data that was never returned.
+		results := make([]*httpResult, len(h.endpoints))
+		for i, ep := range h.endpoints {
+			res, err := ep.fetch(ctx)
+			if err != nil {
+				h.failed = true
+				return nil, err
+			}
+			results[i] = res
+		}
+
+		changed := false
+		for i, ep := range h.endpoints {
+			res := results[i]
+			if res == nil {
+				continue
+			}
+			// Not all servers support conditional requests
+			changed = changed || !reflect.DeepEqual(ep.data, res.data)
+			ep.data = res.data
+			ep.etag = res.etag
+			ep.lastModified = res.lastModified
+		}
+
+		if changed || !h.started || h.failed {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	h.started = true
+	h.failed = false
+
+	st := &HTTPState{Data: map[string]interface{}{}}
+	for _, ep := range h.endpoints {
+		st.Data[ep.Name] = ep.data
+	}
+	return st, nil
+}
+
+// httpResult is the data fetched from an endpoint, along with the
+// validators to use for the next conditional request.
+type httpResult struct {
+	data         interface{}
+	etag         string
+	lastModified string
+}
+
+// fetch reads the endpoint's data, it returns nil if the endpoint reports
+// that the data has not been modified since the last saved fetch.
+func (ep *httpEndpoint) fetch(ctx context.Context) (*httpResult, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ep.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json, application/yaml")
+	for k, v := range ep.Headers {
+		req.Header.Set(k, v)
+	}
+	if ep.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+ep.BearerToken)
+	}
+	if ep.BasicAuth.Username != "" {
+		req.SetBasicAuth(ep.BasicAuth.Username, ep.BasicAuth.Password)
+	}
+	if ep.etag != "" {
+		req.Header.Set("If-None-Match", ep.etag)
+	}
+	if ep.lastModified != "" {
+		req.Header.Set("If-Modified-Since", ep.lastModified)
+	}
+
+	resp, err := ep.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s, %w", ep.Name, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		klog.V(2).Infof("%s not modified", ep.Name)
+		return nil, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("failed to fetch %s, %s", ep.Name, resp.Status)
+	}
+
+	bs, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s, %w", ep.Name, err)
+	}
+
+	// YAML is a superset of JSON, so this handles both
+	var data interface{}
+	if err := yaml.Unmarshal(bs, &data); err != nil {
+		return nil, fmt.Errorf("failed to decode %s, %w", ep.Name, err)
+	}
+
+	return &httpResult{
+		data:         data,
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}, nil
+}
@@ -0,0 +1,165 @@
+package dubber
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHTTPStatePull(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var mu sync.Mutex
+	version := 1
+	body := `{"hosts": [{"name": "www", "ip": "10.0.0.1"}]}`
+	notModified := 0
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" || r.Header.Get("X-Team") != "dns" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		etag := strconv.Quote(strconv.Itoa(version))
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(body))
+	}))
+	defer ts.Close()
+
+	cfg := HTTPConfig{Interval: 10 * time.Millisecond}
+	ep := HTTPEndpointConfig{Name: "inventory", URL: ts.URL}
+	ep.BearerToken = "secret"
+	ep.Headers = map[string]string{"X-Team": "dns"}
+	cfg.Endpoints = append(cfg.Endpoints, ep)
+
+	h, err := NewHTTP(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	st, err := h.StatePull(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	data := st.(*HTTPState).Data["inventory"].(map[string]interface{})
+	if len(data["hosts"].([]interface{})) != 1 {
+		t.Fatalf("expected 1 host, got %v", data)
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		version++
+		body = `hosts: [{name: www, ip: 10.0.0.1}, {name: api, ip: 10.0.0.2}]`
+	}()
+
+	st, err = h.StatePull(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	data = st.(*HTTPState).Data["inventory"].(map[string]interface{})
+	if len(data["hosts"].([]interface{})) != 2 {
+		t.Fatalf("expected 2 hosts, got %v", data)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if notModified == 0 {
+		t.Fatalf("expected conditional requests while unchanged")
+	}
+}
+
+func TestHTTPStatePull_PartialFailure(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var mu sync.Mutex
+	version := 1
+	failing := false
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path == "/b" {
+			if failing {
+				http.Error(w, "broken", http.StatusInternalServerError)
+				return
+			}
+			w.Write([]byte(`{"static": true}`))
+			return
+		}
+		etag := strconv.Quote(strconv.Itoa(version))
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(`{"version": ` + strconv.Itoa(version) + `}`))
+	}))
+	defer ts.Close()
+
+	h, err := NewHTTP(HTTPConfig{
+		Interval: 10 * time.Millisecond,
+		Endpoints: []HTTPEndpointConfig{
+			{Name: "a", URL: ts.URL + "/a"},
+			{Name: "b", URL: ts.URL + "/b"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	if _, err := h.StatePull(ctx); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	mu.Lock()
+	version++
+	failing = true
+	mu.Unlock()
+	if _, err := h.StatePull(ctx); err == nil {
+		t.Fatalf("expected an error while b is failing")
+	}
+
+	// The change to a must not have been lost
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+	st, err := h.StatePull(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	data := st.(*HTTPState).Data["a"].(map[string]interface{})
+	if data["version"] != float64(2) {
+		t.Fatalf("expected version 2, got %v", data)
+	}
+
+	// Recovering with unchanged data is still reported as a success
+	mu.Lock()
+	failing = true
+	mu.Unlock()
+	if _, err := h.StatePull(ctx); err == nil {
+		t.Fatalf("expected an error while b is failing")
+	}
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+	rctx, rcancel := context.WithTimeout(ctx, time.Second)
+	defer rcancel()
+	if _, err := h.StatePull(rctx); err != nil {
+		t.Fatalf("expected the state after recovering, got %v", err)
+	}
+}
@@ -18,12 +18,26 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"time"
 
 	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	netv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	discoverylistersv1 "k8s.io/client-go/listers/discovery/v1"
+	netlistersv1 "k8s.io/client-go/listers/networking/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/klog/v2"
 )
@@ -34,25 +48,123 @@ type KubernetesConfig struct {
 	BaseDiscovererConfig `json:",omitempty" yaml:",omitempty,inline"`
 	FileName             string `json:"kubeconfig" yaml:"kubeconfig"`
 	Context              string `json:"context" yaml:"context"`
-	XXX                  `json:",omitempty" yaml:",omitempty,inline"`
+	// Debounce is how long to wait for further changes after a change
+	// is seen, before a new state is returned. Defaults to 1s.
+	Debounce time.Duration `json:"debounce" yaml:"debounce"`
+
+	Nodes     KubernetesResourceConfig `json:"nodes" yaml:"nodes"`
+	Ingresses KubernetesResourceConfig `json:"ingresses" yaml:"ingresses"`
+	Services  KubernetesResourceConfig `json:"services" yaml:"services"`
+	Endpoints KubernetesResourceConfig `json:"endpoints" yaml:"endpoints"`
+
+	Pods           KubernetesOptionalResourceConfig `json:"pods" yaml:"pods"`
+	EndpointSlices KubernetesOptionalResourceConfig `json:"endpointSlices" yaml:"endpointSlices"`
+	Gateways       KubernetesOptionalResourceConfig `json:"gateways" yaml:"gateways"`
+	HTTPRoutes     KubernetesOptionalResourceConfig `json:"httpRoutes" yaml:"httpRoutes"`
+	// DNSEndpoints are external-dns DNSEndpoint resources, if no template
+	// is set, DNSEndpointTemplate is used.
+	DNSEndpoints KubernetesOptionalResourceConfig `json:"dnsEndpoints" yaml:"dnsEndpoints"`
+	// GatewayAPIVersion is the version of the gateway.networking.k8s.io
+	// API to watch Gateways and HTTPRoutes with. Defaults to v1beta1.
+	GatewayAPIVersion string `json:"gatewayAPIVersion" yaml:"gatewayAPIVersion"`
+
+	XXX `json:",omitempty" yaml:",omitempty,inline"`
+}
+
+// KubernetesOptionalResourceConfig configures a resource that is only
+// watched if enabled.
+type KubernetesOptionalResourceConfig struct {
+	Enabled                  bool `json:"enabled" yaml:"enabled"`
+	KubernetesResourceConfig `json:",omitempty" yaml:",omitempty,inline"`
+}
+
+// KubernetesResourceConfig limits the set of objects of a given resource
+// that are watched, and passed to the template.
+type KubernetesResourceConfig struct {
+	// Namespaces to watch, all namespaces are watched if this is empty.
+	// This allows RBAC to be limited to namespaced Roles.
+	Namespaces []string `json:"namespaces" yaml:"namespaces"`
+	// ExcludeNamespaces are namespaces whose objects are ignored.
+	ExcludeNamespaces []string `json:"excludeNamespaces" yaml:"excludeNamespaces"`
+	LabelSelector     string   `json:"labelSelector" yaml:"labelSelector"`
+	FieldSelector     string   `json:"fieldSelector" yaml:"fieldSelector"`
+}
+
+func (rc KubernetesResourceConfig) validate() error {
+	if _, err := labels.Parse(rc.LabelSelector); err != nil {
+		return fmt.Errorf("invalid label selector %q, %w", rc.LabelSelector, err)
+	}
+	if _, err := fields.ParseSelector(rc.FieldSelector); err != nil {
+		return fmt.Errorf("invalid field selector %q, %w", rc.FieldSelector, err)
+	}
+	return nil
+}
+
+func (rc KubernetesResourceConfig) tweakListOptions(opts *metav1.ListOptions) {
+	opts.LabelSelector = rc.LabelSelector
+	opts.FieldSelector = rc.FieldSelector
+}
+
+func (rc KubernetesResourceConfig) excluded(ns string) bool {
+	for _, ens := range rc.ExcludeNamespaces {
+		if ns == ens {
+			return true
+		}
+	}
+	return false
 }
 
 // KubernetesState holds the state information we will pass to the configuration
-// template.
+// template. Optional resources are nil unless enabled. Gateway API resources
+// are unstructured, their fields can be accessed via .Object, e.g.
+// .Object.spec.hostnames
 type KubernetesState struct {
 	Nodes     map[string]v1.Node
 	Ingresses map[string]netv1.Ingress
 	Services  map[string]v1.Service
 	Endpoints map[string]v1.Endpoints
+
+	Pods           map[string]v1.Pod
+	EndpointSlices map[string]discoveryv1.EndpointSlice
+	Gateways       map[string]unstructured.Unstructured
+	HTTPRoutes     map[string]unstructured.Unstructured
+	DNSEndpoints   map[string]DNSEndpoint
+}
+
+// informerFactory is the common interface of the typed and dynamic
+// informer factories.
+type informerFactory interface {
+	Start(stopCh <-chan struct{})
 }
 
 // Kubernetes implements discovery of applications and
 // dns names from https://github.com/mesosphere/marathon
 type Kubernetes struct {
-	*kubernetes.Clientset
+	client   kubernetes.Interface
+	dynamic  dynamic.Interface
+	debounce time.Duration
 
 	sync.Mutex
-	data *KubernetesState
+	factories []informerFactory
+	synced    []cache.InformerSynced
+	changes   chan struct{}
+	started   bool
+
+	// crds are the custom resources watched, which may not be
+	// installed.
+	crds []schema.GroupVersionResource
+
+	cfg       KubernetesConfig
+	nodes     []listersv1.NodeLister
+	ingresses []netlistersv1.IngressLister
+	services  []listersv1.ServiceLister
+	endpoints []listersv1.EndpointsLister
+
+	pods           []listersv1.PodLister
+	endpointSlices []discoverylistersv1.EndpointSliceLister
+	gateways       []cache.GenericLister
+	httpRoutes     []cache.GenericLister
+	dnsEndpoints   []cache.GenericLister
 }
 
 // NewKubernetes creates a new marathon discoverer
@@ -88,65 +200,405 @@ func NewKubernetes(cfg KubernetesConfig) (*Kubernetes, error) {
 		return nil, err
 	}
 
+	dynClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
 	klog.Infof("got past kube config")
 
-	return &Kubernetes{Clientset: clientset}, err
+	return newKubernetes(cfg, clientset, dynClient)
+}
+
+func newKubernetes(cfg KubernetesConfig, client kubernetes.Interface, dynClient dynamic.Interface) (*Kubernetes, error) {
+	if len(cfg.Nodes.Namespaces) != 0 || len(cfg.Nodes.ExcludeNamespaces) != 0 {
+		return nil, fmt.Errorf("nodes are not namespaced, namespaces cannot be set")
+	}
+	for _, rc := range []KubernetesResourceConfig{
+		cfg.Nodes, cfg.Ingresses, cfg.Services, cfg.Endpoints,
+		cfg.Pods.KubernetesResourceConfig, cfg.EndpointSlices.KubernetesResourceConfig,
+		cfg.Gateways.KubernetesResourceConfig, cfg.HTTPRoutes.KubernetesResourceConfig,
+		cfg.DNSEndpoints.KubernetesResourceConfig,
+	} {
+		if err := rc.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	k := &Kubernetes{
+		client:   client,
+		dynamic:  dynClient,
+		cfg:      cfg,
+		debounce: cfg.Debounce,
+		changes:  make(chan struct{}, 1),
+	}
+	if k.debounce == 0 {
+		k.debounce = time.Second
+	}
+
+	for _, f := range k.informerFactories(cfg.Nodes) {
+		nodes := f.Core().V1().Nodes()
+		k.watch(nodes.Informer())
+		k.nodes = append(k.nodes, nodes.Lister())
+	}
+
+	for _, f := range k.informerFactories(cfg.Ingresses) {
+		ings := f.Networking().V1().Ingresses()
+		k.watch(ings.Informer())
+		k.ingresses = append(k.ingresses, ings.Lister())
+	}
+
+	for _, f := range k.informerFactories(cfg.Services) {
+		svcs := f.Core().V1().Services()
+		k.watch(svcs.Informer())
+		k.services = append(k.services, svcs.Lister())
+	}
+
+	for _, f := range k.informerFactories(cfg.Endpoints) {
+		eps := f.Core().V1().Endpoints()
+		k.watch(eps.Informer())
+		k.endpoints = append(k.endpoints, eps.Lister())
+	}
+
+	if cfg.Pods.Enabled {
+		for _, f := range k.informerFactories(cfg.Pods.KubernetesResourceConfig) {
+			pods := f.Core().V1().Pods()
+			k.watch(pods.Informer())
+			k.pods = append(k.pods, pods.Lister())
+		}
+	}
+
+	if cfg.EndpointSlices.Enabled {
+		for _, f := range k.informerFactories(cfg.EndpointSlices.KubernetesResourceConfig) {
+			eps := f.Discovery().V1().EndpointSlices()
+			k.watch(eps.Informer())
+			k.endpointSlices = append(k.endpointSlices, eps.Lister())
+		}
+	}
+
+	gwVersion := cfg.GatewayAPIVersion
+	if gwVersion == "" {
+		gwVersion = "v1beta1"
+	}
+
+	if cfg.Gateways.Enabled {
+		gvr := schema.GroupVersionResource{Group: "gateway.networking.k8s.io", Version: gwVersion, Resource: "gateways"}
+		k.crds = append(k.crds, gvr)
+		for _, f := range k.dynamicInformerFactories(cfg.Gateways.KubernetesResourceConfig) {
+			gws := f.ForResource(gvr)
+			k.watch(gws.Informer())
+			k.gateways = append(k.gateways, gws.Lister())
+		}
+	}
+
+	if cfg.HTTPRoutes.Enabled {
+		gvr := schema.GroupVersionResource{Group: "gateway.networking.k8s.io", Version: gwVersion, Resource: "httproutes"}
+		k.crds = append(k.crds, gvr)
+		for _, f := range k.dynamicInformerFactories(cfg.HTTPRoutes.KubernetesResourceConfig) {
+			rts := f.ForResource(gvr)
+			k.watch(rts.Informer())
+			k.httpRoutes = append(k.httpRoutes, rts.Lister())
+		}
+	}
+
+	if cfg.DNSEndpoints.Enabled {
+		k.crds = append(k.crds, dnsEndpointResource)
+		for _, f := range k.dynamicInformerFactories(cfg.DNSEndpoints.KubernetesResourceConfig) {
+			deps := f.ForResource(dnsEndpointResource)
+			k.watch(deps.Informer())
+			k.dnsEndpoints = append(k.dnsEndpoints, deps.Lister())
+		}
+	}
+
+	return k, nil
+}
+
+// informerFactories creates an informer factory for each of the namespaces
+// of a resource, filtered by the resource's selectors.
+func (m *Kubernetes) informerFactories(rc KubernetesResourceConfig) []informers.SharedInformerFactory {
+	nss := rc.Namespaces
+	if len(nss) == 0 {
+		nss = []string{metav1.NamespaceAll}
+	}
+
+	var fs []informers.SharedInformerFactory
+	for _, ns := range nss {
+		f := informers.NewSharedInformerFactoryWithOptions(m.client, 0,
+			informers.WithNamespace(ns),
+			informers.WithTweakListOptions(rc.tweakListOptions))
+		fs = append(fs, f)
+		m.factories = append(m.factories, f)
+	}
+	return fs
+}
+
+// dynamicInformerFactories is the same as informerFactories, for resources
+// accessed via the dynamic client.
+func (m *Kubernetes) dynamicInformerFactories(rc KubernetesResourceConfig) []dynamicinformer.DynamicSharedInformerFactory {
+	nss := rc.Namespaces
+	if len(nss) == 0 {
+		nss = []string{metav1.NamespaceAll}
+	}
+
+	var fs []dynamicinformer.DynamicSharedInformerFactory
+	for _, ns := range nss {
+		f := dynamicinformer.NewFilteredDynamicSharedInformerFactory(m.dynamic, 0, ns, rc.tweakListOptions)
+		fs = append(fs, f)
+		m.factories = append(m.factories, f)
+	}
+	return fs
+}
+
+// watch registers an informer for change notifications.
+func (m *Kubernetes) watch(inf cache.SharedIndexInformer) {
+	inf.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { m.changed() },
+		UpdateFunc: func(interface{}, interface{}) { m.changed() },
+		DeleteFunc: func(interface{}) { m.changed() },
+	})
+	m.synced = append(m.synced, inf.HasSynced)
+}
+
+// checkResources checks that the custom resources we watch are served.
+// The informer of a resource that is not served never syncs.
+func (m *Kubernetes) checkResources() error {
+	for _, gvr := range m.crds {
+		rs, err := m.client.Discovery().ServerResourcesForGroupVersion(gvr.GroupVersion().String())
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("failed to discover %s resources, %w", gvr.GroupVersion(), err)
+		}
+		served := false
+		if rs != nil {
+			for _, r := range rs.APIResources {
+				served = served || r.Name == gvr.Resource
+			}
+		}
+		if !served {
+			return fmt.Errorf("%s/%s is not served by the cluster, is its CRD installed?", gvr.GroupResource(), gvr.Version)
+		}
+	}
+	return nil
 }
 
-func key(md metav1.ObjectMeta) string {
+// changed notifies StatePull that the cache has changed
+func (m *Kubernetes) changed() {
+	select {
+	case m.changes <- struct{}{}:
+	default:
+	}
+}
+
+func key(md metav1.Object) string {
 	return fmt.Sprintf("%s/%s", md.GetNamespace(), md.GetName())
 }
 
-// StatePull watches, or polls, marathon for new applications.
-// Any matching the requires constraints are returned.
-// THe first call to Discover returns all the known apps,
-// Subsequent calls block until an individial update is found.
+func (m *Kubernetes) blocksUntilChange() {}
+
+// StatePull watches kubernetes for changes to the resources
+// we are interested in.
+// The first call to StatePull starts the watches and returns
+// the full state once the cache is synchronised, or fails if any
+// of the custom resources to be watched are not installed.
+// Subsequent calls block until a change is seen, and no further
+// changes have been seen for the debounce period.
 func (m *Kubernetes) StatePull(ctx context.Context) (State, error) {
 	m.Lock()
 	defer m.Unlock()
 
-	klog.Info("Pulling state from kubernetes")
+	if !m.started {
+		if err := m.checkResources(); err != nil {
+			return nil, err
+		}
+		klog.Info("Starting kubernetes watches")
+		for _, f := range m.factories {
+			f.Start(ctx.Done())
+		}
+		if !cache.WaitForCacheSync(ctx.Done(), m.synced...) {
+			return nil, fmt.Errorf("failed to sync kubernetes caches, %w", ctx.Err())
+		}
+		m.started = true
 
-	nodesM := map[string]v1.Node{}
-	nodesL, err := m.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
-	if err != nil {
-		return nil, err
+		// The initial sync produces a flood of changes that are
+		// already included in the state.
+		select {
+		case <-m.changes:
+		default:
+		}
+		return m.state()
 	}
-	for _, n := range nodesL.Items {
-		nodesM[key(n.ObjectMeta)] = n
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-m.changes:
 	}
 
-	ingsM := map[string]netv1.Ingress{}
-	ingsL, err := m.NetworkingV1().Ingresses(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
-	if err != nil {
-		return nil, err
+	timer := time.NewTimer(m.debounce)
+	defer timer.Stop()
+	for quiet := false; !quiet; {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-m.changes:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(m.debounce)
+		case <-timer.C:
+			quiet = true
+		}
 	}
-	for _, i := range ingsL.Items {
-		ingsM[key(i.ObjectMeta)] = i
+
+	return m.state()
+}
+
+// state builds the KubernetesState from the informer caches.
+func (m *Kubernetes) state() (State, error) {
+	klog.V(1).Info("Building state from kubernetes cache")
+
+	nodesM := map[string]v1.Node{}
+	for _, l := range m.nodes {
+		nodesL, err := l.List(labels.Everything())
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range nodesL {
+			nodesM[key(n)] = *n
+		}
 	}
 
-	svcsM := map[string]v1.Service{}
-	svcsL, err := m.CoreV1().Services(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
-	if err != nil {
-		return nil, err
+	ingsM := map[string]netv1.Ingress{}
+	for _, l := range m.ingresses {
+		ingsL, err := l.List(labels.Everything())
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range ingsL {
+			if m.cfg.Ingresses.excluded(i.Namespace) {
+				continue
+			}
+			ingsM[key(i)] = *i
+		}
 	}
-	for _, s := range svcsL.Items {
-		svcsM[key(s.ObjectMeta)] = s
+
+	svcsM := map[string]v1.Service{}
+	for _, l := range m.services {
+		svcsL, err := l.List(labels.Everything())
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range svcsL {
+			if m.cfg.Services.excluded(s.Namespace) {
+				continue
+			}
+			svcsM[key(s)] = *s
+		}
 	}
 
 	epsM := map[string]v1.Endpoints{}
-	epsL, err := m.CoreV1().Endpoints(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
-	if err != nil {
-		return nil, err
-	}
-	for _, e := range epsL.Items {
-		epsM[key(e.ObjectMeta)] = e
+	for _, l := range m.endpoints {
+		epsL, err := l.List(labels.Everything())
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range epsL {
+			if m.cfg.Endpoints.excluded(e.Namespace) {
+				continue
+			}
+			epsM[key(e)] = *e
+		}
 	}
 
-	return &KubernetesState{
+	st := &KubernetesState{
 		Nodes:     nodesM,
 		Ingresses: ingsM,
 		Services:  svcsM,
 		Endpoints: epsM,
-	}, nil
+	}
+
+	if m.cfg.Pods.Enabled {
+		st.Pods = map[string]v1.Pod{}
+		for _, l := range m.pods {
+			podsL, err := l.List(labels.Everything())
+			if err != nil {
+				return nil, err
+			}
+			for _, p := range podsL {
+				if m.cfg.Pods.excluded(p.Namespace) {
+					continue
+				}
+				st.Pods[key(p)] = *p
+			}
+		}
+	}
+
+	if m.cfg.EndpointSlices.Enabled {
+		st.EndpointSlices = map[string]discoveryv1.EndpointSlice{}
+		for _, l := range m.endpointSlices {
+			epsL, err := l.List(labels.Everything())
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range epsL {
+				if m.cfg.EndpointSlices.excluded(e.Namespace) {
+					continue
+				}
+				st.EndpointSlices[key(e)] = *e
+			}
+		}
+	}
+
+	if m.cfg.Gateways.Enabled {
+		gws, err := unstructuredState(m.gateways, m.cfg.Gateways.KubernetesResourceConfig)
+		if err != nil {
+			return nil, err
+		}
+		st.Gateways = gws
+	}
+
+	if m.cfg.HTTPRoutes.Enabled {
+		rts, err := unstructuredState(m.httpRoutes, m.cfg.HTTPRoutes.KubernetesResourceConfig)
+		if err != nil {
+			return nil, err
+		}
+		st.HTTPRoutes = rts
+	}
+
+	if m.cfg.DNSEndpoints.Enabled {
+		deps, err := unstructuredState(m.dnsEndpoints, m.cfg.DNSEndpoints.KubernetesResourceConfig)
+		if err != nil {
+			return nil, err
+		}
+		st.DNSEndpoints = map[string]DNSEndpoint{}
+		for k, u := range deps {
+			dep, err := dnsEndpointFromUnstructured(&u)
+			if err != nil {
+				return nil, err
+			}
+			st.DNSEndpoints[k] = dep
+		}
+	}
+
+	return st, nil
+}
+
+func unstructuredState(ls []cache.GenericLister, rc KubernetesResourceConfig) (map[string]unstructured.Unstructured, error) {
+	res := map[string]unstructured.Unstructured{}
+	for _, l := range ls {
+		objs, err := l.List(labels.Everything())
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range objs {
+			u, ok := obj.(*unstructured.Unstructured)
+			if !ok {
+				return nil, fmt.Errorf("unexpected object type %T", obj)
+			}
+			if rc.excluded(u.GetNamespace()) {
+				continue
+			}
+			res[key(u)] = *u
+		}
+	}
+	return res, nil
 }
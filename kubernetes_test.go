@@ -0,0 +1,241 @@
+package dubber
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func testService(ns, name string) *v1.Service {
+	return &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name}}
+}
+
+func testEndpoints(ns, name string) *v1.Endpoints {
+	return &v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name}}
+}
+
+func TestKubernetesStatePull(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client := fake.NewSimpleClientset(
+		&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}},
+		testService("default", "svc1"),
+	)
+	k, err := newKubernetes(KubernetesConfig{Debounce: 10 * time.Millisecond}, client, nil)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	st, err := k.StatePull(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	ks := st.(*KubernetesState)
+	if _, ok := ks.Nodes["/node1"]; !ok {
+		t.Fatalf("expected node1 in state, got %v", ks.Nodes)
+	}
+	if _, ok := ks.Services["default/svc1"]; !ok {
+		t.Fatalf("expected default/svc1 in state, got %v", ks.Services)
+	}
+
+	type result struct {
+		st  State
+		err error
+	}
+	res := make(chan result)
+	go func() {
+		st, err := k.StatePull(ctx)
+		res <- result{st, err}
+	}()
+
+	select {
+	case r := <-res:
+		t.Fatalf("expected StatePull to block until a change, got %v, %v", r.st, r.err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	_, err = client.CoreV1().Services("other").Create(ctx, testService("other", "svc2"), metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("failed creating service, %v", err)
+	}
+
+	r := <-res
+	if r.err != nil {
+		t.Fatalf("unexpected error, %v", r.err)
+	}
+	ks = r.st.(*KubernetesState)
+	if _, ok := ks.Services["other/svc2"]; !ok {
+		t.Fatalf("expected other/svc2 in state, got %v", ks.Services)
+	}
+}
+
+func TestKubernetesStatePull_Scoped(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	labelled := testService("team-a", "labelled")
+	labelled.Labels = map[string]string{"dns": "true"}
+	client := fake.NewSimpleClientset(
+		labelled,
+		testService("team-a", "unlabelled"),
+		testService("team-c", "other"),
+		testEndpoints("team-a", "eps"),
+		testEndpoints("kube-system", "eps"),
+	)
+
+	cfg := KubernetesConfig{
+		Services: KubernetesResourceConfig{
+			Namespaces:    []string{"team-a", "team-b"},
+			LabelSelector: "dns=true",
+		},
+		Endpoints: KubernetesResourceConfig{
+			ExcludeNamespaces: []string{"kube-system"},
+		},
+	}
+	k, err := newKubernetes(cfg, client, nil)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	st, err := k.StatePull(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	ks := st.(*KubernetesState)
+
+	if len(ks.Services) != 1 {
+		t.Fatalf("expected only team-a/labelled service, got %v", ks.Services)
+	}
+	if _, ok := ks.Services["team-a/labelled"]; !ok {
+		t.Fatalf("expected only team-a/labelled service, got %v", ks.Services)
+	}
+	if len(ks.Endpoints) != 1 {
+		t.Fatalf("expected only team-a/eps endpoints, got %v", ks.Endpoints)
+	}
+	if _, ok := ks.Endpoints["team-a/eps"]; !ok {
+		t.Fatalf("expected only team-a/eps endpoints, got %v", ks.Endpoints)
+	}
+}
+
+func TestKubernetesConfig_Invalid(t *testing.T) {
+	client := fake.NewSimpleClientset()
+
+	cfg := KubernetesConfig{Services: KubernetesResourceConfig{LabelSelector: "dns in (true"}}
+	if _, err := newKubernetes(cfg, client, nil); err == nil {
+		t.Fatalf("expected invalid label selector to fail")
+	}
+
+	cfg = KubernetesConfig{Nodes: KubernetesResourceConfig{Namespaces: []string{"default"}}}
+	if _, err := newKubernetes(cfg, client, nil); err == nil {
+		t.Fatalf("expected namespaced nodes to fail")
+	}
+}
+
+func TestKubernetesStatePull_Optional(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client := fake.NewSimpleClientset(
+		&v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pod1"}},
+		&discoveryv1.EndpointSlice{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "svc1-abcde"}},
+	)
+
+	route := &unstructured.Unstructured{}
+	route.SetAPIVersion("gateway.networking.k8s.io/v1beta1")
+	route.SetKind("HTTPRoute")
+	route.SetNamespace("default")
+	route.SetName("route1")
+	unstructured.SetNestedStringSlice(route.Object, []string{"www.example.com"}, "spec", "hostnames")
+
+	client.Resources = []*metav1.APIResourceList{{
+		GroupVersion: "gateway.networking.k8s.io/v1beta1",
+		APIResources: []metav1.APIResource{{Name: "gateways"}, {Name: "httproutes"}},
+	}}
+
+	dynClient := dynfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{
+			{Group: "gateway.networking.k8s.io", Version: "v1beta1", Resource: "gateways"}:   "GatewayList",
+			{Group: "gateway.networking.k8s.io", Version: "v1beta1", Resource: "httproutes"}: "HTTPRouteList",
+		},
+		route,
+	)
+
+	cfg := KubernetesConfig{}
+	cfg.Pods.Enabled = true
+	cfg.EndpointSlices.Enabled = true
+	cfg.Gateways.Enabled = true
+	cfg.HTTPRoutes.Enabled = true
+	k, err := newKubernetes(cfg, client, dynClient)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	st, err := k.StatePull(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	ks := st.(*KubernetesState)
+
+	if _, ok := ks.Pods["default/pod1"]; !ok {
+		t.Fatalf("expected default/pod1 in state, got %v", ks.Pods)
+	}
+	if _, ok := ks.EndpointSlices["default/svc1-abcde"]; !ok {
+		t.Fatalf("expected default/svc1-abcde in state, got %v", ks.EndpointSlices)
+	}
+	if ks.Gateways == nil || len(ks.Gateways) != 0 {
+		t.Fatalf("expected empty gateways in state, got %v", ks.Gateways)
+	}
+	rt, ok := ks.HTTPRoutes["default/route1"]
+	if !ok {
+		t.Fatalf("expected default/route1 in state, got %v", ks.HTTPRoutes)
+	}
+	hosts, _, _ := unstructured.NestedStringSlice(rt.Object, "spec", "hostnames")
+	if len(hosts) != 1 || hosts[0] != "www.example.com" {
+		t.Fatalf("expected route hostnames, got %v", hosts)
+	}
+}
+
+func TestKubernetesStatePull_MissingCRD(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client := fake.NewSimpleClientset()
+	client.Resources = []*metav1.APIResourceList{{
+		GroupVersion: "gateway.networking.k8s.io/v1beta1",
+		APIResources: []metav1.APIResource{{Name: "httproutes"}},
+	}}
+	dynClient := dynfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{
+			{Group: "gateway.networking.k8s.io", Version: "v1beta1", Resource: "gateways"}: "GatewayList",
+			dnsEndpointResource: "DNSEndpointList",
+		},
+	)
+
+	for name, enable := range map[string]func(*KubernetesConfig){
+		"gateways":     func(cfg *KubernetesConfig) { cfg.Gateways.Enabled = true },
+		"dnsEndpoints": func(cfg *KubernetesConfig) { cfg.DNSEndpoints.Enabled = true },
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg := KubernetesConfig{}
+			enable(&cfg)
+			k, err := newKubernetes(cfg, client, dynClient)
+			if err != nil {
+				t.Fatalf("unexpected error, %v", err)
+			}
+			if _, err := k.StatePull(ctx); err == nil || !strings.Contains(err.Error(), "is not served") {
+				t.Fatalf("expected an error for the missing resource, got %v", err)
+			}
+		})
+	}
+}
@@ -16,10 +16,14 @@ package dubber
 
 import (
 	"context"
+	"fmt"
 	"net/url"
+	"strings"
 	"sync"
+	"time"
 
 	marathon "github.com/gambol99/go-marathon"
+	"k8s.io/klog/v2"
 )
 
 // MarathonConfig describes configuration options for
@@ -31,53 +35,205 @@ type MarathonConfig struct {
 		Username string `json:"username" yaml:"username"`
 		Password string `json:"password" yaml:"password"`
 	} `json:"basic_auth" yaml:"basic_auth"`
-	XXX `json:",omitempty" yaml:",omitempty,inline"`
+	// Debounce is how long to wait for further events after an event
+	// is seen, before a new state is returned. Defaults to 1s.
+	Debounce time.Duration `json:"debounce" yaml:"debounce"`
+	// Resync is how often to list all applications, even if no events
+	// have been seen. Defaults to 5m.
+	Resync time.Duration `json:"resync" yaml:"resync"`
+	XXX    `json:",omitempty" yaml:",omitempty,inline"`
 }
 
 // MarathonState holds the state information we will pass to the configuration
 // template.
 type MarathonState struct {
+	// Applications are keyed by application ID.
 	Applications map[string]marathon.Application
-	Tasks        map[string]marathon.Task
+	// Tasks are keyed by task ID, and include the task's host, ports,
+	// IP addresses and health check results.
+	Tasks map[string]marathon.Task
 }
 
 // Marathon implements discovery of applications and
 // dns names from https://github.com/mesosphere/marathon
 type Marathon struct {
 	marathon.Marathon
+	debounce time.Duration
+	resync   time.Duration
 
 	sync.Mutex
-	data *MarathonState
+	started    bool
+	subscribed bool
+	changes    chan struct{}
+	data       *MarathonState
 }
 
+// marathonEvents are the events that may change the state.
+const marathonEvents = marathon.EventIDApplications |
+	marathon.EventIDAddHealthCheck |
+	marathon.EventIDRemoveHealthCheck |
+	marathon.EventIDGroupChangeSuccess |
+	marathon.EventIDDeploymentSuccess |
+	marathon.EventIDDeploymentFailed |
+	marathon.EventIDDeploymentStepSuccess
+
 // NewMarathon creates a new marathon discoverer
 func NewMarathon(cfg MarathonConfig) (*Marathon, error) {
+	if len(cfg.Endpoint) == 0 {
+		return nil, fmt.Errorf("at least one endpoint must be set")
+	}
+
 	config := marathon.NewDefaultConfig()
-	config.URL = cfg.Endpoint[0]
+	// The client fails over between the members of the cluster, marking
+	// unreachable members as down.
+	config.URL = strings.Join(cfg.Endpoint, ",")
 	config.EventsTransport = marathon.EventsTransportSSE
 	config.HTTPBasicAuthUser = cfg.BasicAuth.Username
 	config.HTTPBasicPassword = cfg.BasicAuth.Password
 
 	mc, err := marathon.NewClient(config)
-	return &Marathon{Marathon: mc}, err
+	m := &Marathon{
+		Marathon: mc,
+		debounce: cfg.Debounce,
+		resync:   cfg.Resync,
+		changes:  make(chan struct{}, 1),
+	}
+	if m.debounce == 0 {
+		m.debounce = time.Second
+	}
+	if m.resync == 0 {
+		m.resync = 5 * time.Minute
+	}
+	return m, err
 }
 
-// StatePull watches, or polls, marathon for new applications.
-// Any matching the requires constraints are returned.
-// THe first call to Discover returns all the known apps,
-// Subsequent calls block until an individial update is found.
+func (m *Marathon) blocksUntilChange() {}
+
+// StatePull watches marathon's event stream for changes to applications.
+// The first call subscribes to the event stream and returns all the known
+// apps. Subsequent calls block until a relevant event is seen, and no
+// further events have been seen for the debounce period, or until the
+// resync period has passed. If subscribing fails it is retried on each
+// call, and if listing the apps fails, the next call lists them again
+// without waiting for an event.
 func (m *Marathon) StatePull(ctx context.Context) (State, error) {
 	m.Lock()
-	m.Unlock()
+	defer m.Unlock()
+
+	if !m.subscribed {
+		if err := m.watch(ctx); err != nil {
+			// We can still poll, with the resync period
+			klog.Errorf("failed to subscribe to marathon events, %v", err)
+		} else {
+			m.subscribed = true
+			if m.started {
+				// Events may have been missed while unsubscribed
+				m.changed()
+			}
+		}
+	}
+
+	if !m.started {
+		m.started = true
+		return m.retryState()
+	}
+
+	resync := time.NewTimer(m.resync)
+	defer resync.Stop()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-resync.C:
+		klog.V(1).Info("Resyncing marathon applications")
+		return m.retryState()
+	case <-m.changes:
+	}
+
+	timer := time.NewTimer(m.debounce)
+	defer timer.Stop()
+	for quiet := false; !quiet; {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-m.changes:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(m.debounce)
+		case <-timer.C:
+			quiet = true
+		}
+	}
+
+	return m.retryState()
+}
+
+// retryState lists the apps, re-arming the change notification if that
+// fails, so that the next call retries straight away.
+func (m *Marathon) retryState() (State, error) {
+	st, err := m.state()
+	if err != nil {
+		m.changed()
+	}
+	return st, err
+}
+
+// changed notifies StatePull that apps may have changed
+func (m *Marathon) changed() {
+	select {
+	case m.changes <- struct{}{}:
+	default:
+	}
+}
+
+// watch subscribes to marathon's event stream.
+func (m *Marathon) watch(ctx context.Context) error {
+	evs, err := m.Marathon.AddEventsListener(marathonEvents)
+	if err != nil {
+		return err
+	}
 
+	go func() {
+		// Pending deliveries are abandoned once the listener is
+		// removed, so evs need not be drained.
+		defer m.Marathon.RemoveEventsListener(evs)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ev, ok := <-evs:
+				if !ok {
+					return
+				}
+				klog.V(2).Infof("marathon event %s", ev.Name)
+				m.changed()
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (m *Marathon) state() (State, error) {
 	apps, err := m.Marathon.Applications(url.Values{})
 	if err != nil {
 		return nil, err
 	}
-	data := &MarathonState{Applications: map[string]marathon.Application{}}
+	tasks, err := m.Marathon.AllTasks(&marathon.AllTasksOpts{})
+	if err != nil {
+		return nil, err
+	}
+
+	data := &MarathonState{
+		Applications: map[string]marathon.Application{},
+		Tasks:        map[string]marathon.Task{},
+	}
 	for i := range apps.Apps {
 		data.Applications[apps.Apps[i].ID] = apps.Apps[i]
 	}
+	for i := range tasks.Tasks {
+		data.Tasks[tasks.Tasks[i].ID] = tasks.Tasks[i]
+	}
 	m.data = data
 	return m.data, nil
 }
@@ -0,0 +1,262 @@
+package dubber
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	marathon "github.com/gambol99/go-marathon"
+)
+
+func TestMarathonStatePull(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var mu sync.Mutex
+	apps := []marathon.Application{{ID: "/web"}}
+	events := make(chan string)
+	done := make(chan struct{})
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/apps":
+			mu.Lock()
+			defer mu.Unlock()
+			json.NewEncoder(w).Encode(marathon.Applications{Apps: apps})
+		case "/v2/tasks":
+			json.NewEncoder(w).Encode(marathon.Tasks{Tasks: []marathon.Task{{
+				ID:    "web.1",
+				AppID: "/web",
+				Host:  "node1.example.com",
+				Ports: []int{31000},
+				HealthCheckResults: []*marathon.HealthCheckResult{
+					{Alive: true},
+				},
+			}}})
+		case "/v2/events":
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			for {
+				select {
+				case <-r.Context().Done():
+					return
+				case <-done:
+					return
+				case ev := <-events:
+					fmt.Fprintf(w, "event: %s\ndata: {\"eventType\": %q}\n\n", ev, ev)
+					w.(http.Flusher).Flush()
+				}
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	// The event stream is never closed by the client
+	defer close(done)
+
+	m, err := NewMarathon(MarathonConfig{
+		Endpoint: []string{ts.URL},
+		Debounce: 10 * time.Millisecond,
+		Resync:   time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	st, err := m.StatePull(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if n := len(st.(*MarathonState).Applications); n != 1 {
+		t.Fatalf("expected 1 application, got %d", n)
+	}
+	task, ok := st.(*MarathonState).Tasks["web.1"]
+	if !ok || task.Host != "node1.example.com" || task.Ports[0] != 31000 || !task.HealthCheckResults[0].Alive {
+		t.Fatalf("expected healthy web.1 task, got %#v", st.(*MarathonState).Tasks)
+	}
+
+	mu.Lock()
+	apps = append(apps, marathon.Application{ID: "/api"})
+	mu.Unlock()
+
+	go func() {
+		select {
+		case events <- "deployment_success":
+		case <-ctx.Done():
+		}
+	}()
+
+	st, err = m.StatePull(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if n := len(st.(*MarathonState).Applications); n != 2 {
+		t.Fatalf("expected 2 applications, got %d", n)
+	}
+}
+
+func TestMarathonStatePullResync(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	lists := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/apps":
+			lists++
+			json.NewEncoder(w).Encode(marathon.Applications{})
+		case "/v2/tasks":
+			json.NewEncoder(w).Encode(marathon.Tasks{})
+		default:
+			// No event stream, we should still resync
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	m, err := NewMarathon(MarathonConfig{
+		Endpoint: []string{ts.URL},
+		Resync:   10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := m.StatePull(ctx); err != nil {
+			t.Fatalf("unexpected error, %v", err)
+		}
+	}
+	if lists != 2 {
+		t.Fatalf("expected 2 application lists, got %d", lists)
+	}
+}
+
+func TestMarathonFailover(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/apps":
+			json.NewEncoder(w).Encode(marathon.Applications{Apps: []marathon.Application{{ID: "/web"}}})
+		case "/v2/tasks":
+			json.NewEncoder(w).Encode(marathon.Tasks{})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	m, err := NewMarathon(MarathonConfig{Endpoint: []string{down.URL, ts.URL}})
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	st, err := m.StatePull(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if n := len(st.(*MarathonState).Applications); n != 1 {
+		t.Fatalf("expected 1 application, got %d", n)
+	}
+}
+
+func TestMarathonNoEndpoints(t *testing.T) {
+	if _, err := NewMarathon(MarathonConfig{}); err == nil {
+		t.Fatalf("expected error with no endpoints")
+	}
+}
+
+func TestMarathonStatePullRetry(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var mu sync.Mutex
+	failing := true
+	events := make(chan string)
+	done := make(chan struct{})
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		f := failing
+		mu.Unlock()
+		if f {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v2/apps":
+			json.NewEncoder(w).Encode(marathon.Applications{Apps: []marathon.Application{{ID: "/web"}}})
+		case "/v2/tasks":
+			json.NewEncoder(w).Encode(marathon.Tasks{})
+		case "/v2/events":
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			for {
+				select {
+				case <-r.Context().Done():
+					return
+				case <-done:
+					return
+				case ev := <-events:
+					fmt.Fprintf(w, "event: %s\ndata: {\"eventType\": %q}\n\n", ev, ev)
+					w.(http.Flusher).Flush()
+				}
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	defer close(done)
+
+	m, err := NewMarathon(MarathonConfig{
+		Endpoint: []string{ts.URL},
+		Debounce: 10 * time.Millisecond,
+		Resync:   time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	if _, err := m.StatePull(ctx); err == nil {
+		t.Fatalf("expected an error while marathon is failing")
+	}
+
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+
+	// The failed listing is retried without waiting for an event, or
+	// the resync period
+	st, err := m.StatePull(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if n := len(st.(*MarathonState).Applications); n != 1 {
+		t.Fatalf("expected 1 application, got %d", n)
+	}
+
+	// The subscription was retried, so events are seen
+	go func() {
+		select {
+		case events <- "deployment_success":
+		case <-ctx.Done():
+		}
+	}()
+	if _, err := m.StatePull(ctx); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+}
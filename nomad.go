@@ -0,0 +1,249 @@
+// Copyright 2017 Qubit Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dubber
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	nomad "github.com/hashicorp/nomad/api"
+	"k8s.io/klog/v2"
+)
+
+// NomadConfig describes configuration options for
+// the nomad discoverer. Any settings not given are taken
+// from the standard NOMAD_ environment variables.
+type NomadConfig struct {
+	BaseDiscovererConfig `json:",omitempty" yaml:",omitempty,inline"`
+	Address              string `json:"address" yaml:"address"`
+	// Namespace to read from, "*" reads all namespaces.
+	Namespace string `json:"namespace" yaml:"namespace"`
+	Region    string `json:"region" yaml:"region"`
+	Token     string `json:"token" yaml:"token"`
+	XXX       `json:",omitempty" yaml:",omitempty,inline"`
+}
+
+// NomadState holds the state information we will pass to the configuration
+// template.
+type NomadState struct {
+	// Jobs by namespace/ID
+	Jobs map[string]*nomad.JobListStub
+	// Allocations by ID
+	Allocations map[string]*nomad.AllocationListStub
+	// Services are the nomad native service registrations, by service
+	// name.
+	Services map[string][]NomadService
+}
+
+// NomadService is a nomad native service registration, along with the
+// meta data from the service definition in the job.
+type NomadService struct {
+	*nomad.ServiceRegistration
+	Meta map[string]string
+}
+
+// Nomad implements discovery of jobs, allocations and services
+// from https://www.nomadproject.io
+type Nomad struct {
+	client *nomad.Client
+
+	sync.Mutex
+	// listed is set when the last call succeeded, and indexes are
+	// those of the state it returned.
+	listed  bool
+	indexes nomadIndexes
+}
+
+// nomadIndexes are the raft indexes of the endpoints we block on.
+type nomadIndexes struct {
+	jobs        uint64
+	allocations uint64
+	services    uint64
+}
+
+// NewNomad creates a new nomad discoverer
+func NewNomad(cfg NomadConfig) (*Nomad, error) {
+	config := nomad.DefaultConfig()
+	if cfg.Address != "" {
+		config.Address = cfg.Address
+	}
+	if cfg.Namespace != "" {
+		config.Namespace = cfg.Namespace
+	}
+	if cfg.Region != "" {
+		config.Region = cfg.Region
+	}
+	if cfg.Token != "" {
+		config.SecretID = cfg.Token
+	}
+
+	client, err := nomad.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Nomad{client: client}, nil
+}
+
+func (n *Nomad) blocksUntilChange() {}
+
+// StatePull reads the jobs, allocations and services from nomad.
+// The first call, and the first call after a failure, return the current
+// state, subsequent calls block until any of them change.
+func (n *Nomad) StatePull(ctx context.Context) (State, error) {
+	n.Lock()
+	defer n.Unlock()
+
+	if n.listed {
+		n.listed = false
+		if err := n.wait(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	st, idxs, err := n.state(ctx)
+	if err != nil {
+		return nil, err
+	}
+	n.indexes = idxs
+	n.listed = true
+
+	return st, nil
+}
+
+// wait blocks until any of the indexes change.
+func (n *Nomad) wait(ctx context.Context) error {
+	watch := func(idx uint64, query func(*nomad.QueryOptions) (*nomad.QueryMeta, error)) func(context.Context) error {
+		return func(ctx context.Context) error {
+			for {
+				q := (&nomad.QueryOptions{WaitIndex: idx}).WithContext(ctx)
+				meta, err := query(q)
+				if err != nil {
+					return fmt.Errorf("failed watching nomad, %w", err)
+				}
+				// Blocking queries return the same index when they time
+				// out with no changes
+				if meta.LastIndex != idx {
+					return nil
+				}
+			}
+		}
+	}
+
+	return waitForChange(ctx,
+		watch(n.indexes.jobs, func(q *nomad.QueryOptions) (*nomad.QueryMeta, error) {
+			_, meta, err := n.client.Jobs().List(q)
+			return meta, err
+		}),
+		watch(n.indexes.allocations, func(q *nomad.QueryOptions) (*nomad.QueryMeta, error) {
+			_, meta, err := n.client.Allocations().List(q)
+			return meta, err
+		}),
+		watch(n.indexes.services, func(q *nomad.QueryOptions) (*nomad.QueryMeta, error) {
+			_, meta, err := n.client.Services().List(q)
+			return meta, err
+		}),
+	)
+}
+
+func (n *Nomad) state(ctx context.Context) (*NomadState, nomadIndexes, error) {
+	klog.Info("Pulling state from nomad")
+
+	var idxs nomadIndexes
+	q := (&nomad.QueryOptions{}).WithContext(ctx)
+
+	jobs, meta, err := n.client.Jobs().List(q)
+	if err != nil {
+		return nil, idxs, fmt.Errorf("failed listing nomad jobs, %w", err)
+	}
+	idxs.jobs = meta.LastIndex
+
+	allocs, meta, err := n.client.Allocations().List(q)
+	if err != nil {
+		return nil, idxs, fmt.Errorf("failed listing nomad allocations, %w", err)
+	}
+	idxs.allocations = meta.LastIndex
+
+	svcs, meta, err := n.client.Services().List(q)
+	if err != nil {
+		return nil, idxs, fmt.Errorf("failed listing nomad services, %w", err)
+	}
+	idxs.services = meta.LastIndex
+
+	st := &NomadState{
+		Jobs:        map[string]*nomad.JobListStub{},
+		Allocations: map[string]*nomad.AllocationListStub{},
+		Services:    map[string][]NomadService{},
+	}
+
+	for _, j := range jobs {
+		st.Jobs[j.Namespace+"/"+j.ID] = j
+	}
+
+	for _, a := range allocs {
+		st.Allocations[a.ID] = a
+	}
+
+	// Service meta data is only available from the job definition
+	jobSpecs := map[string]*nomad.Job{}
+	for _, nsSvcs := range svcs {
+		nsq := (&nomad.QueryOptions{Namespace: nsSvcs.Namespace}).WithContext(ctx)
+		for _, stub := range nsSvcs.Services {
+			regs, _, err := n.client.Services().Get(stub.ServiceName, nsq)
+			if err != nil {
+				return nil, idxs, fmt.Errorf("failed reading nomad service %s, %w", stub.ServiceName, err)
+			}
+
+			for _, reg := range regs {
+				jk := reg.Namespace + "/" + reg.JobID
+				job, ok := jobSpecs[jk]
+				if !ok {
+					job, _, err = n.client.Jobs().Info(reg.JobID, nsq)
+					if err != nil {
+						return nil, idxs, fmt.Errorf("failed reading nomad job %s, %w", jk, err)
+					}
+					jobSpecs[jk] = job
+				}
+
+				st.Services[reg.ServiceName] = append(st.Services[reg.ServiceName], NomadService{
+					ServiceRegistration: reg,
+					Meta:                nomadServiceMeta(job, reg.ServiceName),
+				})
+			}
+		}
+	}
+
+	return st, idxs, nil
+}
+
+// nomadServiceMeta finds the meta data for the named service in a job.
+func nomadServiceMeta(job *nomad.Job, name string) map[string]string {
+	for _, tg := range job.TaskGroups {
+		for _, s := range tg.Services {
+			if s.Name == name {
+				return s.Meta
+			}
+		}
+		for _, t := range tg.Tasks {
+			for _, s := range t.Services {
+				if s.Name == name {
+					return s.Meta
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package dubber
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	nomad "github.com/hashicorp/nomad/api"
+)
+
+func TestNomadStatePull(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	jobName := "web"
+	resps := map[string]interface{}{
+		"/v1/jobs": []*nomad.JobListStub{
+			{ID: "web", Namespace: "default"},
+		},
+		"/v1/allocations": []*nomad.AllocationListStub{
+			{ID: "alloc1", JobID: "web", Namespace: "default"},
+		},
+		"/v1/services": []*nomad.ServiceRegistrationListStub{
+			{Namespace: "default", Services: []*nomad.ServiceRegistrationStub{{ServiceName: "web"}}},
+		},
+		"/v1/service/web": []*nomad.ServiceRegistration{
+			{ServiceName: "web", Namespace: "default", JobID: "web", AllocID: "alloc1", Address: "10.0.0.1", Port: 8080, Tags: []string{"public"}},
+		},
+		"/v1/job/web": &nomad.Job{
+			ID: &jobName,
+			TaskGroups: []*nomad.TaskGroup{{
+				Tasks: []*nomad.Task{{
+					Services: []*nomad.Service{{Name: "web", Meta: map[string]string{"dns": "www.example.com"}}},
+				}},
+			}},
+		},
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp, ok := resps[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("X-Nomad-Index", "10")
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer ts.Close()
+
+	n, err := NewNomad(NomadConfig{Address: ts.URL})
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	st, err := n.StatePull(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	nst := st.(*NomadState)
+
+	if _, ok := nst.Jobs["default/web"]; !ok {
+		t.Fatalf("expected default/web job in state, got %v", nst.Jobs)
+	}
+	if _, ok := nst.Allocations["alloc1"]; !ok {
+		t.Fatalf("expected alloc1 in state, got %v", nst.Allocations)
+	}
+	if len(nst.Services["web"]) != 1 {
+		t.Fatalf("expected 1 web service, got %v", nst.Services)
+	}
+	svc := nst.Services["web"][0]
+	if svc.Address != "10.0.0.1" || svc.Meta["dns"] != "www.example.com" {
+		t.Fatalf("expected web service with meta, got %#v", svc)
+	}
+}
+
+func TestNomadStatePull_Recover(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var mu sync.Mutex
+	failing := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failing {
+			http.Error(w, "unavailable", http.StatusInternalServerError)
+			return
+		}
+		if r.URL.Query().Get("index") == "10" {
+			// Nothing changes, blocking queries time out
+			time.Sleep(10 * time.Millisecond)
+		}
+		w.Header().Set("X-Nomad-Index", "10")
+		w.Write([]byte("[]"))
+	}))
+	defer ts.Close()
+
+	n, err := NewNomad(NomadConfig{Address: ts.URL})
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	if _, err := n.StatePull(ctx); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	mu.Lock()
+	failing = true
+	mu.Unlock()
+	if _, err := n.StatePull(ctx); err == nil {
+		t.Fatalf("expected an error while nomad is failing")
+	}
+
+	// Nothing has changed, but the recovery is still reported
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+	rctx, rcancel := context.WithTimeout(ctx, time.Second)
+	defer rcancel()
+	if _, err := n.StatePull(rctx); err != nil {
+		t.Fatalf("expected the state after recovering, got %v", err)
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2017 Qubit Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dubber
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+	klog "k8s.io/klog/v2"
+)
+
+// A Plan records the changes that reconciling each zone would make, so
+// that they can be reviewed before being applied.
+type Plan struct {
+	Zones []*ZonePlan `json:"zones"`
+}
+
+// A ZonePlan holds the changes to be made to a zone by one provisioner.
+// Records are stored in zone file format, including any record flags.
+// Serial is the SOA serial of the remote zone when the plan was made, the
+// plan is only applied if it has not changed. Blocked is set to the reason
+// if the changes exceed the zone's safety limits, they are then included
+// for review, but are not applied.
+type ZonePlan struct {
+	Zone        string   `json:"zone"`
+	Provisioner string   `json:"provisioner"`
+	Serial      uint32   `json:"serial"`
+	Blocked     string   `json:"blocked,omitempty"`
+	Wanted      []string `json:"wanted"`
+	Unwanted    []string `json:"unwanted"`
+	Desired     []string `json:"desired"`
+}
+
+// ReadPlan reads a JSON plan, as written by dubber plan.
+func ReadPlan(r io.Reader) (*Plan, error) {
+	plan := &Plan{}
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(plan); err != nil {
+		return nil, fmt.Errorf("invalid plan, %w", err)
+	}
+	return plan, nil
+}
+
+// record stores the changes in the plan. Records are sorted, so that the
+// plan for an unchanged zone is always the same.
+func (zp *ZonePlan) record(wanted, unwanted, desired, remote Zone) {
+	zoneStrs := func(z Zone) []string {
+		z = append(Zone(nil), z...)
+		sort.Sort(ByRR(z))
+		strs := make([]string, len(z))
+		for i, r := range z {
+			strs[i] = r.String()
+		}
+		return strs
+	}
+	zp.Wanted = zoneStrs(wanted)
+	zp.Unwanted = zoneStrs(unwanted)
+	zp.Desired = zoneStrs(desired)
+	for _, r := range remote {
+		if soa, ok := r.RR.(*dns.SOA); ok {
+			zp.Serial = soa.Serial
+		}
+	}
+}
+
+func parsePlanRecords(strs []string) (Zone, error) {
+	return ParseZoneData(strings.NewReader(strings.Join(strs, "\n")))
+}
+
+// Plan runs every discoverer once, and reconciles each zone without
+// applying any changes, returning the changes that would have been made.
+// Zones served by the built-in authoritative server are skipped, as their
+// contents only exist within a running dubber.
+func (srv *Server) Plan(ctx context.Context) (*Plan, error) {
+	cfg := *srv.cfg
+	cfg.DryRun = false
+	provs, err := cfg.BuildProvisioners()
+	if err != nil {
+		return nil, err
+	}
+
+	ds, err := srv.cfg.BuildDiscoveres()
+	if err != nil {
+		return nil, err
+	}
+
+	var zps []*ZonePlan
+	planProvs := map[string][]NamedProvisioner{}
+	for zn, ps := range provs {
+		for _, p := range ps {
+			if _, ok := p.Provisioner.(*Authoritative); ok {
+				klog.Infof("not planning zone %q for %s, authoritative zones cannot be planned", zn, p.Name)
+				continue
+			}
+			zp := &ZonePlan{Zone: zn, Provisioner: p.Name}
+			zps = append(zps, zp)
+			planProvs[zn] = append(planProvs[zn], NamedProvisioner{
+				Name:        p.Name,
+				Provisioner: dryRunProvisioner{real: p.Provisioner, plan: zp},
+			})
+		}
+	}
+
+	fullZone, err := srv.discoverOnce(ctx, ds)
+	if err != nil {
+		return nil, fmt.Errorf("%w, no plan made", err)
+	}
+
+	if err := srv.reconcileZones(fullZone, planProvs); err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{Zones: []*ZonePlan{}}
+	for _, zp := range zps {
+		if len(zp.Wanted) != 0 || len(zp.Unwanted) != 0 {
+			plan.Zones = append(plan.Zones, zp)
+		}
+	}
+	sort.Slice(plan.Zones, func(i, j int) bool {
+		if plan.Zones[i].Zone != plan.Zones[j].Zone {
+			return plan.Zones[i].Zone < plan.Zones[j].Zone
+		}
+		return plan.Zones[i].Provisioner < plan.Zones[j].Provisioner
+	})
+	return plan, nil
+}
+
+// Apply makes exactly the changes recorded in a plan. Nothing is applied
+// if the remote serial of any zone in the plan has changed since the plan
+// was made. Zones blocked by safety limits are skipped.
+//
+// Only the SOA serial is checked, so changes made outside of dubber are
+// only detected if the provider updates the serial for them. Providers
+// that do not, such as Route53, get no protection against the zone
+// changing between plan and apply.
+func (srv *Server) Apply(plan *Plan) error {
+	provs, err := srv.cfg.BuildProvisioners()
+	if err != nil {
+		return err
+	}
+
+	type change struct {
+		zp                                *ZonePlan
+		p                                 NamedProvisioner
+		wanted, unwanted, desired, remote Zone
+	}
+	var changes []change
+	for _, zp := range plan.Zones {
+		if zp.Blocked != "" {
+			klog.Warningf("not applying plan for zone %q with %s, %s", zp.Zone, zp.Provisioner, zp.Blocked)
+			continue
+		}
+		c := change{zp: zp}
+
+		var ok bool
+		for _, p := range provs[zp.Zone] {
+			if p.Name == zp.Provisioner {
+				c.p, ok = p, true
+			}
+		}
+		if !ok {
+			return fmt.Errorf("no provisioner %s configured for zone %q", zp.Provisioner, zp.Zone)
+		}
+
+		for _, z := range []struct {
+			dst  *Zone
+			strs []string
+		}{
+			{&c.wanted, zp.Wanted},
+			{&c.unwanted, zp.Unwanted},
+			{&c.desired, zp.Desired},
+		} {
+			if *z.dst, err = parsePlanRecords(z.strs); err != nil {
+				return fmt.Errorf("invalid records in plan for zone %q, %w", zp.Zone, err)
+			}
+		}
+
+		if c.remote, err = c.p.RemoteZone(); err != nil {
+			return fmt.Errorf("reading zone %q with %s failed, %w", zp.Zone, zp.Provisioner, err)
+		}
+		var soa *dns.SOA
+		for _, r := range c.remote {
+			if rsoa, ok := r.RR.(*dns.SOA); ok {
+				soa = rsoa
+			}
+		}
+		if soa == nil {
+			return fmt.Errorf("no SOA records found in zone %q with %s", zp.Zone, zp.Provisioner)
+		}
+		if soa.Serial != zp.Serial {
+			return fmt.Errorf("serial of zone %q with %s has changed from %d to %d since the plan was made", zp.Zone, zp.Provisioner, zp.Serial, soa.Serial)
+		}
+
+		changes = append(changes, c)
+	}
+
+	var failed []string
+	for _, c := range changes {
+		if err := c.p.UpdateZone(c.wanted, c.unwanted, c.desired, c.remote); err != nil {
+			klog.Errorf("applying plan for zone %q with %s failed, %v", c.zp.Zone, c.p.Name, err)
+			failed = append(failed, fmt.Sprintf("%s (%s)", c.zp.Zone, c.p.Name))
+			continue
+		}
+		klog.Infof("applied plan for zone %q with %s", c.zp.Zone, c.p.Name)
+	}
+	if len(failed) != 0 {
+		return fmt.Errorf("failed to apply plan for zones %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
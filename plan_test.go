@@ -0,0 +1,167 @@
+package dubber
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestServerPlanApply(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("failed writing %s, %v", name, err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "discovered"), 0755); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	write("discovered/records.zone", `
+www.example.com. 300 IN A 10.0.0.1
+api.example.com. 300 IN A 10.0.0.2 ; owner=me
+`)
+	zonePath := filepath.Join(dir, "example.com.zone")
+	write("example.com.zone", `
+example.com. 3600 IN SOA ns1.example.com. root.example.com. 100 3600 1800 604800 86400
+www.example.com. 300 IN A 10.0.0.100
+`)
+
+	cfg, err := FromYAML(strings.NewReader(`
+discoverers:
+  files:
+    - path: ` + filepath.Join(dir, "discovered") + `
+provisioners:
+  zonefile:
+    - zone: example.com.
+      path: ` + zonePath + `
+`))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	srv := New(&cfg)
+
+	before, _ := os.ReadFile(zonePath)
+	plan, err := srv.Plan(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if after, _ := os.ReadFile(zonePath); !bytes.Equal(before, after) {
+		t.Fatalf("expected plan not to change the zone")
+	}
+
+	// The plan survives a round trip through JSON
+	bs, err := json.Marshal(plan)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	plan, err = ReadPlan(bytes.NewReader(bs))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	if len(plan.Zones) != 1 {
+		t.Fatalf("expected 1 zone in plan, got %d", len(plan.Zones))
+	}
+	zp := plan.Zones[0]
+	if zp.Zone != "example.com." || zp.Provisioner != "zonefile/0" || zp.Serial != 100 {
+		t.Fatalf("unexpected plan %+v", zp)
+	}
+	if got, exp := strings.Join(zp.Wanted, "\n"), "api.example.com.\t300\tIN\tA\t10.0.0.2 ; owner=me\nexample.com.\t3600\tIN\tSOA\tns1.example.com. root.example.com. 101 3600 1800 604800 86400\nwww.example.com.\t300\tIN\tA\t10.0.0.1"; got != exp {
+		t.Fatalf("\n  expected wanted:\n%s\n  got:\n%s", exp, got)
+	}
+
+	if err := srv.Apply(plan); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	f, err := NewZoneFile(&ZoneFileConfig{Path: zonePath})
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	remz, err := f.RemoteZone()
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	sort.Sort(ByRR(remz))
+	if got, exp := remz.String(), strings.Join(zp.Wanted, "\n"); got != exp {
+		t.Fatalf("\n  expected:\n%s\n  got:\n%s", exp, got)
+	}
+
+	// The serial has moved on, so the plan is refused
+	if err := srv.Apply(plan); err == nil || !strings.Contains(err.Error(), "has changed from 100 to 101") {
+		t.Fatalf("expected stale plan to be refused, got %v", err)
+	}
+}
+
+func TestServerPlanApply_Blocked(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("failed writing %s, %v", name, err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "discovered"), 0755); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	write("discovered/records.zone", `
+www.example.com. 300 IN A 10.0.0.1
+www.example.org. 300 IN A 10.0.0.1
+`)
+	write("example.com.zone", `
+example.com. 3600 IN SOA ns1.example.com. root.example.com. 100 3600 1800 604800 86400
+www.example.com. 300 IN A 10.0.0.100
+`)
+	write("example.org.zone", `
+example.org. 3600 IN SOA ns1.example.org. root.example.org. 100 3600 1800 604800 86400
+www.example.org. 300 IN A 10.0.0.100
+`)
+
+	cfg, err := FromYAML(strings.NewReader(`
+discoverers:
+  files:
+    - path: ` + filepath.Join(dir, "discovered") + `
+provisioners:
+  zonefile:
+    - zone: example.com.
+      path: ` + filepath.Join(dir, "example.com.zone") + `
+    - zone: example.org.
+      path: ` + filepath.Join(dir, "example.org.zone") + `
+      safety:
+        maxChanges: 1
+`))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	srv := New(&cfg)
+
+	plan, err := srv.Plan(context.Background())
+	if err != nil {
+		t.Fatalf("expected a blocked zone not to fail the plan, got %v", err)
+	}
+	if len(plan.Zones) != 2 {
+		t.Fatalf("expected 2 zones in plan, got %d", len(plan.Zones))
+	}
+	if zp := plan.Zones[0]; zp.Zone != "example.com." || zp.Blocked != "" {
+		t.Fatalf("unexpected plan %+v", zp)
+	}
+	if zp := plan.Zones[1]; zp.Zone != "example.org." || !strings.Contains(zp.Blocked, "would change 2 records") || len(zp.Unwanted) != 1 {
+		t.Fatalf("expected example.org. to be blocked, got %+v", zp)
+	}
+
+	before, _ := os.ReadFile(filepath.Join(dir, "example.org.zone"))
+	if err := srv.Apply(plan); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if after, _ := os.ReadFile(filepath.Join(dir, "example.org.zone")); !bytes.Equal(before, after) {
+		t.Fatalf("expected the blocked zone not to be changed")
+	}
+	if bs, _ := os.ReadFile(filepath.Join(dir, "example.com.zone")); !strings.Contains(string(bs), "10.0.0.1\n") {
+		t.Fatalf("expected example.com. to be updated, got\n%s", bs)
+	}
+}
@@ -0,0 +1,330 @@
+// Copyright 2017 Qubit Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dubber
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	klog "k8s.io/klog/v2"
+)
+
+// PowerDNSConfig describes the settings required for managing a zone on a
+// PowerDNS Authoritative server, via its HTTP API.
+type PowerDNSConfig struct {
+	BaseProvisionerConfig `json:",omitempty,inline" yaml:",omitempty,inline"`
+	// URL is the base URL of the API, e.g. http://pdns.example.com:8081
+	URL    string `yaml:"url" json:"url"`
+	APIKey string `yaml:"apiKey" json:"apiKey"`
+	// Server is the server ID, defaults to localhost.
+	Server  string          `yaml:"server" json:"server"`
+	TLS     TLSClientConfig `yaml:"tls" json:"tls"`
+	Timeout time.Duration   `yaml:"timeout" json:"timeout"`
+}
+
+// PowerDNS is a provisioner for the PowerDNS Authoritative HTTP API.
+// This provision uses the following flags:
+//   - powerdns.Comment: A comment on the record's RRset
+//   - powerdns.Account: The account for the comment
+//   - powerdns.Disabled: Create the record, but disabled
+//
+// Whitespace and % in comments and accounts are percent encoded, e.g.
+// powerdns.Comment=managed%20by%20dubber.
+type PowerDNS struct {
+	*PowerDNSConfig
+	client *http.Client
+}
+
+type pdnsZone struct {
+	Name   string      `json:"name"`
+	Serial uint32      `json:"serial"`
+	RRSets []pdnsRRSet `json:"rrsets"`
+}
+
+type pdnsRRSet struct {
+	Name       string        `json:"name"`
+	Type       string        `json:"type"`
+	TTL        uint32        `json:"ttl,omitempty"`
+	ChangeType string        `json:"changetype,omitempty"`
+	Records    []pdnsRecord  `json:"records"`
+	Comments   []pdnsComment `json:"comments"`
+}
+
+type pdnsRecord struct {
+	Content  string `json:"content"`
+	Disabled bool   `json:"disabled"`
+}
+
+type pdnsComment struct {
+	Content string `json:"content"`
+	Account string `json:"account"`
+}
+
+// NewPowerDNS creates a PowerDNS provisioner.
+func NewPowerDNS(cfg *PowerDNSConfig) (*PowerDNS, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("powerdns url must be set")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.TLS.enabled() {
+		tlsCfg, err := cfg.TLS.build()
+		if err != nil {
+			return nil, fmt.Errorf("invalid powerdns tls config, %w", err)
+		}
+		transport.TLSClientConfig = tlsCfg
+	}
+
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+
+	return &PowerDNS{
+		PowerDNSConfig: cfg,
+		client:         &http.Client{Transport: transport, Timeout: timeout},
+	}, nil
+}
+
+// GroupFlags is empty for PowerDNS
+func (p *PowerDNS) GroupFlags() []string {
+	return nil
+}
+
+func (p *PowerDNS) zoneURL() string {
+	server := p.Server
+	if server == "" {
+		server = "localhost"
+	}
+	return fmt.Sprintf("%s/api/v1/servers/%s/zones/%s",
+		strings.TrimSuffix(p.URL, "/"),
+		url.PathEscape(server),
+		url.PathEscape(dns.Fqdn(p.Zone)))
+}
+
+func (p *PowerDNS) do(method string, body interface{}, out interface{}) error {
+	var rdr io.Reader
+	if body != nil {
+		bs, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rdr = bytes.NewReader(bs)
+	}
+
+	req, err := http.NewRequestWithContext(context.Background(), method, p.zoneURL(), rdr)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-API-Key", p.APIKey)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var perr struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&perr)
+		return fmt.Errorf("%s %s, %s %s", method, p.zoneURL(), resp.Status, perr.Error)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// RemoteZone creates a Zone from a PowerDNS zone.
+func (p *PowerDNS) RemoteZone() (Zone, error) {
+	var pz pdnsZone
+	if err := p.do(http.MethodGet, nil, &pz); err != nil {
+		return nil, fmt.Errorf("could not read zone %s, %w", p.Zone, err)
+	}
+
+	var z Zone
+	for _, rs := range pz.RRSets {
+		rrs, err := pdnsRRSetToRecords(rs)
+		if err != nil {
+			return nil, err
+		}
+		z = append(z, rrs...)
+	}
+
+	sort.Sort(ByRR(z))
+
+	return z, nil
+}
+
+func pdnsRRSetToRecords(rs pdnsRRSet) (Zone, error) {
+	flags := RecordFlags{}
+	if len(rs.Comments) != 0 {
+		flags["powerdns.Comment"] = escapeFlagValue(rs.Comments[0].Content)
+		if rs.Comments[0].Account != "" {
+			flags["powerdns.Account"] = escapeFlagValue(rs.Comments[0].Account)
+		}
+	}
+
+	var z Zone
+	for _, r := range rs.Records {
+		str := fmt.Sprintf("%s %d IN %s %s", rs.Name, rs.TTL, rs.Type, r.Content)
+		rr, err := dns.NewRR(str)
+		if err != nil {
+			klog.Infof("failed parsing record %q, %v", str, err)
+			continue
+		}
+
+		rflags := RecordFlags{}
+		for k, v := range flags {
+			rflags[k] = v
+		}
+		if r.Disabled {
+			rflags["powerdns.Disabled"] = ""
+		}
+		if len(rflags) == 0 {
+			rflags = nil
+		}
+		z = append(z, &Record{RR: rr, Flags: rflags})
+	}
+	return z, nil
+}
+
+func recordsToPDNSRRSet(key RecordSetKey, z Zone) (pdnsRRSet, error) {
+	rrtype, ok := dns.TypeToString[key.Rrtype]
+	if !ok {
+		return pdnsRRSet{}, fmt.Errorf("unknown dns.Rtype %d", key.Rrtype)
+	}
+	rs := pdnsRRSet{
+		Name:     key.Name,
+		Type:     rrtype,
+		Records:  []pdnsRecord{},
+		Comments: []pdnsComment{},
+	}
+	if len(z) == 0 {
+		rs.ChangeType = "DELETE"
+		return rs, nil
+	}
+
+	rs.ChangeType = "REPLACE"
+	rs.TTL = z[0].Header().Ttl
+	for _, r := range z {
+		_, disabled := r.Flags["powerdns.Disabled"]
+		rs.Records = append(rs.Records, pdnsRecord{
+			Content:  r.RR.String()[len(r.Header().String()):],
+			Disabled: disabled,
+		})
+		if c, ok := r.Flags["powerdns.Comment"]; ok && len(rs.Comments) == 0 {
+			rs.Comments = append(rs.Comments, pdnsComment{
+				Content: unescapeFlagValue(c),
+				Account: unescapeFlagValue(r.Flags["powerdns.Account"]),
+			})
+		}
+	}
+	return rs, nil
+}
+
+// UpdateZone updates a PowerDNS zone. The RRsets containing wanted or
+// unwanted records are replaced with their new contents, or deleted if
+// no records remain. The PowerDNS API has no conditional updates, so the
+// SOA serial is checked immediately before the changes are sent.
+func (p *PowerDNS) UpdateZone(wanted, unwanted, desired, remote Zone) error {
+	var soa *dns.SOA
+	for _, uw := range unwanted {
+		if s, ok := uw.RR.(*dns.SOA); ok {
+			soa = s
+		}
+	}
+	if soa == nil {
+		return fmt.Errorf("no SOA record to update for zone %s", p.Zone)
+	}
+
+	rgs := remote.Group(p.GroupFlags())
+	wgs := wanted.Group(p.GroupFlags())
+	ugs := unwanted.Group(p.GroupFlags())
+
+	keys := map[RecordSetKey]struct{}{}
+	for k := range wgs {
+		keys[k] = struct{}{}
+	}
+	for k := range ugs {
+		keys[k] = struct{}{}
+	}
+
+	var patch struct {
+		RRSets []pdnsRRSet `json:"rrsets"`
+	}
+	for key := range keys {
+		var recs Zone
+	nextRecord:
+		for _, r := range rgs[key] {
+			for _, u := range ugs[key] {
+				if r.Compare(u) == 0 {
+					continue nextRecord
+				}
+			}
+			recs = append(recs, r)
+		}
+		recs = append(recs, wgs[key]...)
+		sort.Sort(ByRR(recs))
+		recs = Zone(ByRR(recs).Dedupe())
+
+		rs, err := recordsToPDNSRRSet(key, recs)
+		if err != nil {
+			return fmt.Errorf("generating rrset for %s, %w", key.Name, err)
+		}
+		klog.V(1).Infof("powerdns %s: %s %s", rs.ChangeType, rs.Name, rs.Type)
+		patch.RRSets = append(patch.RRSets, rs)
+	}
+	sort.Slice(patch.RRSets, func(i, j int) bool {
+		if patch.RRSets[i].Name != patch.RRSets[j].Name {
+			return patch.RRSets[i].Name < patch.RRSets[j].Name
+		}
+		return patch.RRSets[i].Type < patch.RRSets[j].Type
+	})
+
+	cur, err := p.RemoteZone()
+	if err != nil {
+		return err
+	}
+	for _, r := range cur {
+		if s, ok := r.RR.(*dns.SOA); ok && s.Serial != soa.Serial {
+			return fmt.Errorf("zone %s serial has changed from %d to %d", p.Zone, soa.Serial, s.Serial)
+		}
+	}
+
+	if err := p.do(http.MethodPatch, patch, nil); err != nil {
+		return fmt.Errorf("updating zone %s, %w", p.Zone, err)
+	}
+
+	klog.V(1).Infof("Change succeeded")
+
+	return nil
+}
@@ -0,0 +1,206 @@
+package dubber
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// testPowerDNSServer is a minimal stand-in for the PowerDNS zone API.
+type testPowerDNSServer struct {
+	t *testing.T
+	sync.Mutex
+	zone    pdnsZone
+	patches int
+}
+
+func (s *testPowerDNSServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	if r.Header.Get("X-API-Key") != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Unauthorized"})
+		return
+	}
+	if r.URL.Path != "/api/v1/servers/localhost/zones/example.com." {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(s.zone)
+	case http.MethodPatch:
+		var patch struct {
+			RRSets []pdnsRRSet `json:"rrsets"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.patches++
+		for _, prs := range patch.RRSets {
+			var rrsets []pdnsRRSet
+			for _, rs := range s.zone.RRSets {
+				if rs.Name != prs.Name || rs.Type != prs.Type {
+					rrsets = append(rrsets, rs)
+				}
+			}
+			switch prs.ChangeType {
+			case "REPLACE":
+				prs.ChangeType = ""
+				rrsets = append(rrsets, prs)
+			case "DELETE":
+			default:
+				s.t.Errorf("unexpected changetype %q", prs.ChangeType)
+			}
+			s.zone.RRSets = rrsets
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestPowerDNSReconcile(t *testing.T) {
+	h := &testPowerDNSServer{t: t}
+	h.zone.Name = "example.com."
+	h.zone.RRSets = []pdnsRRSet{
+		{Name: "example.com.", Type: "SOA", TTL: 3600, Records: []pdnsRecord{{Content: "ns1.example.com. root.example.com. 100 3600 1800 6048 8640"}}},
+		{Name: "example.com.", Type: "NS", TTL: 3600, Records: []pdnsRecord{{Content: "ns1.example.com."}}},
+		{Name: "thing.example.com.", Type: "A", TTL: 10, Records: []pdnsRecord{{Content: "6.6.6.6"}, {Content: "8.8.8.8"}}},
+		{Name: "old.example.com.", Type: "A", TTL: 10, Records: []pdnsRecord{{Content: "5.5.5.5"}}},
+	}
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	cfg := &PowerDNSConfig{URL: ts.URL, APIKey: "secret"}
+	cfg.Zone = "example.com."
+	p, err := NewPowerDNS(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	desired, err := ParseZoneData(bytes.NewBufferString(`
+thing.example.com. 10 IN A 7.7.7.7 ; powerdns.Comment=dubber
+thing.example.com. 10 IN A 8.8.8.8 ; powerdns.Comment=dubber
+new.example.com. 10 IN A 1.1.1.1 ; powerdns.Disabled
+`))
+	if err != nil {
+		t.Fatalf("error parsing desired zone, %v", err)
+	}
+
+	var srv *Server
+	if err := srv.ReconcileZone(p, desired); err != nil {
+		t.Fatalf("error reconciling zone, %v", err)
+	}
+
+	got, err := p.RemoteZone()
+	if err != nil {
+		t.Fatalf("error reading remote zone, %v", err)
+	}
+
+	exp := `example.com.	3600	IN	NS	ns1.example.com.
+example.com.	3600	IN	SOA	ns1.example.com. root.example.com. 101 3600 1800 6048 8640
+new.example.com.	10	IN	A	1.1.1.1 ; powerdns.Disabled
+old.example.com.	10	IN	A	5.5.5.5
+thing.example.com.	10	IN	A	7.7.7.7 ; powerdns.Comment=dubber
+thing.example.com.	10	IN	A	8.8.8.8 ; powerdns.Comment=dubber`
+	if got.String() != exp {
+		t.Fatalf("\n  expected:\n%s\n  got:\n%s", exp, got)
+	}
+
+	// Nothing left to do
+	if err := srv.ReconcileZone(p, desired); err != nil {
+		t.Fatalf("error reconciling zone, %v", err)
+	}
+	if h.patches != 1 {
+		t.Fatalf("expected 1 patch, got %d", h.patches)
+	}
+
+	// Removing the last record of an RRset deletes it
+	var unwanted, wanted Zone
+	for _, r := range got {
+		switch r.Header().Name {
+		case "example.com.":
+			if soa, ok := r.RR.(*dns.SOA); ok {
+				newsoa := *soa
+				newsoa.Serial++
+				wanted = append(wanted, &Record{RR: &newsoa})
+				unwanted = append(unwanted, r)
+			}
+		case "new.example.com.":
+			unwanted = append(unwanted, r)
+		}
+	}
+	if err := p.UpdateZone(wanted, unwanted, desired, got); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	for _, rs := range h.zone.RRSets {
+		if rs.Name == "new.example.com." {
+			t.Fatalf("expected new.example.com. rrset to be deleted, got %v", rs)
+		}
+	}
+
+	// An update based on a stale SOA must be refused
+	if err := p.UpdateZone(wanted, unwanted, desired, got); err == nil {
+		t.Fatalf("expected update with stale SOA to fail")
+	}
+}
+
+func TestPowerDNSReconcile_Comment(t *testing.T) {
+	h := &testPowerDNSServer{t: t}
+	h.zone.Name = "example.com."
+	h.zone.RRSets = []pdnsRRSet{
+		{Name: "example.com.", Type: "SOA", TTL: 3600, Records: []pdnsRecord{{Content: "ns1.example.com. root.example.com. 100 3600 1800 6048 8640"}}},
+		{
+			Name: "thing.example.com.", Type: "A", TTL: 10,
+			Records:  []pdnsRecord{{Content: "8.8.8.8"}},
+			Comments: []pdnsComment{{Content: "managed by the ops team", Account: "ops"}},
+		},
+	}
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	cfg := &PowerDNSConfig{URL: ts.URL, APIKey: "secret"}
+	cfg.Zone = "example.com."
+	p, err := NewPowerDNS(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	parse := func(str string) Zone {
+		z, err := ParseZoneData(bytes.NewBufferString(str))
+		if err != nil {
+			t.Fatalf("error parsing desired zone, %v", err)
+		}
+		return z
+	}
+
+	// The existing comment round trips, so there is nothing to do
+	var srv *Server
+	if err := srv.ReconcileZone(p, parse(`thing.example.com. 10 IN A 8.8.8.8 ; powerdns.Comment=managed%20by%20the%20ops%20team powerdns.Account=ops`)); err != nil {
+		t.Fatalf("error reconciling zone, %v", err)
+	}
+	if h.patches != 0 {
+		t.Fatalf("expected no patches, got %d", h.patches)
+	}
+
+	if err := srv.ReconcileZone(p, parse(`thing.example.com. 10 IN A 8.8.8.8 ; powerdns.Comment=100%25%20managed%20by%20dubber`)); err != nil {
+		t.Fatalf("error reconciling zone, %v", err)
+	}
+	for _, rs := range h.zone.RRSets {
+		if rs.Name != "thing.example.com." {
+			continue
+		}
+		if len(rs.Comments) != 1 || rs.Comments[0].Content != "100% managed by dubber" {
+			t.Fatalf("unexpected comments %+v", rs.Comments)
+		}
+	}
+}
@@ -15,6 +15,7 @@
 package dubber
 
 import (
+	"errors"
 	"fmt"
 	"regexp"
 	"sort"
@@ -29,12 +30,68 @@ import (
 // Zone retuned by RemoteZone, UpdateZone will be called with the relevant
 // changes, plus an update to the SOA record. It is assumed that an update
 // will fail if the SOA serial from the remote list does not match the
-// SOA of the current remote zone state.
+// SOA of the current remote zone state. Registry returns the optional
+// ownership registry for the zone, and Safety the optional limits on
+// changes to the zone, either of which may be nil.
 type Provisioner interface {
 	RemoteZone() (Zone, error)
 	UpdateZone(wanted, unwanted, desired, remote Zone) error
 	GroupFlags() []string
 	OwnerFlags() (map[string]*regexp.Regexp, error)
+	Registry() (*Registry, error)
+	Safety() (*Safety, error)
+}
+
+// A NamedProvisioner is a Provisioner, with a name identifying it in logs
+// and metrics.
+type NamedProvisioner struct {
+	Name string
+	Provisioner
+}
+
+// A recordNormaliser rewrites desired records into the form in which the
+// remote zone will report them, e.g. with values the provider enforces, so
+// that equivalent records compare equal.
+type recordNormaliser interface {
+	normaliseRecord(r *Record) *Record
+}
+
+// unwrapProvisioner returns the provisioner wrapped by any
+// NamedProvisioner or dryRunProvisioner.
+func unwrapProvisioner(p Provisioner) Provisioner {
+	for {
+		switch wp := p.(type) {
+		case NamedProvisioner:
+			p = wp.Provisioner
+		case dryRunProvisioner:
+			p = wp.real
+		default:
+			return p
+		}
+	}
+}
+
+// zonePlan returns the plan that p records its changes in, if it is a
+// dryRunProvisioner making a plan.
+func zonePlan(p Provisioner) *ZonePlan {
+	for {
+		switch wp := p.(type) {
+		case NamedProvisioner:
+			p = wp.Provisioner
+		case dryRunProvisioner:
+			return wp.plan
+		default:
+			return nil
+		}
+	}
+}
+
+// provisionerName returns the name of p, if it is a NamedProvisioner.
+func provisionerName(p Provisioner) string {
+	if np, ok := p.(NamedProvisioner); ok {
+		return np.Name
+	}
+	return ""
 }
 
 // ReconcileZone attempts to ensure that the set of records in the desired
@@ -46,6 +103,11 @@ type Provisioner interface {
 //     remote zone, but not in the desired zone are removed.
 //   - Records of a given "Name, Type , Class" combination that are in the
 //     desired zone, but not in the remote zone are added.
+//   - If an ownership registry is configured, record sets owned by another
+//     owner are left untouched, and a registry record is maintained for
+//     each of the desired record sets.
+//   - If safety limits are configured, updates exceeding them are refused
+//     unless overridden.
 func (srv *Server) ReconcileZone(p Provisioner, desired Zone) error {
 	remz, err := p.RemoteZone()
 	if err != nil {
@@ -74,7 +136,28 @@ func (srv *Server) ReconcileZone(p Provisioner, desired Zone) error {
 	}
 
 	if srv != nil {
-		srv.MetricDiscoveredZoneSerial.WithLabelValues(soa.Header().Name).Set(float64(soa.Serial))
+		srv.MetricDiscoveredZoneSerial.WithLabelValues(soa.Header().Name, provisionerName(p)).Set(float64(soa.Serial))
+	}
+
+	reg, err := p.Registry()
+	if err != nil {
+		return err
+	}
+	var owners map[string]string
+	if reg != nil {
+		desired, err = reg.withOwnership(desired, remz)
+		if err != nil {
+			return err
+		}
+		owners, _ = reg.owners(remz)
+	}
+
+	if n, ok := unwrapProvisioner(p).(recordNormaliser); ok {
+		nz := make(Zone, len(desired))
+		for i, r := range desired {
+			nz[i] = n.normaliseRecord(r)
+		}
+		desired = nz
 	}
 
 	dgroups := desired.Group(p.GroupFlags())
@@ -99,37 +182,35 @@ func (srv *Server) ReconcileZone(p Provisioner, desired Zone) error {
 		allWanted = append(allWanted, wanted...)
 	}
 
-	// unused remote groups
+	// unused remote groups, these are only removed if they are owned by
+	// us according to the owner flags and registry, whichever are
+	// configured. Registry records are owned according to their contents.
+	//
+	// We can ignore the error here because we've already
+	// parsed these from config
+	oflags, _ := p.OwnerFlags()
 	var unusedGroups []RecordSetKey
 	for rgroupKey := range rgroups {
 		_, ok := dgroups[rgroupKey]
 		if ok {
 			continue
 		}
-		// We can ignore the error here because this string
-		// was produced by us and so should always be valid
-		fs, _ := ParseRecordFlags(rgroupKey.GroupFlags)
-		matches := 0
-
-		// We can ignore the error here because we've already
-		// parsed these from config
-		oflags, _ := p.OwnerFlags()
-		if len(oflags) == 0 {
+		switch {
+		case reg != nil && rgroupKey.Rrtype == dns.TypeTXT && reg.isRegistryName(rgroupKey.Name):
+			if !reg.owns(rgroupKey, owners) {
+				continue
+			}
+		case len(oflags) == 0 && reg == nil:
 			continue
-		}
-		for k, rx := range oflags {
-			for fk, fv := range fs {
-				if k != fk {
-					continue
-				}
-				if rx.MatchString(fv) {
-					matches += 1
-				}
+		default:
+			if len(oflags) != 0 && !ownerFlagsMatch(oflags, rgroupKey) {
+				continue
+			}
+			if reg != nil && !reg.owns(rgroupKey, owners) {
+				continue
 			}
 		}
-		if matches != 0 && matches == len(oflags) {
-			unusedGroups = append(unusedGroups, rgroupKey)
-		}
+		unusedGroups = append(unusedGroups, rgroupKey)
 	}
 
 	for _, unusedGroupKey := range unusedGroups {
@@ -137,6 +218,20 @@ func (srv *Server) ReconcileZone(p Provisioner, desired Zone) error {
 		allUnwanted = append(allUnwanted, rgroup...)
 	}
 
+	// Checked even if there is nothing to do, so that a blocked update
+	// that has since been reverted is no longer reported.
+	if err := srv.checkSafety(p, soa.Header().Name, remz, allWanted, allUnwanted); err != nil {
+		// Plans record the blocked changes, so that one blocked zone
+		// does not prevent the rest being planned.
+		if zp := zonePlan(p); zp != nil && errors.Is(err, errSafetyLimits) {
+			klog.Warningf("zone %s is blocked, %v", soa.Header().Name, err)
+			zp.record(allWanted, allUnwanted, desired, remz)
+			zp.Blocked = err.Error()
+			return nil
+		}
+		return err
+	}
+
 	if len(allWanted) == 0 && len(allUnwanted) == 0 {
 		klog.V(1).Info("nothing to do")
 		return nil
@@ -150,13 +245,36 @@ func (srv *Server) ReconcileZone(p Provisioner, desired Zone) error {
 
 	err = p.UpdateZone(allWanted, allUnwanted, desired, remz)
 	if err == nil && srv != nil {
-		srv.MetricProvisionedZoneSerial.WithLabelValues(soa.Header().Name).Set(float64(soa.Serial))
+		srv.MetricProvisionedZoneSerial.WithLabelValues(soa.Header().Name, provisionerName(p)).Set(float64(soa.Serial))
 	}
 	return err
 }
 
+// ownerFlagsMatch returns true if every owner flag is set on the group,
+// and matches its regexp.
+func ownerFlagsMatch(oflags map[string]*regexp.Regexp, key RecordSetKey) bool {
+	// We can ignore the error here because this string
+	// was produced by us and so should always be valid
+	fs, _ := ParseRecordFlags(key.GroupFlags)
+	matches := 0
+	for k, rx := range oflags {
+		for fk, fv := range fs {
+			if k != fk {
+				continue
+			}
+			if rx.MatchString(fv) {
+				matches += 1
+			}
+		}
+	}
+	return matches != 0 && matches == len(oflags)
+}
+
+// dryRunProvisioner logs the changes that would be made to a zone, rather
+// than making them. If plan is set, the changes are also recorded there.
 type dryRunProvisioner struct {
 	real Provisioner
+	plan *ZonePlan
 }
 
 func (p dryRunProvisioner) GroupFlags() []string {
@@ -167,6 +285,14 @@ func (p dryRunProvisioner) OwnerFlags() (map[string]*regexp.Regexp, error) {
 	return p.real.OwnerFlags()
 }
 
+func (p dryRunProvisioner) Registry() (*Registry, error) {
+	return p.real.Registry()
+}
+
+func (p dryRunProvisioner) Safety() (*Safety, error) {
+	return p.real.Safety()
+}
+
 func (p dryRunProvisioner) RemoteZone() (Zone, error) {
 	return p.real.RemoteZone()
 }
@@ -174,5 +300,8 @@ func (p dryRunProvisioner) RemoteZone() (Zone, error) {
 func (p dryRunProvisioner) UpdateZone(allWanted, allUnwanted, desired, remote Zone) error {
 	klog.V(0).Info("Unwanted records to be removed:\n", allUnwanted)
 	klog.V(0).Info("Wanted records to be added:\n", allWanted)
+	if p.plan != nil {
+		p.plan.record(allWanted, allUnwanted, desired, remote)
+	}
 	return nil
 }
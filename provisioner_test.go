@@ -12,12 +12,15 @@ type tpChange struct {
 }
 
 type testProvisioner struct {
-	t  *testing.T
-	rz Zone
-	of map[string]*regexp.Regexp
+	t       *testing.T
+	rz      Zone
+	of      map[string]*regexp.Regexp
+	safety  *Safety
+	updates int
 }
 
 func (tp *testProvisioner) UpdateZone(wanted, unwanted, desired, remote Zone) error {
+	tp.updates++
 	tp.t.Logf("wanted:\n%s", wanted)
 	tp.t.Logf("unwanted:\n%s", unwanted)
 	tp.t.Logf("desired:\n%s", desired)
@@ -33,6 +36,14 @@ func (tp *testProvisioner) OwnerFlags() (map[string]*regexp.Regexp, error) {
 	return tp.of, nil
 }
 
+func (tp *testProvisioner) Registry() (*Registry, error) {
+	return nil, nil
+}
+
+func (tp *testProvisioner) Safety() (*Safety, error) {
+	return tp.safety, nil
+}
+
 func (tp *testProvisioner) RemoteZone() (Zone, error) {
 	return tp.rz, nil
 }
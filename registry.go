@@ -0,0 +1,231 @@
+// Copyright 2017 Qubit Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dubber
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+	klog "k8s.io/klog/v2"
+)
+
+// RegistryConfig configures an ownership registry. The owner of each record
+// set managed by dubber is recorded in a companion TXT record, named
+// PREFIX.TYPE.NAME, e.g. _dubber.a.www.example.com. for the A records of
+// www.example.com.
+type RegistryConfig struct {
+	// OwnerID identifies this instance of dubber, the registry is only
+	// used if it is set.
+	OwnerID string `yaml:"ownerID" json:"ownerID"`
+	// Prefix is prepended to the names of the TXT records, defaults to
+	// "_dubber."
+	Prefix string `yaml:"prefix" json:"prefix"`
+	// EncryptionKey is an optional base64 encoded 16, 24 or 32 byte AES
+	// key, used to encrypt the contents of the TXT records.
+	EncryptionKey string `yaml:"encryptionKey" json:"encryptionKey"`
+}
+
+// Registry records the owners of record sets in TXT records.
+type Registry struct {
+	ownerID string
+	prefix  string
+	aead    cipher.AEAD
+}
+
+func (rc RegistryConfig) build() (*Registry, error) {
+	if rc.OwnerID == "" {
+		return nil, nil
+	}
+	if strings.ContainsAny(rc.OwnerID, ", \"") {
+		return nil, fmt.Errorf("registry ownerID may not contain spaces, commas or quotes")
+	}
+
+	reg := &Registry{
+		ownerID: rc.OwnerID,
+		prefix:  strings.ToLower(rc.Prefix),
+	}
+	if reg.prefix == "" {
+		reg.prefix = "_dubber."
+	}
+	if !strings.HasSuffix(reg.prefix, ".") {
+		reg.prefix += "."
+	}
+
+	if rc.EncryptionKey != "" {
+		key, err := base64.StdEncoding.DecodeString(rc.EncryptionKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid registry encryption key, %w", err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid registry encryption key, %w", err)
+		}
+		if reg.aead, err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	return reg, nil
+}
+
+// name returns the name of the TXT record holding the owner of the record
+// set with the given name and type. Wildcards become a "wildcard" label, as
+// a * may only be the first label of a name.
+func (reg *Registry) name(name string, rrtype uint16) string {
+	name = strings.ToLower(name)
+	if strings.HasPrefix(name, "*.") {
+		name = "wildcard." + name[2:]
+	}
+	return reg.prefix + strings.ToLower(dns.TypeToString[rrtype]) + "." + name
+}
+
+// isRegistryName returns true if name is the name of a registry record.
+func (reg *Registry) isRegistryName(name string) bool {
+	return strings.HasPrefix(strings.ToLower(name), reg.prefix)
+}
+
+func (reg *Registry) encode() (string, error) {
+	val := "heritage=dubber,dubber/owner=" + reg.ownerID
+	if reg.aead == nil {
+		return val, nil
+	}
+	nonce := make([]byte, reg.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(reg.aead.Seal(nonce, nonce, []byte(val), nil)), nil
+}
+
+// owner returns the owner recorded in a registry TXT record.
+func (reg *Registry) owner(r *Record) (string, bool) {
+	txt, ok := r.RR.(*dns.TXT)
+	if !ok {
+		return "", false
+	}
+	val := strings.Join(txt.Txt, "")
+	if reg.aead != nil {
+		if bs, err := base64.StdEncoding.DecodeString(val); err == nil && len(bs) > reg.aead.NonceSize() {
+			n := reg.aead.NonceSize()
+			if pt, err := reg.aead.Open(nil, bs[:n], bs[n:], nil); err == nil {
+				val = string(pt)
+			}
+		}
+	}
+
+	var heritage bool
+	var owner string
+	for _, kv := range strings.Split(val, ",") {
+		switch {
+		case kv == "heritage=dubber":
+			heritage = true
+		case strings.HasPrefix(kv, "dubber/owner="):
+			owner = strings.TrimPrefix(kv, "dubber/owner=")
+		}
+	}
+	if !heritage || owner == "" {
+		return "", false
+	}
+	return owner, true
+}
+
+// owners returns the owner recorded for each registry record in the zone,
+// keyed by the registry record name, along with the registry records
+// owned by this registry. A TXT record at a registry name that we cannot
+// read, e.g. as it is encrypted with another key, belongs to an unknown
+// owner, recorded as "". So do names with conflicting registry records.
+func (reg *Registry) owners(z Zone) (map[string]string, map[string]*Record) {
+	owners := map[string]string{}
+	records := map[string]*Record{}
+	for _, r := range z {
+		name := strings.ToLower(r.Header().Name)
+		if r.Header().Rrtype != dns.TypeTXT || !reg.isRegistryName(name) {
+			continue
+		}
+		owner, _ := reg.owner(r)
+		if cur, ok := owners[name]; ok && cur != owner {
+			owner = ""
+		}
+		owners[name] = owner
+		records[name] = r
+	}
+
+	ours := map[string]*Record{}
+	for name, owner := range owners {
+		if owner == reg.ownerID {
+			ours[name] = records[name]
+		}
+	}
+	return owners, ours
+}
+
+// withOwnership adds a registry record for each record set in the desired
+// zone, and drops any record sets owned by another owner. The registry
+// records already in the remote zone are reused, so that encrypted
+// records are not needlessly rewritten.
+func (reg *Registry) withOwnership(desired, remote Zone) (Zone, error) {
+	owners, ours := reg.owners(remote)
+
+	var z Zone
+	added := map[string]bool{}
+	for _, r := range desired {
+		hdr := r.Header()
+		if reg.isRegistryName(hdr.Name) {
+			klog.Infof("ignoring desired record %s, the name is reserved for the ownership registry", r)
+			continue
+		}
+
+		name := reg.name(hdr.Name, hdr.Rrtype)
+		if owner, ok := owners[name]; ok && owner != reg.ownerID {
+			if owner == "" {
+				owner = "an unknown owner"
+			}
+			klog.V(1).Infof("ignoring desired record %s, owned by %s", r, owner)
+			continue
+		}
+		z = append(z, r)
+
+		if added[name] {
+			continue
+		}
+		added[name] = true
+
+		if cur, ok := ours[name]; ok {
+			z = append(z, cur)
+			continue
+		}
+		val, err := reg.encode()
+		if err != nil {
+			return nil, err
+		}
+		z = append(z, &Record{RR: &dns.TXT{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: hdr.Ttl},
+			Txt: []string{val},
+		}})
+	}
+	return z, nil
+}
+
+// owns returns true if the remote record set is owned by this registry.
+func (reg *Registry) owns(key RecordSetKey, owners map[string]string) bool {
+	name := strings.ToLower(key.Name)
+	if key.Rrtype == dns.TypeTXT && reg.isRegistryName(name) {
+		return owners[name] == reg.ownerID
+	}
+	return owners[reg.name(name, key.Rrtype)] == reg.ownerID
+}
@@ -0,0 +1,170 @@
+package dubber
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRegistryReconcile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "example.com.zone")
+	err := os.WriteFile(path, []byte(`
+example.com. 3600 IN SOA ns1.example.com. root.example.com. 100 3600 1800 604800 86400
+manual.example.com. 300 IN A 10.0.0.100
+`), 0644)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	newProv := func(owner, key string) *ZoneFile {
+		cfg := &ZoneFileConfig{Path: path}
+		cfg.Zone = "example.com."
+		cfg.RegistryConfig = RegistryConfig{OwnerID: owner, EncryptionKey: key}
+		p, err := NewZoneFile(cfg)
+		if err != nil {
+			t.Fatalf("unexpected error, %v", err)
+		}
+		if _, err := p.Registry(); err != nil {
+			t.Fatalf("unexpected error, %v", err)
+		}
+		return p
+	}
+	one := newProv("one", "")
+	two := newProv("two", "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+
+	reconcile := func(p Provisioner, zone string) {
+		t.Helper()
+		desired, err := ParseZoneData(bytes.NewBufferString(zone))
+		if err != nil {
+			t.Fatalf("error parsing desired zone, %v", err)
+		}
+		var srv *Server
+		if err := srv.ReconcileZone(p, desired); err != nil {
+			t.Fatalf("error reconciling zone, %v", err)
+		}
+	}
+	records := func() string {
+		t.Helper()
+		z, err := one.RemoteZone()
+		if err != nil {
+			t.Fatalf("unexpected error, %v", err)
+		}
+		var strs []string
+		for _, r := range z {
+			switch {
+			case r.Header().Rrtype == dns.TypeSOA:
+			case strings.HasPrefix(r.Header().Name, "_dubber."):
+				owner, _ := one.registry.owner(r)
+				if owner == "" {
+					owner, _ = two.registry.owner(r)
+				}
+				strs = append(strs, r.Header().Name+" "+owner)
+			default:
+				strs = append(strs, r.Header().Name+" "+r.RR.(*dns.A).A.String())
+			}
+		}
+		sort.Strings(strs)
+		return strings.Join(strs, "\n")
+	}
+	check := func(exp string) {
+		t.Helper()
+		if got := records(); got != exp {
+			t.Fatalf("\n  expected:\n%s\n  got:\n%s", exp, got)
+		}
+	}
+
+	reconcile(one, `
+www.example.com. 300 IN A 10.0.0.1
+api.example.com. 300 IN A 10.0.0.2
+`)
+	check(`_dubber.a.api.example.com. one
+_dubber.a.www.example.com. one
+api.example.com. 10.0.0.2
+manual.example.com. 10.0.0.100
+www.example.com. 10.0.0.1`)
+
+	// Record sets owned by another owner are left alone
+	reconcile(two, `
+www.example.com. 300 IN A 10.0.0.3
+db.example.com. 300 IN A 10.0.0.4
+`)
+	check(`_dubber.a.api.example.com. one
+_dubber.a.db.example.com. two
+_dubber.a.www.example.com. one
+api.example.com. 10.0.0.2
+db.example.com. 10.0.0.4
+manual.example.com. 10.0.0.100
+www.example.com. 10.0.0.1`)
+
+	// Encrypted registry records are not rewritten when nothing changes
+	before, _ := os.ReadFile(path)
+	reconcile(two, `db.example.com. 300 IN A 10.0.0.4`)
+	after, _ := os.ReadFile(path)
+	if !bytes.Equal(before, after) {
+		t.Fatalf("expected no changes to the zone")
+	}
+	if strings.Contains(string(after), "owner=two") {
+		t.Fatalf("expected registry records to be encrypted, got\n%s", after)
+	}
+
+	// Registry records we cannot decrypt belong to someone else
+	reconcile(one, `
+www.example.com. 300 IN A 10.0.0.1
+api.example.com. 300 IN A 10.0.0.2
+db.example.com. 300 IN A 10.0.0.9
+`)
+	check(`_dubber.a.api.example.com. one
+_dubber.a.db.example.com. two
+_dubber.a.www.example.com. one
+api.example.com. 10.0.0.2
+db.example.com. 10.0.0.4
+manual.example.com. 10.0.0.100
+www.example.com. 10.0.0.1`)
+
+	// As do registry records encrypted with another key
+	three := newProv("three", "ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA=")
+	reconcile(three, `db.example.com. 300 IN A 10.0.0.9`)
+	check(`_dubber.a.api.example.com. one
+_dubber.a.db.example.com. two
+_dubber.a.www.example.com. one
+api.example.com. 10.0.0.2
+db.example.com. 10.0.0.4
+manual.example.com. 10.0.0.100
+www.example.com. 10.0.0.1`)
+
+	// Only record sets owned by us, and their registry records, are
+	// removed when no longer wanted.
+	reconcile(one, `www.example.com. 300 IN A 10.0.0.1`)
+	check(`_dubber.a.db.example.com. two
+_dubber.a.www.example.com. one
+db.example.com. 10.0.0.4
+manual.example.com. 10.0.0.100
+www.example.com. 10.0.0.1`)
+
+	reconcile(two, ``)
+	check(`_dubber.a.www.example.com. one
+manual.example.com. 10.0.0.100
+www.example.com. 10.0.0.1`)
+}
+
+func TestRegistryName(t *testing.T) {
+	reg, err := RegistryConfig{OwnerID: "one", Prefix: "_owner"}.build()
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if got, exp := reg.name("*.Apps.example.com.", dns.TypeCNAME), "_owner.cname.wildcard.apps.example.com."; got != exp {
+		t.Fatalf("expected %s, got %s", exp, got)
+	}
+
+	if reg, err := (RegistryConfig{}).build(); reg != nil || err != nil {
+		t.Fatalf("expected no registry without an owner ID, got %v, %v", reg, err)
+	}
+	if _, err := (RegistryConfig{OwnerID: "one", EncryptionKey: "c2hvcnQ="}).build(); err == nil {
+		t.Fatalf("expected an error for an invalid key")
+	}
+}
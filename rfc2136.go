@@ -0,0 +1,180 @@
+// Copyright 2017 Qubit Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dubber
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/miekg/dns"
+	klog "k8s.io/klog/v2"
+)
+
+// RFC2136Config describes the settings required for managing a zone on a
+// DNS server that supports RFC 2136 dynamic updates, such as BIND or Knot.
+// The zone is read via AXFR, so the server must also allow zone transfers
+// to dubber.
+type RFC2136Config struct {
+	BaseProvisionerConfig `json:",omitempty,inline" yaml:",omitempty,inline"`
+	// Server is the host:port of the primary server for the zone.
+	Server string `yaml:"server" json:"server"`
+	// Net is the transport for updates, "udp" or "tcp" (the default).
+	Net  string `yaml:"net" json:"net"`
+	TSIG struct {
+		KeyName string `yaml:"keyName" json:"keyName"`
+		// Algorithm defaults to hmac-sha256.
+		Algorithm string `yaml:"algorithm" json:"algorithm"`
+		// Secret is the base64 encoded TSIG secret.
+		Secret string `yaml:"secret" json:"secret"`
+	} `yaml:"tsig" json:"tsig"`
+	Timeout time.Duration `yaml:"timeout" json:"timeout"`
+}
+
+// RFC2136 is a provisioner for DNS servers supporting RFC 2136 dynamic
+// updates. Updates are sent with a prerequisite on the current SOA record,
+// so they fail if the zone has been changed since it was read.
+type RFC2136 struct {
+	*RFC2136Config
+}
+
+// NewRFC2136 creates an RFC 2136 dynamic update provisioner.
+func NewRFC2136(cfg *RFC2136Config) *RFC2136 {
+	return &RFC2136{RFC2136Config: cfg}
+}
+
+// GroupFlags is empty for RFC 2136 servers
+func (r *RFC2136) GroupFlags() []string {
+	return nil
+}
+
+func (r *RFC2136) tsigSecret() map[string]string {
+	if r.TSIG.KeyName == "" {
+		return nil
+	}
+	return map[string]string{dns.Fqdn(r.TSIG.KeyName): r.TSIG.Secret}
+}
+
+func (r *RFC2136) sign(m *dns.Msg) {
+	if r.TSIG.KeyName == "" {
+		return
+	}
+	algo := dns.HmacSHA256
+	if r.TSIG.Algorithm != "" {
+		algo = dns.Fqdn(r.TSIG.Algorithm)
+	}
+	m.SetTsig(dns.Fqdn(r.TSIG.KeyName), algo, 300, time.Now().Unix())
+}
+
+func (r *RFC2136) timeout() time.Duration {
+	if r.Timeout == 0 {
+		return 10 * time.Second
+	}
+	return r.Timeout
+}
+
+// RemoteZone creates a Zone from an AXFR of the zone.
+func (r *RFC2136) RemoteZone() (Zone, error) {
+	m := new(dns.Msg)
+	m.SetAxfr(dns.Fqdn(r.Zone))
+	r.sign(m)
+
+	t := &dns.Transfer{
+		DialTimeout:  r.timeout(),
+		ReadTimeout:  r.timeout(),
+		WriteTimeout: r.timeout(),
+		TsigSecret:   r.tsigSecret(),
+	}
+	ch, err := t.In(m, r.Server)
+	if err != nil {
+		return nil, fmt.Errorf("could not transfer zone %s, %w", r.Zone, err)
+	}
+
+	var z Zone
+	seenSOA := false
+	for env := range ch {
+		if env.Error != nil {
+			return nil, fmt.Errorf("could not transfer zone %s, %w", r.Zone, env.Error)
+		}
+		for _, rr := range env.RR {
+			// The transfer is terminated by a repeat of the SOA
+			if rr.Header().Rrtype == dns.TypeSOA {
+				if seenSOA {
+					continue
+				}
+				seenSOA = true
+			}
+			z = append(z, &Record{RR: rr})
+		}
+	}
+
+	sort.Sort(ByRR(z))
+
+	return z, nil
+}
+
+// UpdateZone sends a dynamic update removing the unwanted records and
+// adding the wanted records. The update is conditional on the SOA being
+// removed still being present on the server.
+func (r *RFC2136) UpdateZone(wanted, unwanted, desired, remote Zone) error {
+	m := new(dns.Msg)
+	m.SetUpdate(dns.Fqdn(r.Zone))
+
+	// The update functions modify the headers of the records they are
+	// passed, so we work on copies.
+	var prereqs, rems, adds []dns.RR
+	for _, uw := range unwanted {
+		if uw.Header().Rrtype == dns.TypeSOA {
+			// The SOA cannot be deleted, it is replaced by the
+			// new SOA, we just require that it is still current.
+			prereqs = append(prereqs, dns.Copy(uw.RR))
+			continue
+		}
+		rems = append(rems, dns.Copy(uw.RR))
+	}
+	for _, w := range wanted {
+		adds = append(adds, dns.Copy(w.RR))
+	}
+
+	if len(prereqs) != 0 {
+		m.Used(prereqs)
+	}
+	m.Remove(rems)
+	m.Insert(adds)
+	r.sign(m)
+
+	klog.V(1).Infof("RFC2136 update to %s: %s", r.Server, m)
+
+	c := &dns.Client{
+		Net:        r.Net,
+		Timeout:    r.timeout(),
+		TsigSecret: r.tsigSecret(),
+	}
+	if c.Net == "" {
+		c.Net = "tcp"
+	}
+
+	resp, _, err := c.Exchange(m, r.Server)
+	if err != nil {
+		return fmt.Errorf("sending update to %s, %w", r.Server, err)
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("update of zone %s rejected by %s, %s", r.Zone, r.Server, dns.RcodeToString[resp.Rcode])
+	}
+
+	klog.V(1).Infof("Change succeeded:\n %s", resp)
+
+	return nil
+}
@@ -0,0 +1,176 @@
+package dubber
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const testTSIGSecret = "c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0Cg=="
+
+// testRFC2136Server is a minimal primary server supporting AXFR and
+// dynamic updates for a single zone.
+type testRFC2136Server struct {
+	t *testing.T
+	sync.Mutex
+	zone []dns.RR
+}
+
+func (s *testRFC2136Server) find(rr dns.RR) int {
+	for i := range s.zone {
+		if dns.IsDuplicate(s.zone[i], rr) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *testRFC2136Server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	s.Lock()
+	defer s.Unlock()
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+
+	tsig := req.IsTsig()
+	if tsig == nil || w.TsigStatus() != nil {
+		m.Rcode = dns.RcodeNotAuth
+		w.WriteMsg(m)
+		return
+	}
+
+	switch req.Opcode {
+	case dns.OpcodeQuery:
+		ch := make(chan *dns.Envelope, 1)
+		ch <- &dns.Envelope{RR: append(append([]dns.RR{}, s.zone...), s.zone[0])}
+		close(ch)
+		if err := new(dns.Transfer).Out(w, req, ch); err != nil {
+			s.t.Errorf("transfer failed, %v", err)
+		}
+		return
+	case dns.OpcodeUpdate:
+		for _, pr := range req.Answer {
+			if s.find(pr) == -1 {
+				m.Rcode = dns.RcodeNXRrset
+				break
+			}
+		}
+		if m.Rcode != dns.RcodeSuccess {
+			break
+		}
+		for _, up := range req.Ns {
+			rr := dns.Copy(up)
+			switch rr.Header().Class {
+			case dns.ClassNONE:
+				rr.Header().Class = dns.ClassINET
+				if i := s.find(rr); i != -1 {
+					s.zone = append(s.zone[:i], s.zone[i+1:]...)
+				}
+			case dns.ClassINET:
+				if rr.Header().Rrtype == dns.TypeSOA {
+					s.zone[0] = rr
+					continue
+				}
+				if s.find(rr) == -1 {
+					s.zone = append(s.zone, rr)
+				}
+			}
+		}
+	}
+
+	m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, 300, time.Now().Unix())
+	w.WriteMsg(m)
+}
+
+func startTestRFC2136Server(t *testing.T, zone string) (string, *testRFC2136Server) {
+	z, err := ParseZoneData(bytes.NewBufferString(zone))
+	if err != nil {
+		t.Fatalf("error parsing server zone, %v", err)
+	}
+	h := &testRFC2136Server{t: t}
+	for _, r := range z {
+		h.zone = append(h.zone, r.RR)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen, %v", err)
+	}
+
+	started := make(chan struct{})
+	srv := &dns.Server{
+		Listener:          l,
+		Handler:           h,
+		TsigSecret:        map[string]string{"dubber.": testTSIGSecret},
+		NotifyStartedFunc: func() { close(started) },
+		// The default accept func refuses updates
+		MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+	}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	<-started
+
+	return l.Addr().String(), h
+}
+
+func TestRFC2136Reconcile(t *testing.T) {
+	addr, h := startTestRFC2136Server(t, `
+example.com. 3600 IN SOA ns1.example.com. root.example.com. 100 3600 1800 6048 8640
+example.com. 3600 IN NS ns1.example.com.
+thing.example.com. 10 IN A 6.6.6.6
+other.example.com. 10 IN A 5.5.5.5
+`)
+
+	cfg := &RFC2136Config{Server: addr}
+	cfg.Zone = "example.com."
+	cfg.TSIG.KeyName = "dubber"
+	cfg.TSIG.Secret = testTSIGSecret
+	p := NewRFC2136(cfg)
+
+	desired, err := ParseZoneData(bytes.NewBufferString(`
+thing.example.com. 10 IN A 7.7.7.7
+new.example.com. 10 IN CNAME thing.example.com.
+`))
+	if err != nil {
+		t.Fatalf("error parsing desired zone, %v", err)
+	}
+
+	var srv *Server
+	if err := srv.ReconcileZone(p, desired); err != nil {
+		t.Fatalf("error reconciling zone, %v", err)
+	}
+
+	got, err := p.RemoteZone()
+	if err != nil {
+		t.Fatalf("error reading remote zone, %v", err)
+	}
+
+	exp := `example.com.	3600	IN	NS	ns1.example.com.
+example.com.	3600	IN	SOA	ns1.example.com. root.example.com. 101 3600 1800 6048 8640
+new.example.com.	10	IN	CNAME	thing.example.com.
+other.example.com.	10	IN	A	5.5.5.5
+thing.example.com.	10	IN	A	7.7.7.7`
+	if got.String() != exp {
+		t.Fatalf("\n  expected:\n%s\n  got:\n%s", exp, got)
+	}
+
+	// An update based on the old SOA must be refused
+	oldSOA, _ := dns.NewRR(`example.com. 3600 IN SOA ns1.example.com. root.example.com. 100 3600 1800 6048 8640`)
+	newSOA, _ := dns.NewRR(`example.com. 3600 IN SOA ns1.example.com. root.example.com. 101 3600 1800 6048 8640`)
+	err = p.UpdateZone(Zone{{RR: newSOA}}, Zone{{RR: oldSOA}}, nil, nil)
+	if err == nil {
+		t.Fatalf("expected update with stale SOA to fail")
+	}
+
+	cfg.TSIG.Secret = "d3JvbmcK"
+	if _, err := p.RemoteZone(); err == nil {
+		t.Fatalf("expected transfer with the wrong TSIG secret to fail")
+	}
+	if len(h.zone) != 5 {
+		t.Fatalf("expected server zone to be unchanged, got %v", h.zone)
+	}
+}
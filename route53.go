@@ -48,12 +48,12 @@ type Route53Config struct {
 type Route53 struct {
 	svc route53iface.Route53API
 	sync.Mutex
-	Route53Config
+	*Route53Config
 }
 
 // NewRoute53 creates a route53 provisioner. Currently this uses the
 // default client setup from the aws-sdk.
-func NewRoute53(cfg Route53Config) *Route53 {
+func NewRoute53(cfg *Route53Config) *Route53 {
 	sess := session.Must(session.NewSession())
 	svc := route53.New(sess)
 
@@ -16,7 +16,11 @@ package dubber
 
 import (
 	"context"
+	"fmt"
 	"net/http"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -32,10 +36,15 @@ type Server struct {
 	*prometheus.Registry
 	MetricActiveDicoverers      prometheus.Gauge
 	MetricDiscovererRuns        *prometheus.CounterVec
+	MetricDiscovererStaleness   *prometheus.GaugeVec
+	MetricDiscovererExpired     *prometheus.GaugeVec
 	MetricDiscoveredZoneSerial  *prometheus.GaugeVec
 	MetricProvisionedZoneSerial *prometheus.GaugeVec
 	MetricReconcileRuns         *prometheus.CounterVec
 	MetricReconcileTimes        *prometheus.HistogramVec
+	MetricReconcileBlocked      *prometheus.GaugeVec
+
+	safety safetyState
 }
 
 // New creates a new dubber server.
@@ -44,6 +53,10 @@ func New(cfg *Config) *Server {
 		cfg:      cfg,
 		ServeMux: http.NewServeMux(),
 		Registry: prometheus.NewRegistry(),
+		safety: safetyState{
+			blocked:   map[string]SafetyStatus{},
+			overrides: map[string]string{},
+		},
 	}
 
 	srv.MetricActiveDicoverers = prometheus.NewGauge(prometheus.GaugeOpts{
@@ -56,57 +69,88 @@ func New(cfg *Config) *Server {
 		Help: "Total count of discoverer runs.",
 	}, []string{"status"})
 
+	srv.MetricDiscovererStaleness = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dubber_discoverer_staleness_seconds",
+		Help: "Age of the last successfully discovered zone, 0 if the last run succeeded.",
+	}, []string{"discoverer"})
+
+	srv.MetricDiscovererExpired = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dubber_discoverer_expired",
+		Help: "1 if a discoverer has failed for longer than the grace period and its records have been dropped.",
+	}, []string{"discoverer"})
+
 	srv.MetricDiscoveredZoneSerial = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "dubber_discovered_zone_serial",
 		Help: "Zone serial numbers as discoverd from provisioners.",
-	}, []string{"zone"})
+	}, []string{"zone", "provisioner"})
 
 	srv.MetricProvisionedZoneSerial = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "dubber_provisioned_zone_serial",
 		Help: "Zone serial set by provisioner.",
-	}, []string{"zone"})
+	}, []string{"zone", "provisioner"})
 
 	srv.MetricReconcileRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "dubber_reconcile_runs_total",
 		Help: "Total count of reconcile runs.",
-	}, []string{"status"})
+	}, []string{"zone", "provisioner", "status"})
 
 	srv.MetricReconcileTimes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Name: "dubber_reconcile_time_seconds",
 		Help: "Timings for reconcile runs",
-	}, []string{"zone"})
+	}, []string{"zone", "provisioner"})
+
+	srv.MetricReconcileBlocked = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dubber_reconcile_blocked",
+		Help: "Set to 1 if updates are blocked by safety limits.",
+	}, []string{"zone", "provisioner"})
 
 	srv.MustRegister(srv.MetricActiveDicoverers)
 	srv.MustRegister(srv.MetricDiscovererRuns)
+	srv.MustRegister(srv.MetricDiscovererStaleness)
+	srv.MustRegister(srv.MetricDiscovererExpired)
 	srv.MustRegister(srv.MetricDiscoveredZoneSerial)
 	srv.MustRegister(srv.MetricProvisionedZoneSerial)
 	srv.MustRegister(srv.MetricReconcileRuns)
 	srv.MustRegister(srv.MetricReconcileTimes)
+	srv.MustRegister(srv.MetricReconcileBlocked)
 
 	srv.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("OK")) })
 	srv.Handle("/metrics", promhttp.HandlerFor(srv.Registry, promhttp.HandlerOpts{}))
+	srv.HandleFunc("/safety", srv.ServeSafety)
 
 	return srv
 }
 
 // Run process the configuration, passing updates form discoverers,
-// managing state, and request action from provisioners.
+// managing state, and request action from provisioners. In OneShot
+// mode Run returns once every zone has been reconciled once.
 func (srv *Server) Run(ctx context.Context) error {
 	provs, err := srv.cfg.BuildProvisioners()
 	if err != nil {
 		return err
 	}
 
-	var provisionZones []string
-	for k := range provs {
-		provisionZones = append(provisionZones, k)
-	}
-
 	ds, err := srv.cfg.BuildDiscoveres()
 	if err != nil {
 		return err
 	}
 
+	if srv.cfg.OneShot {
+		return srv.runOnce(ctx, ds, provs)
+	}
+
+	if err := serveAuthoritative(ctx, provs); err != nil {
+		return err
+	}
+
+	return srv.run(ctx, ds, provs)
+}
+
+// run polls the discoverers, reconciling the zones whenever one of them
+// produces an update. Nothing is reconciled until every discoverer has
+// either succeeded once, or failed for longer than the grace period, so
+// that a discoverer failing at startup does not have its records deleted.
+func (srv *Server) run(ctx context.Context, ds []Discoverer, provs map[string][]NamedProvisioner) error {
 	type update struct {
 		i int
 		z Zone
@@ -119,60 +163,241 @@ func (srv *Server) Run(ctx context.Context) error {
 			srv.MetricActiveDicoverers.Inc()
 			defer srv.MetricActiveDicoverers.Dec()
 
+			st := newDiscovererStatus(srv.cfg.DiscovererGracePeriod, time.Now())
+
+			// Watchers block until something changes, so are only
+			// polled when they fail.
+			_, watches := d.StatePuller.(watcher)
+			wait := !watches
+
 			ticker := time.NewTicker(srv.cfg.PollInterval)
 			defer ticker.Stop()
 			for {
+				if wait {
+					select {
+					case <-ctx.Done():
+						return
+					case <-ticker.C:
+					}
+				}
+
+				z, err := d.Discover(ctx)
+				now := time.Now()
+				wait = err != nil || !watches
+				if err != nil {
+					klog.Errorf("discoverer %s failed, %v", d.Name, err)
+					srv.MetricDiscovererRuns.With(prometheus.Labels{"status": "failed"}).Inc()
+
+					expired := st.failed(now)
+					srv.MetricDiscovererStaleness.WithLabelValues(d.Name).Set(st.staleness(now).Seconds())
+					if !expired {
+						// Keep the last known good zone, there is nothing
+						// new to reconcile.
+						continue
+					}
+
+					klog.Warningf("discoverer %s has not succeeded since %s, dropping its records", d.Name, st.lastSuccess)
+					srv.MetricDiscovererExpired.WithLabelValues(d.Name).Set(1)
+				} else {
+					srv.MetricDiscovererRuns.With(prometheus.Labels{"status": "success"}).Inc()
+					st.succeeded(z, now)
+					srv.MetricDiscovererStaleness.WithLabelValues(d.Name).Set(0)
+					srv.MetricDiscovererExpired.WithLabelValues(d.Name).Set(0)
+				}
+
 				select {
 				case <-ctx.Done():
 					return
-				case <-ticker.C:
-					z, err := d.Discover(ctx)
-					if err != nil {
-						klog.Info("error", err)
-						srv.MetricDiscovererRuns.With(prometheus.Labels{"status": "failed"}).Inc()
-					}
-					srv.MetricDiscovererRuns.With(prometheus.Labels{"status": "success"}).Inc()
-					upds <- update{i, z}
+				case upds <- update{i, st.zone}:
 				}
 			}
 		}(i, d)
 	}
 
 	dzones := make([]Zone, len(ds))
+	ready := make([]bool, len(ds))
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		case up := <-upds:
 			dzones[up.i] = up.z
+			ready[up.i] = true
+
+			var waiting []string
+			for i := range ready {
+				if !ready[i] {
+					waiting = append(waiting, ds[i].Name)
+				}
+			}
+			if len(waiting) != 0 {
+				klog.Infof("waiting for discoverers %s before reconciling", strings.Join(waiting, ", "))
+				continue
+			}
 
 			var fullZone Zone
 			for i := range dzones {
 				fullZone = append(fullZone, dzones[i]...)
 			}
 
-			zones := fullZone.Partition(provisionZones)
+			// Failures are logged per zone, and retried on the next
+			// update.
+			_ = srv.reconcileZones(fullZone, provs)
+		}
+	}
+}
+
+// runOnce waits for the first result of every discoverer, and then
+// reconciles each zone once. If any discoverer fails nothing is
+// reconciled, as the missing records could otherwise be deleted.
+func (srv *Server) runOnce(ctx context.Context, ds []Discoverer, provs map[string][]NamedProvisioner) error {
+	fullZone, err := srv.discoverOnce(ctx, ds)
+	if err != nil {
+		return fmt.Errorf("%w, no zones reconciled", err)
+	}
+
+	return srv.reconcileZones(fullZone, provs)
+}
+
+// discoverOnce runs every discoverer once, returning the combined zone
+// data, or an error listing the discoverers that failed.
+func (srv *Server) discoverOnce(ctx context.Context, ds []Discoverer) (Zone, error) {
+	dzones := make([]Zone, len(ds))
+	errs := make([]error, len(ds))
+
+	wg := sync.WaitGroup{}
+	for i := range ds {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			dzones[i], errs[i] = ds[i].Discover(ctx)
+		}(i)
+	}
+	wg.Wait()
+
+	var failed []string
+	for i, err := range errs {
+		if err != nil {
+			klog.Errorf("discoverer %s failed, %v", ds[i].Name, err)
+			srv.MetricDiscovererRuns.With(prometheus.Labels{"status": "failed"}).Inc()
+			failed = append(failed, ds[i].Name)
+			continue
+		}
+		srv.MetricDiscovererRuns.With(prometheus.Labels{"status": "success"}).Inc()
+	}
+	if len(failed) != 0 {
+		return nil, fmt.Errorf("discoverers %s failed", strings.Join(failed, ", "))
+	}
+
+	var fullZone Zone
+	for i := range dzones {
+		fullZone = append(fullZone, dzones[i]...)
+	}
+	return fullZone, nil
+}
+
+// reconcileZones partitions the zone data between the provisioners and
+// reconciles each of the resulting zones. Each provisioner of a zone is
+// reconciled concurrently, and independently of the others. An error
+// listing the provisioners that failed is returned if any zone could not
+// be reconciled.
+func (srv *Server) reconcileZones(fullZone Zone, provs map[string][]NamedProvisioner) error {
+	var provisionZones []string
+	for k := range provs {
+		provisionZones = append(provisionZones, k)
+	}
+
+	zones := fullZone.Partition(provisionZones)
+
+	var failed []string
+	mu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for zn, newzone := range zones {
+		ps, ok := provs[zn]
+		if !ok {
+			klog.V(1).Infof("no provisioner for zone %q\n", zn)
+			continue
+		}
+		for _, p := range ps {
+			wg.Add(1)
+			go func(zn string, p NamedProvisioner, desired Zone) {
+				defer wg.Done()
+
+				timer := prometheus.NewTimer(prometheus.ObserverFunc(func(v float64) {
+					srv.MetricReconcileTimes.With(prometheus.Labels{"zone": zn, "provisioner": p.Name}).Observe(v)
+				}))
+				defer timer.ObserveDuration()
 
-			for zn, newzone := range zones {
-				p, ok := provs[zn]
-				if !ok {
-					klog.V(1).Infof("no provisioner for zone %q\n", zn)
-					continue
+				if err := srv.ReconcileZone(p, desired); err != nil {
+					klog.Errorf("reconciling zone %q with %s failed, %v", zn, p.Name, err)
+					srv.MetricReconcileRuns.With(prometheus.Labels{"zone": zn, "provisioner": p.Name, "status": "failed"}).Inc()
+					mu.Lock()
+					failed = append(failed, fmt.Sprintf("%s (%s)", zn, p.Name))
+					mu.Unlock()
+					return
 				}
-				func() {
-					timer := prometheus.NewTimer(prometheus.ObserverFunc(func(v float64) {
-						srv.MetricReconcileTimes.With(prometheus.Labels{"zone": zn}).Observe(v)
-					}))
-					defer timer.ObserveDuration()
-
-					if err := srv.ReconcileZone(p, newzone); err != nil {
-						klog.Infof(err.Error())
-						srv.MetricReconcileRuns.With(prometheus.Labels{"status": "failed"}).Inc()
-						return
-					}
-					srv.MetricReconcileRuns.With(prometheus.Labels{"status": "success"}).Inc()
-				}()
-			}
+				srv.MetricReconcileRuns.With(prometheus.Labels{"zone": zn, "provisioner": p.Name, "status": "success"}).Inc()
+			}(zn, p, append(Zone(nil), newzone...))
 		}
 	}
+	wg.Wait()
+
+	if len(failed) != 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("failed to reconcile zones %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// discovererStatus tracks the last Zone successfully produced by a
+// discoverer. When a discoverer fails, the last known good Zone is
+// retained until the grace period has passed since the last success, at
+// which point the discoverer is considered expired and its Zone is
+// dropped. A zero grace period retains the last zone indefinitely.
+type discovererStatus struct {
+	grace time.Duration
+
+	zone        Zone
+	lastSuccess time.Time
+	failing     bool
+	expired     bool
+}
+
+func newDiscovererStatus(grace time.Duration, now time.Time) *discovererStatus {
+	return &discovererStatus{
+		grace:       grace,
+		lastSuccess: now,
+	}
+}
+
+// succeeded records a successful discovery of z.
+func (st *discovererStatus) succeeded(z Zone, now time.Time) {
+	st.zone = z
+	st.lastSuccess = now
+	st.failing = false
+	st.expired = false
+}
+
+// failed records a failed discovery. It returns true if the
+// discoverer has just expired, and it's zone has been dropped.
+func (st *discovererStatus) failed(now time.Time) bool {
+	st.failing = true
+	if st.expired || st.grace == 0 {
+		return false
+	}
+	if now.Sub(st.lastSuccess) <= st.grace {
+		return false
+	}
+	st.zone = nil
+	st.expired = true
+	return true
+}
+
+// staleness is the age of the retained zone, or 0 if the last
+// discovery succeeded.
+func (st *discovererStatus) staleness(now time.Time) time.Duration {
+	if !st.failing {
+		return 0
+	}
+	return now.Sub(st.lastSuccess)
 }
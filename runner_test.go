@@ -0,0 +1,259 @@
+package dubber
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+)
+
+type testStatePuller struct {
+	state State
+	err   error
+}
+
+func (sp testStatePuller) StatePull(context.Context) (State, error) {
+	return sp.state, sp.err
+}
+
+func testDiscoverer(name, tmpl string, err error) Discoverer {
+	return Discoverer{
+		Name:         name,
+		StatePuller:  testStatePuller{err: err},
+		JSONTemplate: JSONTemplate{template.Must(template.New(name).Parse(tmpl))},
+	}
+}
+
+func TestDiscovererStatus(t *testing.T) {
+	z, err := ParseZoneData(bytes.NewBufferString(`thing.example.com. 10 IN A 8.8.8.8`))
+	if err != nil {
+		t.Fatalf("error parsing zone, %v", err)
+	}
+
+	start := time.Unix(0, 0)
+	st := newDiscovererStatus(time.Minute, start)
+
+	st.succeeded(z, start.Add(time.Second))
+	if got := st.staleness(start.Add(time.Second)); got != 0 {
+		t.Fatalf("expected no staleness after success, got %s", got)
+	}
+
+	if st.failed(start.Add(30 * time.Second)) {
+		t.Fatalf("expected failure within grace period not to expire")
+	}
+	if len(st.zone) != 1 {
+		t.Fatalf("expected last known good zone to be retained, got %v", st.zone)
+	}
+	if got, exp := st.staleness(start.Add(30*time.Second)), 29*time.Second; got != exp {
+		t.Fatalf("expected staleness %s, got %s", exp, got)
+	}
+
+	if !st.failed(start.Add(2 * time.Minute)) {
+		t.Fatalf("expected failure after grace period to expire")
+	}
+	if st.zone != nil {
+		t.Fatalf("expected expired zone to be dropped, got %v", st.zone)
+	}
+	if st.failed(start.Add(3 * time.Minute)) {
+		t.Fatalf("expected an expired discoverer to only expire once")
+	}
+
+	st.succeeded(z, start.Add(4*time.Minute))
+	if st.expired || len(st.zone) != 1 {
+		t.Fatalf("expected success to reset expiry")
+	}
+}
+
+func TestDiscovererStatus_NoGrace(t *testing.T) {
+	start := time.Unix(0, 0)
+	st := newDiscovererStatus(0, start)
+	if st.failed(start.Add(24 * time.Hour)) {
+		t.Fatalf("expected a zero grace period to never expire")
+	}
+}
+
+func TestServerRunOnce(t *testing.T) {
+	rz, err := ParseZoneData(bytes.NewBufferString(`example.com. 86400 IN SOA example.com. root.example.com. 100 3600 1800 6048 8640`))
+	if err != nil {
+		t.Fatalf("error parsing remote zone, %v", err)
+	}
+
+	tp := &testProvisioner{t: t, rz: rz}
+	provs := map[string][]NamedProvisioner{"example.com.": {{Name: "test/0", Provisioner: tp}}}
+	srv := New(&Config{OneShot: true})
+
+	ds := []Discoverer{
+		testDiscoverer("one", `thing.example.com. 10 IN A 8.8.8.8`, nil),
+		testDiscoverer("two", `thing2.example.com. 10 IN A 8.8.4.4`, nil),
+	}
+	if err := srv.runOnce(context.Background(), ds, provs); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if tp.updates != 1 {
+		t.Fatalf("expected 1 update, got %d", tp.updates)
+	}
+
+	ds = append(ds, testDiscoverer("three", ``, errors.New("broken")))
+	if err := srv.runOnce(context.Background(), ds, provs); err == nil {
+		t.Fatalf("expected an error from a failed discoverer")
+	}
+	if tp.updates != 1 {
+		t.Fatalf("expected no update after a failed discoverer, got %d", tp.updates-1)
+	}
+}
+
+type statePullerFunc func(context.Context) (State, error)
+
+func (f statePullerFunc) StatePull(ctx context.Context) (State, error) {
+	return f(ctx)
+}
+
+type updateRecorder struct {
+	*testProvisioner
+	wanted chan Zone
+}
+
+func (ur updateRecorder) UpdateZone(wanted, unwanted, desired, remote Zone) error {
+	select {
+	case ur.wanted <- wanted:
+	default:
+	}
+	return nil
+}
+
+func TestServerRun_DiscovererFailsAtStartup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rz, err := ParseZoneData(bytes.NewBufferString(`example.com. 86400 IN SOA example.com. root.example.com. 100 3600 1800 6048 8640`))
+	if err != nil {
+		t.Fatalf("error parsing remote zone, %v", err)
+	}
+	ur := updateRecorder{testProvisioner: &testProvisioner{t: t, rz: rz}, wanted: make(chan Zone, 1)}
+	provs := map[string][]NamedProvisioner{"example.com.": {{Name: "test/0", Provisioner: ur}}}
+	srv := New(&Config{PollInterval: 10 * time.Millisecond})
+
+	broken := make(chan bool, 1)
+	broken <- true
+	two := testDiscoverer("two", `thing2.example.com. 10 IN A 8.8.4.4`, nil)
+	two.StatePuller = statePullerFunc(func(context.Context) (State, error) {
+		select {
+		case b := <-broken:
+			broken <- b
+			if b {
+				return nil, errors.New("broken")
+			}
+		default:
+		}
+		return nil, nil
+	})
+	ds := []Discoverer{
+		testDiscoverer("one", `thing.example.com. 10 IN A 8.8.8.8`, nil),
+		two,
+	}
+
+	go srv.run(ctx, ds, provs)
+
+	select {
+	case z := <-ur.wanted:
+		t.Fatalf("expected no update while a discoverer has never succeeded, got\n%s", z)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	<-broken
+	broken <- false
+
+	select {
+	case z := <-ur.wanted:
+		if got := z.String(); !strings.Contains(got, "8.8.8.8") || !strings.Contains(got, "8.8.4.4") {
+			t.Fatalf("expected records from both discoverers, got\n%s", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no update once every discoverer succeeded")
+	}
+}
+
+type watchingStatePuller chan State
+
+func (sp watchingStatePuller) StatePull(ctx context.Context) (State, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case st := <-sp:
+		return st, nil
+	}
+}
+
+func (sp watchingStatePuller) blocksUntilChange() {}
+
+func TestServerRun_Watcher(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rz, err := ParseZoneData(bytes.NewBufferString(`example.com. 86400 IN SOA example.com. root.example.com. 100 3600 1800 6048 8640`))
+	if err != nil {
+		t.Fatalf("error parsing remote zone, %v", err)
+	}
+	ur := updateRecorder{testProvisioner: &testProvisioner{t: t, rz: rz}, wanted: make(chan Zone, 1)}
+	provs := map[string][]NamedProvisioner{"example.com.": {{Name: "test/0", Provisioner: ur}}}
+
+	// Watchers are not held back by the poll interval
+	srv := New(&Config{PollInterval: time.Hour})
+
+	states := make(watchingStatePuller)
+	d := testDiscoverer("watcher", `{{ . }}`, nil)
+	d.StatePuller = states
+
+	go srv.run(ctx, []Discoverer{d}, provs)
+
+	for _, addr := range []string{"8.8.8.8", "8.8.4.4"} {
+		states <- "thing.example.com. 10 IN A " + addr
+		select {
+		case z := <-ur.wanted:
+			if got := z.String(); !strings.Contains(got, addr) {
+				t.Fatalf("expected %s in update, got\n%s", addr, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no update for %s", addr)
+		}
+	}
+}
+
+type failingProvisioner struct {
+	*testProvisioner
+}
+
+func (fp failingProvisioner) RemoteZone() (Zone, error) {
+	return nil, errors.New("broken")
+}
+
+func TestServerReconcileZones_MultipleProvisioners(t *testing.T) {
+	rz, err := ParseZoneData(bytes.NewBufferString(`example.com. 86400 IN SOA example.com. root.example.com. 100 3600 1800 6048 8640`))
+	if err != nil {
+		t.Fatalf("error parsing remote zone, %v", err)
+	}
+	z, err := ParseZoneData(bytes.NewBufferString(`thing.example.com. 10 IN A 8.8.8.8`))
+	if err != nil {
+		t.Fatalf("error parsing zone, %v", err)
+	}
+
+	tp1 := &testProvisioner{t: t, rz: rz}
+	tp2 := &testProvisioner{t: t, rz: rz}
+	provs := map[string][]NamedProvisioner{"example.com.": {
+		{Name: "test/0", Provisioner: tp1},
+		{Name: "broken/0", Provisioner: failingProvisioner{&testProvisioner{t: t}}},
+		{Name: "test/1", Provisioner: tp2},
+	}}
+	srv := New(&Config{})
+
+	err = srv.reconcileZones(z, provs)
+	if err == nil || err.Error() != "failed to reconcile zones example.com. (broken/0)" {
+		t.Fatalf("expected only broken/0 to fail, got %v", err)
+	}
+	if tp1.updates != 1 || tp2.updates != 1 {
+		t.Fatalf("expected each working provisioner to be updated once, got %d and %d", tp1.updates, tp2.updates)
+	}
+}
@@ -0,0 +1,310 @@
+// Copyright 2017 Qubit Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dubber
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	klog "k8s.io/klog/v2"
+)
+
+// SafetyConfig limits the changes a single reconcile may make to a zone.
+// Updates exceeding the limits are blocked until they are explicitly
+// overridden.
+type SafetyConfig struct {
+	// MaxDeletes is the maximum number of records that may be deleted,
+	// 0 allows any number.
+	MaxDeletes int `yaml:"maxDeletes" json:"maxDeletes"`
+	// MaxDeletePercent is the maximum percentage of the zone's records
+	// that may be deleted, 0 allows any percentage.
+	MaxDeletePercent float64 `yaml:"maxDeletePercent" json:"maxDeletePercent"`
+	// MaxChanges is the maximum number of records that may be added or
+	// deleted, 0 allows any number.
+	MaxChanges int `yaml:"maxChanges" json:"maxChanges"`
+	// NeverDelete lists record types, e.g. NS, MX or TXT, that may never
+	// be deleted.
+	NeverDelete []string `yaml:"neverDelete" json:"neverDelete"`
+}
+
+// Safety holds the parsed safety limits for a zone.
+type Safety struct {
+	cfg         SafetyConfig
+	neverDelete map[uint16]bool
+}
+
+func (sc SafetyConfig) build() (*Safety, error) {
+	if sc.MaxDeletes == 0 && sc.MaxDeletePercent == 0 && sc.MaxChanges == 0 && len(sc.NeverDelete) == 0 {
+		return nil, nil
+	}
+	if sc.MaxDeletes < 0 || sc.MaxDeletePercent < 0 || sc.MaxChanges < 0 {
+		return nil, fmt.Errorf("safety limits may not be negative")
+	}
+	s := &Safety{cfg: sc, neverDelete: map[uint16]bool{}}
+	for _, str := range sc.NeverDelete {
+		t, ok := dns.StringToType[strings.ToUpper(str)]
+		if !ok {
+			return nil, fmt.Errorf("unknown record type %q in safety neverDelete", str)
+		}
+		s.neverDelete[t] = true
+	}
+	return s, nil
+}
+
+// errSafetyLimits is returned, wrapped, by updates blocked by safety limits.
+var errSafetyLimits = errors.New("safety limits exceeded")
+
+// check returns an error describing the limits exceeded by the changes.
+// Within each record set, records replaced by wanted records are counted
+// as changes, but not as deletions. Records of a protected type may not be
+// removed at all, even if they are replaced, other than the records of the
+// ownership registry, if reg is set.
+func (s *Safety) check(remote, wanted, unwanted Zone, groupFlags []string, reg *Registry) error {
+	if s == nil {
+		return nil
+	}
+
+	wgs := wanted.Group(groupFlags)
+	ugs := unwanted.Group(groupFlags)
+
+	deletes := 0
+	for k, ug := range ugs {
+		if n := len(ug) - len(wgs[k]); n > 0 {
+			deletes += n
+		}
+	}
+
+	neverDeleted := map[string]bool{}
+	for _, r := range unwanted {
+		hdr := r.Header()
+		if !s.neverDelete[hdr.Rrtype] {
+			continue
+		}
+		if reg != nil && hdr.Rrtype == dns.TypeTXT && reg.isRegistryName(hdr.Name) {
+			continue
+		}
+		neverDeleted[dns.TypeToString[hdr.Rrtype]+" "+hdr.Name] = true
+	}
+
+	total := 0
+	for _, r := range remote {
+		if r.Header().Rrtype != dns.TypeSOA {
+			total++
+		}
+	}
+
+	var reasons []string
+	if len(neverDeleted) != 0 {
+		var strs []string
+		for k := range neverDeleted {
+			strs = append(strs, k)
+		}
+		sort.Strings(strs)
+		reasons = append(reasons, fmt.Sprintf("would delete protected records %s", strings.Join(strs, ", ")))
+	}
+	if s.cfg.MaxDeletes != 0 && deletes > s.cfg.MaxDeletes {
+		reasons = append(reasons, fmt.Sprintf("would delete %d records, the limit is %d", deletes, s.cfg.MaxDeletes))
+	}
+	if s.cfg.MaxDeletePercent != 0 && total != 0 {
+		if pct := 100 * float64(deletes) / float64(total); pct > s.cfg.MaxDeletePercent {
+			reasons = append(reasons, fmt.Sprintf("would delete %.1f%% of records, the limit is %.1f%%", pct, s.cfg.MaxDeletePercent))
+		}
+	}
+	if changes := len(wanted) + len(unwanted); s.cfg.MaxChanges != 0 && changes > s.cfg.MaxChanges {
+		reasons = append(reasons, fmt.Sprintf("would change %d records, the limit is %d", changes, s.cfg.MaxChanges))
+	}
+
+	if len(reasons) != 0 {
+		return fmt.Errorf("%w, %s", errSafetyLimits, strings.Join(reasons, "; "))
+	}
+	return nil
+}
+
+// SafetyStatus describes an update that has been blocked by the safety
+// limits of a zone. Serial is the serial of the remote zone when the
+// update was last attempted.
+type SafetyStatus struct {
+	Zone        string    `json:"zone"`
+	Provisioner string    `json:"provisioner"`
+	Reason      string    `json:"reason"`
+	Serial      uint32    `json:"serial"`
+	Since       time.Time `json:"since"`
+
+	changes string
+}
+
+// safetyState tracks the blocked updates, and the one time overrides
+// requested via the HTTP endpoint. An override holds the changes of the
+// blocked update it was granted for, and only allows exactly those
+// changes.
+type safetyState struct {
+	sync.Mutex
+	blocked   map[string]SafetyStatus
+	overrides map[string]string
+}
+
+func safetyKey(zone, provisioner string) string {
+	return zone + " " + provisioner
+}
+
+// safetyChanges returns a fingerprint of a set of changes. Registry
+// records are ignored, as new encrypted registry records differ on every
+// reconcile, and follow the record sets they belong to.
+func safetyChanges(wanted, unwanted Zone, reg *Registry) string {
+	strs := func(z Zone) []string {
+		var res []string
+		for _, r := range z {
+			if reg != nil && r.Header().Rrtype == dns.TypeTXT && reg.isRegistryName(r.Header().Name) {
+				continue
+			}
+			res = append(res, r.String())
+		}
+		sort.Strings(res)
+		return res
+	}
+	h := fnv.New64a()
+	for _, str := range strs(wanted) {
+		fmt.Fprintf(h, "+%s\n", str)
+	}
+	for _, str := range strs(unwanted) {
+		fmt.Fprintf(h, "-%s\n", str)
+	}
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// checkSafety checks the changes to a zone against the provisioner's
+// safety limits. Blocked updates are recorded for the status endpoint and
+// metrics, unless overridden by configuration, or a one time override of
+// exactly these changes.
+func (srv *Server) checkSafety(p Provisioner, zone string, remote, wanted, unwanted Zone) error {
+	s, err := p.Safety()
+	if err != nil {
+		return err
+	}
+	reg, err := p.Registry()
+	if err != nil {
+		return err
+	}
+	err = s.check(remote, wanted, unwanted, p.GroupFlags(), reg)
+	if srv == nil {
+		return err
+	}
+
+	name := provisionerName(p)
+	key := safetyKey(zone, name)
+	changes := safetyChanges(wanted, unwanted, reg)
+
+	srv.safety.Lock()
+	defer srv.safety.Unlock()
+
+	if err != nil {
+		override, ok := srv.safety.overrides[key]
+		delete(srv.safety.overrides, key)
+		switch {
+		case srv.cfg.SafetyOverride:
+			klog.Warningf("zone %s on %s, overriding %v", zone, name, err)
+			err = nil
+		case ok && override == changes:
+			klog.Warningf("zone %s on %s, overriding once %v", zone, name, err)
+			err = nil
+		case ok:
+			klog.Warningf("zone %s on %s, discarding override, the blocked changes are no longer the same", zone, name)
+		}
+	}
+
+	if err == nil {
+		delete(srv.safety.blocked, key)
+		delete(srv.safety.overrides, key)
+		srv.MetricReconcileBlocked.WithLabelValues(zone, name).Set(0)
+		return nil
+	}
+
+	st, ok := srv.safety.blocked[key]
+	if !ok || st.changes != changes {
+		st = SafetyStatus{Zone: zone, Provisioner: name, Since: time.Now(), changes: changes}
+	}
+	st.Reason = err.Error()
+	for _, r := range remote {
+		if soa, ok := r.RR.(*dns.SOA); ok {
+			st.Serial = soa.Serial
+		}
+	}
+	srv.safety.blocked[key] = st
+	srv.MetricReconcileBlocked.WithLabelValues(zone, name).Set(1)
+
+	return err
+}
+
+// ServeSafety reports the updates blocked by safety limits. If
+// SafetyHTTPOverride is set, a POST with zone and provisioner parameters
+// allows the currently blocked update of that zone, by that provisioner,
+// to exceed the limits once. The optional serial parameter must then match
+// the serial reported for the blocked update.
+func (srv *Server) ServeSafety(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		srv.safety.Lock()
+		sts := []SafetyStatus{}
+		for _, st := range srv.safety.blocked {
+			sts = append(sts, st)
+		}
+		srv.safety.Unlock()
+		sort.Slice(sts, func(i, j int) bool {
+			return safetyKey(sts[i].Zone, sts[i].Provisioner) < safetyKey(sts[j].Zone, sts[j].Provisioner)
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sts)
+	case http.MethodPost:
+		if !srv.cfg.SafetyHTTPOverride {
+			http.Error(w, "safety overrides over HTTP are disabled", http.StatusForbidden)
+			return
+		}
+		zone, name := dns.Fqdn(r.FormValue("zone")), r.FormValue("provisioner")
+		if r.FormValue("zone") == "" || name == "" {
+			http.Error(w, "zone and provisioner must be set", http.StatusBadRequest)
+			return
+		}
+		key := safetyKey(zone, name)
+
+		srv.safety.Lock()
+		defer srv.safety.Unlock()
+
+		st, ok := srv.safety.blocked[key]
+		if !ok {
+			http.Error(w, "no update is blocked for that zone and provisioner", http.StatusConflict)
+			return
+		}
+		if serial := r.FormValue("serial"); serial != "" && serial != strconv.FormatUint(uint64(st.Serial), 10) {
+			http.Error(w, "the serial of the blocked update has changed", http.StatusConflict)
+			return
+		}
+		klog.Infof("safety override requested for zone %s on %s, %s", zone, name, st.Reason)
+		srv.safety.overrides[key] = st.changes
+
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
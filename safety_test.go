@@ -0,0 +1,249 @@
+package dubber
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSafetyCheck(t *testing.T) {
+	remote, err := ParseZoneData(bytes.NewBufferString(`
+example.com. 86400 IN SOA example.com. root.example.com. 100 3600 1800 6048 8640
+example.com. 300 IN NS ns1.example.com.
+example.com. 300 IN NS ns2.example.com.
+www.example.com. 300 IN A 10.0.0.1
+www.example.com. 300 IN A 10.0.0.2
+www.example.com. 300 IN A 10.0.0.3
+`))
+	if err != nil {
+		t.Fatalf("error parsing remote zone, %v", err)
+	}
+	parse := func(str string) Zone {
+		z, err := ParseZoneData(bytes.NewBufferString(str))
+		if err != nil {
+			t.Fatalf("error parsing zone, %v", err)
+		}
+		return z
+	}
+
+	tests := []struct {
+		name     string
+		cfg      SafetyConfig
+		wanted   string
+		unwanted string
+		registry bool
+		err      string
+	}{
+		{
+			name:     "no limits",
+			unwanted: `www.example.com. 300 IN A 10.0.0.1`,
+		},
+		{
+			name:     "replacements are not deletes",
+			cfg:      SafetyConfig{MaxDeletes: 1},
+			wanted:   "www.example.com. 300 IN A 10.0.0.4\nwww.example.com. 300 IN A 10.0.0.5",
+			unwanted: "www.example.com. 300 IN A 10.0.0.1\nwww.example.com. 300 IN A 10.0.0.2",
+		},
+		{
+			name:     "max deletes",
+			cfg:      SafetyConfig{MaxDeletes: 1},
+			unwanted: "www.example.com. 300 IN A 10.0.0.1\nwww.example.com. 300 IN A 10.0.0.2",
+			err:      "safety limits exceeded, would delete 2 records, the limit is 1",
+		},
+		{
+			name:     "max delete percent",
+			cfg:      SafetyConfig{MaxDeletePercent: 30},
+			unwanted: "www.example.com. 300 IN A 10.0.0.1\nwww.example.com. 300 IN A 10.0.0.2",
+			err:      "safety limits exceeded, would delete 40.0% of records, the limit is 30.0%",
+		},
+		{
+			name:     "max changes",
+			cfg:      SafetyConfig{MaxChanges: 2},
+			wanted:   "www.example.com. 300 IN A 10.0.0.4\nwww.example.com. 300 IN A 10.0.0.5",
+			unwanted: "www.example.com. 300 IN A 10.0.0.1",
+			err:      "safety limits exceeded, would change 3 records, the limit is 2",
+		},
+		{
+			name:     "never delete",
+			cfg:      SafetyConfig{NeverDelete: []string{"ns", "MX"}},
+			unwanted: `example.com. 300 IN NS ns2.example.com.`,
+			err:      "safety limits exceeded, would delete protected records NS example.com.",
+		},
+		{
+			name:     "never delete includes replacement",
+			cfg:      SafetyConfig{NeverDelete: []string{"NS"}},
+			wanted:   "example.com. 300 IN NS ns3.example.com.\nexample.com. 300 IN NS ns4.example.com.",
+			unwanted: "example.com. 300 IN NS ns1.example.com.\nexample.com. 300 IN NS ns2.example.com.",
+			err:      "safety limits exceeded, would delete protected records NS example.com.",
+		},
+		{
+			name:     "never delete ignores registry records",
+			cfg:      SafetyConfig{NeverDelete: []string{"TXT"}},
+			unwanted: "www.example.com. 300 IN A 10.0.0.1\n_dubber.a.www.example.com. 300 IN TXT \"heritage=dubber,dubber/owner=one\"",
+			registry: true,
+		},
+		{
+			name:     "never delete without a registry",
+			cfg:      SafetyConfig{NeverDelete: []string{"TXT"}},
+			unwanted: `_dubber.a.www.example.com. 300 IN TXT "heritage=dubber,dubber/owner=one"`,
+			err:      "safety limits exceeded, would delete protected records TXT _dubber.a.www.example.com.",
+		},
+	}
+
+	reg, err := RegistryConfig{OwnerID: "one"}.build()
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := tt.cfg.build()
+			if err != nil {
+				t.Fatalf("unexpected error, %v", err)
+			}
+			var treg *Registry
+			if tt.registry {
+				treg = reg
+			}
+			err = s.check(remote, parse(tt.wanted), parse(tt.unwanted), nil, treg)
+			switch {
+			case err == nil && tt.err != "":
+				t.Fatalf("expected error %q", tt.err)
+			case err != nil && err.Error() != tt.err:
+				t.Fatalf("expected error %q, got %v", tt.err, err)
+			}
+		})
+	}
+
+	if _, err := (SafetyConfig{NeverDelete: []string{"BOGUS"}}).build(); err == nil {
+		t.Fatalf("expected an error for an unknown record type")
+	}
+}
+
+func TestServerReconcileZone_Safety(t *testing.T) {
+	rz, err := ParseZoneData(bytes.NewBufferString(`
+example.com. 86400 IN SOA example.com. root.example.com. 100 3600 1800 6048 8640
+www.example.com. 300 IN A 10.0.0.1
+www.example.com. 300 IN A 10.0.0.2
+www.example.com. 300 IN A 10.0.0.3
+`))
+	if err != nil {
+		t.Fatalf("error parsing remote zone, %v", err)
+	}
+	z, err := ParseZoneData(bytes.NewBufferString(`www.example.com. 300 IN A 10.0.0.1`))
+	if err != nil {
+		t.Fatalf("error parsing zone, %v", err)
+	}
+
+	safety, err := SafetyConfig{MaxDeletes: 1}.build()
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	tp := &testProvisioner{t: t, rz: rz, safety: safety}
+	p := NamedProvisioner{Name: "test/0", Provisioner: tp}
+	srv := New(&Config{SafetyHTTPOverride: true})
+
+	post := func(query string) int {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/safety?"+query, nil))
+		return w.Code
+	}
+
+	// Overrides are only accepted for blocked updates
+	if code := post("zone=example.com&provisioner=test/0"); code != http.StatusConflict {
+		t.Fatalf("expected override with nothing blocked to be refused, got %d", code)
+	}
+
+	if err := srv.ReconcileZone(p, z); err == nil {
+		t.Fatalf("expected update to be blocked")
+	}
+	if tp.updates != 0 {
+		t.Fatalf("expected no updates, got %d", tp.updates)
+	}
+	if v := testutil.ToFloat64(srv.MetricReconcileBlocked.WithLabelValues("example.com.", "test/0")); v != 1 {
+		t.Fatalf("expected blocked metric to be 1, got %v", v)
+	}
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/safety", nil))
+	var sts []SafetyStatus
+	if err := json.NewDecoder(w.Body).Decode(&sts); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if len(sts) != 1 || sts[0].Zone != "example.com." || sts[0].Provisioner != "test/0" || !strings.Contains(sts[0].Reason, "would delete 2 records") {
+		t.Fatalf("unexpected status %+v", sts)
+	}
+
+	// A one time override lets the blocked update through
+	if code := post("zone=example.com&provisioner=test/0&serial=99"); code != http.StatusConflict {
+		t.Fatalf("expected override with the wrong serial to be refused, got %d", code)
+	}
+	if code := post("zone=example.com&provisioner=test/0&serial=100"); code != http.StatusAccepted {
+		t.Fatalf("expected override to be accepted, got %d", code)
+	}
+	if err := srv.ReconcileZone(p, z); err != nil {
+		t.Fatalf("expected override to allow the update, got %v", err)
+	}
+	if tp.updates != 1 {
+		t.Fatalf("expected 1 update, got %d", tp.updates)
+	}
+	if v := testutil.ToFloat64(srv.MetricReconcileBlocked.WithLabelValues("example.com.", "test/0")); v != 0 {
+		t.Fatalf("expected blocked metric to be 0, got %v", v)
+	}
+
+	if err := srv.ReconcileZone(p, z); err == nil {
+		t.Fatalf("expected the override to only apply once")
+	}
+
+	// Overrides only apply to the changes that were blocked
+	if code := post("zone=example.com&provisioner=test/0"); code != http.StatusAccepted {
+		t.Fatalf("expected override to be accepted, got %d", code)
+	}
+	z2, err := ParseZoneData(bytes.NewBufferString(`www.example.com. 300 IN A 10.0.0.9`))
+	if err != nil {
+		t.Fatalf("error parsing zone, %v", err)
+	}
+	if err := srv.ReconcileZone(p, z2); err == nil {
+		t.Fatalf("expected the override not to apply to different changes")
+	}
+	if err := srv.ReconcileZone(p, z); err == nil {
+		t.Fatalf("expected the override to have been discarded")
+	}
+
+	srv.cfg.SafetyHTTPOverride = false
+	if code := post("zone=example.com&provisioner=test/0"); code != http.StatusForbidden {
+		t.Fatalf("expected overrides over HTTP to be disabled, got %d", code)
+	}
+
+	srv.cfg.SafetyOverride = true
+	if err := srv.ReconcileZone(p, z); err != nil {
+		t.Fatalf("expected the configured override to allow the update, got %v", err)
+	}
+	srv.cfg.SafetyOverride = false
+
+	// Reverting the change clears the block, even though there is then
+	// nothing to do.
+	if err := srv.ReconcileZone(p, z); err == nil {
+		t.Fatalf("expected update to be blocked")
+	}
+	updates := tp.updates
+	if err := srv.ReconcileZone(p, rz[1:]); err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if tp.updates != updates {
+		t.Fatalf("expected no updates, got %d", tp.updates-updates)
+	}
+	if v := testutil.ToFloat64(srv.MetricReconcileBlocked.WithLabelValues("example.com.", "test/0")); v != 0 {
+		t.Fatalf("expected blocked metric to be 0, got %v", v)
+	}
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/safety", nil))
+	if got := strings.TrimSpace(w.Body.String()); got != "[]" {
+		t.Fatalf("expected nothing to be blocked, got %s", got)
+	}
+}
@@ -18,6 +18,8 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"net/url"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -56,6 +58,25 @@ func ParseRecordFlags(str string) (RecordFlags, error) {
 	return res, nil
 }
 
+// flagValueEscaper percent encodes the characters that cannot appear in a
+// record flag value, as flags are whitespace separated.
+var flagValueEscaper = strings.NewReplacer("%", "%25", " ", "%20", "\t", "%09", "\n", "%0A", "\r", "%0D")
+
+// escapeFlagValue percent encodes free text, such as a comment, for use
+// as a flag value.
+func escapeFlagValue(str string) string {
+	return flagValueEscaper.Replace(str)
+}
+
+// unescapeFlagValue decodes a flag value encoded by escapeFlagValue.
+// Values that are not validly encoded are used as they are.
+func unescapeFlagValue(str string) string {
+	if v, err := url.PathUnescape(str); err == nil {
+		return v
+	}
+	return str
+}
+
 // String implements Stringer for a RecordFlags, rendering
 // the strings in sorted order
 func (rf RecordFlags) String() string {
@@ -207,9 +228,38 @@ func (z ZoneError) Error() string {
 	return strings.Join(strs, "\n")
 }
 
+// recordFlagRe matches a single record flag, either a K=V pair, or a bare
+// provider flag such as powerdns.Disabled.
+var recordFlagRe = regexp.MustCompile(`^([A-Za-z][\w./-]*=\S*|[a-z][a-z0-9]*\.[A-Z]\w*)$`)
+
+// isRecordFlags reports whether a comment holds record flags. Comments
+// without any flags are free text, such as "; serial", and are ignored.
+// Comments mixing flags with other words are an error, as they are most
+// likely flag values containing whitespace.
+func isRecordFlags(str string) (bool, error) {
+	flags, other := 0, 0
+	for _, w := range strings.Fields(str) {
+		if recordFlagRe.MatchString(w) {
+			flags++
+		} else {
+			other++
+		}
+	}
+	switch {
+	case flags == 0:
+		return false, nil
+	case other != 0:
+		return false, fmt.Errorf("comment %q mixes record flags with other text, flag values may not contain whitespace", strings.TrimSpace(str))
+	default:
+		return true, nil
+	}
+}
+
 // ParseZoneData parses the text from the provided reader into
 // zone data. All errors encountered during parsing are collected
-// into the err response.
+// into the err response. Record comments are parsed as flags if they
+// contain only K=V pairs and provider flags, and ignored if they contain
+// none, comments mixing the two are an error.
 func ParseZoneData(r io.Reader) (Zone, error) {
 	var errs []error
 	var z Zone
@@ -225,12 +275,18 @@ func ParseZoneData(r io.Reader) (Zone, error) {
 		}
 		var flags RecordFlags
 		if cmnt := zp.Comment(); len(cmnt) > 1 {
-			var err error
-			flags, err = ParseRecordFlags(cmnt[1:])
+			ok, err := isRecordFlags(cmnt[1:])
 			if err != nil {
-				errs = append(errs, err)
+				errs = append(errs, fmt.Errorf("record %s, %w", rr.Header().Name, err))
 				continue
 			}
+			if ok {
+				flags, err = ParseRecordFlags(cmnt[1:])
+				if err != nil {
+					errs = append(errs, err)
+					continue
+				}
+			}
 		}
 		z = append(z, &Record{RR: rr, Flags: flags})
 	}
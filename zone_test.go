@@ -39,6 +39,40 @@ thing2.example.com.	10	IN	A	8.8.8.8 ; aws.Route53.alias=mything comment=1`
 	}
 }
 
+func TestParseZoneData_Comments(t *testing.T) {
+	var z1 = `
+$ORIGIN example.com.
+@ 3600 IN SOA ns1 root (
+	100 ; serial
+	3600 1800 604800 86400 )
+ns1 10 IN A 10.0.0.1 ; primary web
+ns2 10 IN A 10.0.0.2 ; see docs.example.com for details
+thing 10 IN A 8.8.8.8 ; owner=dubber powerdns.Disabled
+thing 10 IN A 9.9.9.9 ; route53.SetID=set1
+`
+
+	var z2 = `example.com.	3600	IN	SOA	ns1.example.com. root.example.com. 100 3600 1800 604800 86400
+ns1.example.com.	10	IN	A	10.0.0.1
+ns2.example.com.	10	IN	A	10.0.0.2
+thing.example.com.	10	IN	A	8.8.8.8 ; owner=dubber powerdns.Disabled
+thing.example.com.	10	IN	A	9.9.9.9 ; route53.SetID=set1`
+
+	z, err := ParseZoneData(bytes.NewBuffer([]byte(z1)))
+	if err != nil {
+		t.Fatalf("expected no errors while parsing, got errs = %v", err)
+	}
+	sort.Sort(ByRR(z))
+	if z.String() != z2 {
+		t.Fatalf("\n  expected:\n%s\n  got:\n%s", z2, z)
+	}
+
+	// Flags with whitespace in their values must not be silently dropped
+	_, err = ParseZoneData(bytes.NewBufferString(`www.example.com. 10 IN A 8.8.8.8 ; cloudflare.Proxied=true cloudflare.Comment=marketing site`))
+	if err == nil || !strings.Contains(err.Error(), "mixes record flags with other text") {
+		t.Fatalf("expected an error for a comment mixing flags and text, got %v", err)
+	}
+}
+
 func TestZonePartition(t *testing.T) {
 	var zstr = `www.example.com.	10	IN	A	8.8.8.8 ; comment=1
 www.example.com.	10	IN	A	8.8.8.8 ; comment=2
@@ -0,0 +1,208 @@
+// Copyright 2017 Qubit Ltd.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dubber
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	klog "k8s.io/klog/v2"
+)
+
+// ZoneFileConfig describes the settings required for managing an RFC 1035
+// zone file.
+type ZoneFileConfig struct {
+	BaseProvisionerConfig `json:",omitempty,inline" yaml:",omitempty,inline"`
+	// Path is the zone file to manage, it must already exist and contain
+	// an SOA record for the zone.
+	Path string `yaml:"path" json:"path"`
+	// ReloadCommand is run after the zone file has been updated, e.g.
+	// ["rndc", "reload", "example.com"]
+	ReloadCommand []string `yaml:"reloadCommand" json:"reloadCommand"`
+	// ReloadTimeout is the maximum time the reload command may run for,
+	// defaults to 30s.
+	ReloadTimeout time.Duration `yaml:"reloadTimeout" json:"reloadTimeout"`
+}
+
+// ZoneFile is a provisioner for a local zone file, such as those served by
+// BIND or NSD. Flags are preserved as comments on each record. Relative
+// names in the file are taken to be relative to the zone, but the file is
+// always rewritten with fully qualified names.
+type ZoneFile struct {
+	*ZoneFileConfig
+
+	sync.Mutex
+}
+
+// NewZoneFile creates a zone file provisioner.
+func NewZoneFile(cfg *ZoneFileConfig) (*ZoneFile, error) {
+	if cfg.Path == "" {
+		return nil, fmt.Errorf("zone file path must be set")
+	}
+	return &ZoneFile{ZoneFileConfig: cfg}, nil
+}
+
+// GroupFlags is empty for zone files
+func (f *ZoneFile) GroupFlags() []string {
+	return nil
+}
+
+// RemoteZone parses the zone file.
+func (f *ZoneFile) RemoteZone() (Zone, error) {
+	f.Lock()
+	defer f.Unlock()
+	return f.read()
+}
+
+func (f *ZoneFile) read() (Zone, error) {
+	fh, err := os.Open(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	origin := strings.NewReader(fmt.Sprintf("$ORIGIN %s\n", dns.Fqdn(f.Zone)))
+	z, err := ParseZoneData(io.MultiReader(origin, fh))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse zone file %s, %w", f.Path, err)
+	}
+	sort.Sort(ByRR(z))
+
+	return z, nil
+}
+
+// UpdateZone rewrites the zone file, replacing it atomically, and runs the
+// reload command if one is configured. The zone file is re-read first, and
+// the update fails if its SOA serial has changed.
+func (f *ZoneFile) UpdateZone(wanted, unwanted, desired, remote Zone) error {
+	f.Lock()
+	defer f.Unlock()
+
+	var soa *dns.SOA
+	for _, uw := range unwanted {
+		if s, ok := uw.RR.(*dns.SOA); ok {
+			soa = s
+		}
+	}
+	if soa == nil {
+		return fmt.Errorf("no SOA record to update for zone %s", f.Zone)
+	}
+
+	cur, err := f.read()
+	if err != nil {
+		return err
+	}
+
+	var z Zone
+nextRecord:
+	for _, r := range cur {
+		if s, ok := r.RR.(*dns.SOA); ok && s.Serial != soa.Serial {
+			return fmt.Errorf("zone %s serial has changed from %d to %d", f.Zone, soa.Serial, s.Serial)
+		}
+		for _, u := range unwanted {
+			if r.Compare(u) == 0 {
+				continue nextRecord
+			}
+		}
+		z = append(z, r)
+	}
+	z = append(z, wanted...)
+	sort.Sort(ByRR(z))
+	z = Zone(ByRR(z).Dedupe())
+
+	for _, r := range unwanted {
+		klog.V(1).Infof("zonefile remove: %s", r)
+	}
+	for _, r := range wanted {
+		klog.V(1).Infof("zonefile add: %s", r)
+	}
+
+	if err := f.write(z); err != nil {
+		return fmt.Errorf("writing zone file %s, %w", f.Path, err)
+	}
+
+	if err := f.reload(); err != nil {
+		return err
+	}
+
+	klog.V(1).Infof("Change succeeded")
+
+	return nil
+}
+
+// write replaces the zone file with the given zone, via a temporary file
+// in the same directory, so readers never see a partially written zone.
+func (f *ZoneFile) write(z Zone) error {
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(f.Path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.Path), "."+filepath.Base(f.Path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	fmt.Fprintf(tmp, "; zone %s, managed by dubber\n", dns.Fqdn(f.Zone))
+	fmt.Fprintf(tmp, "%s\n", z)
+
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.Path)
+}
+
+func (f *ZoneFile) reload() error {
+	if len(f.ReloadCommand) == 0 {
+		return nil
+	}
+	timeout := f.ReloadTimeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, f.ReloadCommand[0], f.ReloadCommand[1:]...)
+	out := &bytes.Buffer{}
+	cmd.Stdout = out
+	cmd.Stderr = out
+
+	klog.V(1).Infof("running %v", f.ReloadCommand)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("zone file %s was updated, but reload command %v failed, %w, %s",
+			f.Path, f.ReloadCommand, err, bytes.TrimSpace(out.Bytes()))
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package dubber
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"text/template"
+)
+
+func TestZoneFileReconcile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "example.com.zone")
+	marker := filepath.Join(dir, "reloaded")
+
+	err := os.WriteFile(path, []byte(`$TTL 3600
+@	IN	SOA	ns1 root (
+		100 ; serial
+		3600 1800 604800 86400 )
+	IN	NS	ns1
+ns1	IN	A	10.0.0.1
+thing	10	IN	A	6.6.6.6
+thing	10	IN	A	8.8.8.8 ; owner=dubber
+`), 0640)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	cfg := &ZoneFileConfig{
+		Path:          path,
+		ReloadCommand: []string{"touch", marker},
+	}
+	cfg.Zone = "example.com."
+	cfg.OwnerFlagsStrs = map[string]JSONTemplate{"owner": {template.Must(template.New("owner").Parse("dubber"))}}
+	p, err := NewZoneFile(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+
+	desired, err := ParseZoneData(bytes.NewBufferString(`
+thing.example.com. 10 IN A 7.7.7.7 ; owner=dubber
+new.example.com. 60 IN TXT "hello world" ; owner=dubber
+`))
+	if err != nil {
+		t.Fatalf("error parsing desired zone, %v", err)
+	}
+
+	var srv *Server
+	if err := srv.ReconcileZone(p, desired); err != nil {
+		t.Fatalf("error reconciling zone, %v", err)
+	}
+
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	exp := `; zone example.com., managed by dubber
+example.com.	3600	IN	NS	ns1.example.com.
+example.com.	3600	IN	SOA	ns1.example.com. root.example.com. 101 3600 1800 604800 86400
+new.example.com.	60	IN	TXT	"hello world" ; owner=dubber
+ns1.example.com.	3600	IN	A	10.0.0.1
+thing.example.com.	10	IN	A	7.7.7.7 ; owner=dubber
+`
+	if string(bs) != exp {
+		t.Fatalf("\n  expected:\n%s\n  got:\n%s", exp, bs)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	if fi.Mode().Perm() != 0640 {
+		t.Fatalf("expected file mode to be preserved, got %v", fi.Mode())
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Fatalf("expected reload command to be run, %v", err)
+	}
+	os.Remove(marker)
+
+	// Nothing left to do
+	if err := srv.ReconcileZone(p, desired); err != nil {
+		t.Fatalf("error reconciling zone, %v", err)
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Fatalf("expected no reload when nothing has changed")
+	}
+
+	// An update based on a stale SOA must be refused
+	var unwanted, wanted Zone
+	stale, err := ParseZoneData(bytes.NewBufferString(
+		`example.com. 3600 IN SOA ns1.example.com. root.example.com. 100 3600 1800 604800 86400`))
+	if err != nil {
+		t.Fatalf("unexpected error, %v", err)
+	}
+	unwanted = append(unwanted, stale...)
+	wanted = append(wanted, desired...)
+	if err := p.UpdateZone(wanted, unwanted, desired, nil); err == nil {
+		t.Fatalf("expected update with stale SOA to fail")
+	}
+
+	// A failing reload command is reported
+	cfg.ReloadCommand = []string{"false"}
+	other, _ := ParseZoneData(bytes.NewBufferString(`other.example.com. 60 IN A 1.1.1.1 ; owner=dubber`))
+	desired = append(desired, other...)
+	if err := srv.ReconcileZone(p, desired); err == nil {
+		t.Fatalf("expected failing reload command to be reported")
+	}
+}